@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+type RequeueRequest struct {
+	IDs    []string `json:"ids"`
+	Status string   `json:"status"`
+	From   int      `json:"from"`
+	To     int      `json:"to"`
+	Force  bool     `json:"force"`
+}
+
+func ledgerListEndpoint(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"cursor":  crawlLedger.Cursor(),
+		"counts":  crawlLedger.Counts(),
+		"entries": crawlLedger.List(c.Query("status")),
+	})
+}
+
+func ledgerEntryEndpoint(c *gin.Context) {
+	e, ok := crawlLedger.Get(c.Param("id"))
+	if !ok {
+		errorResponse(c, http.StatusNotFound, "Id not in ledger")
+		return
+	}
+	c.JSON(http.StatusOK, e)
+}
+
+func ledgerGapsEndpoint(c *gin.Context) {
+	from, _ := strconv.Atoi(c.Query("from"))
+	to, _ := strconv.Atoi(c.Query("to"))
+	c.JSON(http.StatusOK, gin.H{
+		"cursor": crawlLedger.Cursor(),
+		"gaps":   crawlLedger.Gaps(from, to),
+	})
+}
+
+// ledgerRequeueEndpoint queues IDs for the next crawl: explicit ids, every
+// entry with a status (e.g. "failed"), or every gap in a numeric range.
+func ledgerRequeueEndpoint(c *gin.Context) {
+	var req RequeueRequest
+	if err := c.BindJSON(&req); err != nil {
+		errorResponse(c, http.StatusBadRequest, "Malformed request body")
+		return
+	}
+	ids := append([]string(nil), req.IDs...)
+	if req.Status != "" {
+		ids = append(ids, crawlLedger.IDs(req.Status)...)
+	}
+	if req.To > 0 {
+		for _, gap := range crawlLedger.Gaps(req.From, req.To) {
+			for id := gap.From; id <= gap.To; id++ {
+				ids = append(ids, strconv.Itoa(id))
+			}
+		}
+	}
+	if len(ids) == 0 {
+		errorResponse(c, http.StatusBadRequest, "Nothing to requeue")
+		return
+	}
+	queued, err := crawlLedger.Requeue(ids, req.Force)
+	if err != nil {
+		errorResponse(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"queued": queued})
+}
+
+type CrawlStartRequest struct {
+	From      int    `json:"from"`
+	To        int    `json:"to"`
+	BatchSize int    `json:"batch_size"`
+	Interval  string `json:"interval"`
+}
+
+type CrawlConfigRequest struct {
+	BatchSize int    `json:"batch_size"`
+	Interval  string `json:"interval"`
+}
+
+func crawlStatusEndpoint(c *gin.Context) {
+	c.JSON(http.StatusOK, crawlControl.Progress())
+}
+
+// crawlStartEndpoint starts a crawl of the ID range from..to, or the
+// scheduled crawl from the ledger cursor when no range is given. The
+// batch size and interval are only changed if the crawl starts.
+func crawlStartEndpoint(c *gin.Context) {
+	var req CrawlStartRequest
+	if err := c.ShouldBindJSON(&req); err != nil && err != io.EOF {
+		errorResponse(c, http.StatusBadRequest, "Malformed request body")
+		return
+	}
+	if req.BatchSize < 0 {
+		errorResponse(c, http.StatusBadRequest, "batch_size must be positive")
+		return
+	}
+	interval, ok := parseInterval(c, req.Interval)
+	if !ok {
+		return
+	}
+	var err error
+	if req.From > 0 || req.To > 0 {
+		err = crawlControl.StartRange(req.From, req.To, req.BatchSize, interval)
+	} else {
+		err = crawlControl.StartSchedule(req.BatchSize, interval)
+	}
+	if err == errCrawlActive {
+		errorResponse(c, http.StatusConflict, err.Error())
+		return
+	}
+	if err != nil {
+		errorResponse(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, crawlControl.Progress())
+}
+
+func crawlPauseEndpoint(c *gin.Context) {
+	crawlStateChange(c, crawlControl.Pause)
+}
+
+func crawlResumeEndpoint(c *gin.Context) {
+	crawlStateChange(c, crawlControl.Resume)
+}
+
+func crawlCancelEndpoint(c *gin.Context) {
+	crawlStateChange(c, crawlControl.Cancel)
+}
+
+func crawlStateChange(c *gin.Context, change func() error) {
+	if err := change(); err != nil {
+		errorResponse(c, http.StatusConflict, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, crawlControl.Progress())
+}
+
+// crawlConfigEndpoint changes the batch size and interval of the running
+// crawl, or of the next one.
+func crawlConfigEndpoint(c *gin.Context) {
+	var req CrawlConfigRequest
+	if err := c.BindJSON(&req); err != nil {
+		errorResponse(c, http.StatusBadRequest, "Malformed request body")
+		return
+	}
+	if req.BatchSize < 0 {
+		errorResponse(c, http.StatusBadRequest, "batch_size must be positive")
+		return
+	}
+	interval, ok := parseInterval(c, req.Interval)
+	if !ok {
+		return
+	}
+	crawlControl.Configure(req.BatchSize, interval)
+	c.JSON(http.StatusOK, crawlControl.Progress())
+}
+
+// parseInterval parses a duration such as "30s" or "24h"; an empty string
+// is zero.
+func parseInterval(c *gin.Context, s string) (time.Duration, bool) {
+	if s == "" {
+		return 0, true
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		errorResponse(c, http.StatusBadRequest, "interval must be a positive duration like \"30s\"")
+		return 0, false
+	}
+	return d, true
+}
+
+type CatalogImportRequest struct {
+	Path string `json:"path"`
+}
+
+func catalogStatusEndpoint(c *gin.Context) {
+	status := catalogStatus()
+	status.Records = currentCatalog().Len()
+	c.JSON(http.StatusOK, status)
+}
+
+// catalogImportEndpoint loads an RDF catalog from a path on the server and
+// applies it to the index in the background.
+func catalogImportEndpoint(c *gin.Context) {
+	var req CatalogImportRequest
+	if err := c.BindJSON(&req); err != nil || req.Path == "" {
+		errorResponse(c, http.StatusBadRequest, "Malformed request body")
+		return
+	}
+	if catalogStatus().Running {
+		errorResponse(c, http.StatusConflict, "a catalog import is already running")
+		return
+	}
+	go func() {
+		if err := importCatalog(context.Background(), req.Path, nil); err != nil {
+			log.Println(err)
+		}
+	}()
+	c.JSON(http.StatusAccepted, gin.H{"path": req.Path})
+}
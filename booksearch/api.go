@@ -0,0 +1,485 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	requestIDHeader = "X-Request-ID"
+	requestIDKey    = "request_id"
+
+	codeInvalidJSON  = "invalid_json"
+	codeValidation   = "validation_failed"
+	codeNotFound     = "not_found"
+	codeConflict     = "conflict"
+	codePrecondition = "precondition_failed"
+	codeMediaType    = "unsupported_media_type"
+	codeInternal     = "internal_error"
+
+	// maxIDLength is the longest document ID Elasticsearch accepts.
+	maxIDLength = 512
+	// minReleaseYear is the earliest released_at accepted.
+	minReleaseYear = 1000
+)
+
+// requestID gives every request an ID, the caller's X-Request-ID if it
+// sent a reasonable one, and echoes it in the response.
+func requestID(c *gin.Context) {
+	id := c.GetHeader(requestIDHeader)
+	if id == "" || len(id) > 128 {
+		b := make([]byte, 16)
+		rand.Read(b)
+		id = hex.EncodeToString(b)
+	}
+	c.Set(requestIDKey, id)
+	c.Header(requestIDHeader, id)
+	c.Next()
+}
+
+// APIError is the error envelope of the /v1 routes.
+type APIError struct {
+	Code      string      `json:"code"`
+	Message   string      `json:"message"`
+	Details   interface{} `json:"details,omitempty"`
+	RequestID string      `json:"request_id"`
+}
+
+// FieldError is the detail of a validation error.
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+func apiError(c *gin.Context, status int, code, message string, details interface{}) {
+	c.AbortWithStatusJSON(status, gin.H{"error": APIError{
+		Code:      code,
+		Message:   message,
+		Details:   details,
+		RequestID: c.GetString(requestIDKey),
+	}})
+}
+
+// storeError answers for an error from the book store.
+func storeError(c *gin.Context, err error) {
+	if err == ErrNotFound {
+		apiError(c, http.StatusNotFound, codeNotFound, "Book not found", nil)
+		return
+	}
+	log.Println(err)
+	apiError(c, http.StatusInternalServerError, codeInternal, err.Error(), nil)
+}
+
+// BookResponse is a book as the /v1 routes return it. The paragraph and
+// chapter offsets are left to the passage and chapter routes.
+type BookResponse struct {
+	ID               string     `json:"id"`
+	Title            string     `json:"title"`
+	Author           string     `json:"author"`
+	CreatedAt        time.Time  `json:"created_at"`
+	UpdatedAt        *time.Time `json:"updated_at,omitempty"`
+	ReleasedAt       *time.Time `json:"released_at"`
+	ReleasePrecision string     `json:"release_precision,omitempty"`
+	Form             string     `json:"form,omitempty"`
+	Language         string     `json:"language,omitempty"`
+	Translator       string     `json:"translator,omitempty"`
+	Editor           string     `json:"editor,omitempty"`
+	Illustrator      string     `json:"illustrator,omitempty"`
+	EbookNumber      string     `json:"ebook_number,omitempty"`
+	Footnotes        []Footnote `json:"footnotes,omitempty"`
+	Content          string     `json:"content"`
+	CatalogRecord
+}
+
+func newBookResponse(b Book) BookResponse {
+	return BookResponse{
+		ID:               b.ID,
+		Title:            b.Title,
+		Author:           b.Author,
+		CreatedAt:        b.CreatedAt,
+		UpdatedAt:        b.UpdatedAt,
+		ReleasedAt:       b.ReleasedAt,
+		ReleasePrecision: b.ReleasePrecision,
+		Form:             b.Form,
+		Language:         b.Language,
+		Translator:       b.Translator,
+		Editor:           b.Editor,
+		Illustrator:      b.Illustrator,
+		EbookNumber:      b.EbookNumber,
+		Footnotes:        b.Footnotes,
+		Content:          b.Content,
+		CatalogRecord:    b.CatalogRecord,
+	}
+}
+
+type DeleteBookResponse struct {
+	ID     string `json:"id"`
+	Result string `json:"result"`
+}
+
+// validateBookRequest lists what is wrong with a book to be stored under
+// id; an empty id is generated by createBook.
+func validateBookRequest(id string, req CreateBookRequest) []FieldError {
+	errs := validateBookID(id)
+	if req.ID != "" && req.ID != id {
+		errs = append(errs, FieldError{"id", "does not match the book in the URL"})
+	}
+	if strings.TrimSpace(req.Title) == "" {
+		errs = append(errs, FieldError{"title", "is required"})
+	}
+	if strings.TrimSpace(req.Content) == "" {
+		errs = append(errs, FieldError{"content", "is required"})
+	}
+	if t := req.ReleasedAt; t != nil && (t.Year() < minReleaseYear || t.After(time.Now().Add(24*time.Hour))) {
+		errs = append(errs, FieldError{"released_at", fmt.Sprintf("must be between the year %d and today", minReleaseYear)})
+	}
+	return errs
+}
+
+// validateBookID checks an ID can be used in a /v1/books/:id path.
+func validateBookID(id string) []FieldError {
+	switch {
+	case id == "":
+	case len(id) > maxIDLength:
+		return []FieldError{{"id", "is longer than 512 bytes"}}
+	case strings.ContainsAny(id, "/?#") || strings.TrimSpace(id) != id:
+		return []FieldError{{"id", "may not contain /, ?, # or surrounding spaces"}}
+	}
+	return nil
+}
+
+// fieldErrorMessage joins validation errors into one message, for the
+// routes without the error envelope.
+func fieldErrorMessage(errs []FieldError) string {
+	parts := make([]string, len(errs))
+	for i, e := range errs {
+		parts[i] = e.Field + " " + e.Message
+	}
+	return strings.Join(parts, "; ")
+}
+
+// generatedBookID derives the ID of a book posted without one from its
+// title, author and content, so posting the same book again is a conflict
+// rather than a copy.
+func generatedBookID(req CreateBookRequest) string {
+	h := sha256.New()
+	for _, part := range []string{req.Title, req.Author, req.Content} {
+		io.WriteString(h, strings.TrimSpace(part))
+		h.Write([]byte{0})
+	}
+	return "book-" + hex.EncodeToString(h.Sum(nil))[:16]
+}
+
+// createBook stores the book of a validated create request, which fails
+// with ErrConflict if its ID is taken.
+func createBook(ctx context.Context, req CreateBookRequest) (Book, error) {
+	if req.ID == "" {
+		req.ID = generatedBookID(req)
+	}
+	book := newBook(req)
+	return book, bookStore.Create(ctx, book)
+}
+
+func bookLocation(id string) string {
+	return "/v1/books/" + url.PathEscape(id)
+}
+
+// bindBook reads the request body of a /v1 book route, answering for it if
+// it is not valid. id is the book in the URL, if there is one.
+func bindBook(c *gin.Context, id string) (CreateBookRequest, bool) {
+	var req CreateBookRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		apiError(c, http.StatusBadRequest, codeInvalidJSON, "Malformed request body", err.Error())
+		return req, false
+	}
+	if id == "" {
+		id = req.ID
+	}
+	if errs := validateBookRequest(id, req); len(errs) > 0 {
+		apiError(c, http.StatusUnprocessableEntity, codeValidation, "Invalid book", errs)
+		return req, false
+	}
+	return req, true
+}
+
+func getBookV1(c *gin.Context) {
+	src, v, err := bookStore.GetVersion(c, c.Param("id"))
+	if err != nil {
+		storeError(c, err)
+		return
+	}
+	c.Header("ETag", v.ETag())
+	if etagMatches(c.GetHeader("If-None-Match"), v) {
+		c.Status(http.StatusNotModified)
+		return
+	}
+	var book Book
+	if err := json.Unmarshal(src, &book); err != nil {
+		storeError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, newBookResponse(book))
+}
+
+// createBookV1 stores a new book; an existing one with the same ID is a
+// conflict.
+func createBookV1(c *gin.Context) {
+	req, ok := bindBook(c, "")
+	if !ok {
+		return
+	}
+	book, err := createBook(c, req)
+	if err == ErrConflict {
+		apiError(c, http.StatusConflict, codeConflict, "A book with this id already exists", gin.H{"id": book.ID})
+		return
+	}
+	if err != nil {
+		storeError(c, err)
+		return
+	}
+	c.Header("Location", bookLocation(book.ID))
+	c.JSON(http.StatusCreated, newBookResponse(book))
+}
+
+// replaceBookV1 replaces a book with the one in the body; writable fields
+// left out are gone afterwards. See replacement for what is kept.
+func replaceBookV1(c *gin.Context) {
+	id := c.Param("id")
+	req, ok := bindBook(c, id)
+	if !ok {
+		return
+	}
+	req.ID = id
+	book, v, _, err := editBook(c, id, c.GetHeader("If-Match"), func(existing Book) (Book, []FieldError) {
+		return replacement(existing, req), nil
+	})
+	editResponse(c, book, v, nil, err)
+}
+
+// patchBookV1 applies a JSON merge patch (RFC 7396) to the title, author,
+// released_at and content of a book; the other fields are kept.
+func patchBookV1(c *gin.Context) {
+	switch contentType := c.ContentType(); contentType {
+	case "application/merge-patch+json", "application/json":
+	default:
+		apiError(c, http.StatusUnsupportedMediaType, codeMediaType, "Send a JSON merge patch as application/merge-patch+json", gin.H{"content_type": contentType})
+		return
+	}
+	var patch map[string]json.RawMessage
+	if err := json.NewDecoder(c.Request.Body).Decode(&patch); err != nil {
+		apiError(c, http.StatusBadRequest, codeInvalidJSON, "The merge patch must be a JSON object", err.Error())
+		return
+	}
+	book, v, errs, err := editBook(c, c.Param("id"), c.GetHeader("If-Match"), func(existing Book) (Book, []FieldError) {
+		return mergePatchBook(existing, patch)
+	})
+	editResponse(c, book, v, errs, err)
+}
+
+func editResponse(c *gin.Context, book Book, v Version, errs []FieldError, err error) {
+	switch {
+	case len(errs) > 0:
+		apiError(c, http.StatusUnprocessableEntity, codeValidation, "Invalid book", errs)
+	case err == errIfMatch, err == ErrPreconditionFailed && c.GetHeader("If-Match") != "":
+		apiError(c, http.StatusPreconditionFailed, codePrecondition, errIfMatch.Error(), gin.H{"if_match": c.GetHeader("If-Match")})
+	case err == ErrPreconditionFailed:
+		apiError(c, http.StatusConflict, codeConflict, "The book was changed by another request; read it again and retry", nil)
+	case err != nil:
+		storeError(c, err)
+	default:
+		c.Header("ETag", v.ETag())
+		c.JSON(http.StatusOK, newBookResponse(book))
+	}
+}
+
+var errIfMatch = errors.New("If-Match does not name the current version of the book")
+
+// editBook reads a book, lets edit change it and writes it back, setting
+// updated_at. The write only succeeds if the book is still at the version
+// read, so a concurrent edit fails with ErrPreconditionFailed instead of
+// being lost; an ifMatch header naming another version fails with
+// errIfMatch before edit runs.
+func editBook(ctx context.Context, id, ifMatch string, edit func(existing Book) (Book, []FieldError)) (Book, Version, []FieldError, error) {
+	src, current, err := bookStore.GetVersion(ctx, id)
+	if err != nil {
+		return Book{}, Version{}, nil, err
+	}
+	if ifMatch != "" && !etagMatches(ifMatch, current) {
+		return Book{}, Version{}, nil, errIfMatch
+	}
+	var existing Book
+	if err := json.Unmarshal(src, &existing); err != nil {
+		return Book{}, Version{}, nil, err
+	}
+	book, errs := edit(existing)
+	if len(errs) > 0 {
+		return Book{}, Version{}, errs, nil
+	}
+	now := time.Now().UTC()
+	book.UpdatedAt = &now
+	v, err := bookStore.Replace(ctx, book, current)
+	return book, v, nil, err
+}
+
+// etagMatches reports whether an If-Match or If-None-Match header names
+// version v. Tags are compared strongly.
+func etagMatches(header string, v Version) bool {
+	for _, tag := range strings.Split(header, ",") {
+		if tag = strings.TrimSpace(tag); tag == "*" || tag == v.ETag() {
+			return true
+		}
+	}
+	return false
+}
+
+// replacement is the book stored by a full replace of existing. Only the
+// fields a client can write are replaced; the header and catalog metadata
+// the crawl recorded are not in the request and are carried over, as is
+// the release date as written while released_at is unchanged.
+func replacement(existing Book, req CreateBookRequest) Book {
+	book := newBook(req)
+	book.CreatedAt = existing.CreatedAt
+	book.Encoding = existing.Encoding
+	book.Translator = existing.Translator
+	book.Editor = existing.Editor
+	book.Illustrator = existing.Illustrator
+	book.Language = existing.Language
+	book.PostingDate = existing.PostingDate
+	book.LastUpdated = existing.LastUpdated
+	book.EbookNumber = existing.EbookNumber
+	book.CatalogRecord = existing.CatalogRecord
+	if sameTime(book.ReleasedAt, existing.ReleasedAt) {
+		book.ReleasePrecision, book.ReleaseDateRaw = existing.ReleasePrecision, existing.ReleaseDateRaw
+	}
+	return book
+}
+
+func sameTime(a, b *time.Time) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Equal(*b)
+}
+
+// mergePatchBook applies a merge patch to the writable fields of a book:
+// a value replaces the field and null clears it. Content that changes is
+// normalized again.
+func mergePatchBook(existing Book, patch map[string]json.RawMessage) (Book, []FieldError) {
+	req := CreateBookRequest{
+		ID:         existing.ID,
+		Title:      existing.Title,
+		Author:     existing.Author,
+		ReleasedAt: existing.ReleasedAt,
+		Content:    existing.Content,
+	}
+	fields := make([]string, 0, len(patch))
+	for field := range patch {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	var errs []FieldError
+	for _, field := range fields {
+		value := patch[field]
+		if string(bytes.TrimSpace(value)) == "null" {
+			value = nil
+		}
+		var err error
+		switch field {
+		case "title":
+			err = patchString(value, &req.Title)
+		case "author":
+			err = patchString(value, &req.Author)
+		case "content":
+			err = patchString(value, &req.Content)
+		case "released_at":
+			req.ReleasedAt = nil
+			if value != nil {
+				err = json.Unmarshal(value, &req.ReleasedAt)
+			}
+		default:
+			errs = append(errs, FieldError{field, "cannot be changed"})
+			continue
+		}
+		if err != nil {
+			errs = append(errs, FieldError{field, "has the wrong type"})
+		}
+	}
+	errs = append(errs, validateBookRequest(existing.ID, req)...)
+	if len(errs) > 0 {
+		return Book{}, errs
+	}
+
+	_, contentChanged := patch["content"]
+	if !contentChanged {
+		// Spare newBook normalizing the content again.
+		req.Content = ""
+	}
+	fresh := newBook(req)
+	book := existing
+	if _, ok := patch["title"]; ok {
+		book.Title = fresh.Title
+	}
+	if _, ok := patch["author"]; ok {
+		book.Author = fresh.Author
+	}
+	if _, ok := patch["released_at"]; ok {
+		book.ReleasedAt, book.ReleasePrecision, book.ReleaseDateRaw = fresh.ReleasedAt, fresh.ReleasePrecision, ""
+	}
+	if contentChanged {
+		book.Content = fresh.Content
+		book.Paragraphs, book.Footnotes, book.Chapters, book.Form = fresh.Paragraphs, fresh.Footnotes, fresh.Chapters, fresh.Form
+	}
+	return book, nil
+}
+
+func patchString(value json.RawMessage, s *string) error {
+	if value == nil {
+		*s = ""
+		return nil
+	}
+	return json.Unmarshal(value, s)
+}
+
+func deleteBookV1(c *gin.Context) {
+	id := c.Param("id")
+	header := c.GetHeader("If-Match")
+	var err error
+	if header == "" {
+		_, err = bookStore.Delete(c, id)
+	} else {
+		// Deleted only if still at the version the tag was checked
+		// against.
+		var current Version
+		if _, current, err = bookStore.GetVersion(c, id); err == nil {
+			if !etagMatches(header, current) {
+				err = errIfMatch
+			} else {
+				_, err = bookStore.DeleteIf(c, id, current)
+			}
+		}
+	}
+	if err == errIfMatch || err == ErrPreconditionFailed {
+		apiError(c, http.StatusPreconditionFailed, codePrecondition, errIfMatch.Error(), gin.H{"if_match": header})
+		return
+	}
+	if err != nil {
+		storeError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, DeleteBookResponse{ID: id, Result: "deleted"})
+}
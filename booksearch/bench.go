@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// benchPlan is one way of answering a search query.
+type benchPlan struct {
+	name   string
+	search func(ctx context.Context, terms []string) (int, error)
+}
+
+// runSearchBenchmark times every query in the file at path, one per line,
+// runs times over against each search plan the store supports, and
+// writes latency percentiles to w. With the elastic engine it compares
+// the span_near path with the analyzed one on the same index.
+func runSearchBenchmark(w io.Writer, store BookStore, path string, runs int) error {
+	queries, err := readBenchQueries(path)
+	if err != nil {
+		return err
+	}
+	if len(queries) == 0 {
+		return fmt.Errorf("%s has no queries", path)
+	}
+	ctx := context.Background()
+	plans := benchPlans(ctx, w, store)
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "plan\tqueries\tmean\tp50\tp95\tmax\thits/query\t")
+	for _, plan := range plans {
+		var latencies []time.Duration
+		hits := 0
+		for run := 0; run < runs; run++ {
+			for _, terms := range queries {
+				start := time.Now()
+				n, err := plan.search(ctx, terms)
+				if err != nil {
+					return fmt.Errorf("%s %q: %v", plan.name, strings.Join(terms, " "), err)
+				}
+				latencies = append(latencies, time.Since(start))
+				hits += n
+			}
+		}
+		sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+		var total time.Duration
+		for _, d := range latencies {
+			total += d
+		}
+		n := len(latencies)
+		fmt.Fprintf(tw, "%s\t%d\t%v\t%v\t%v\t%v\t%.1f\t\n", plan.name, n,
+			(total / time.Duration(n)).Round(time.Microsecond),
+			latencies[n/2].Round(time.Microsecond),
+			latencies[n*95/100].Round(time.Microsecond),
+			latencies[n-1].Round(time.Microsecond),
+			float64(hits)/float64(n))
+	}
+	return tw.Flush()
+}
+
+// benchPlans returns the search plans store supports, noting on w what
+// it found. With the elastic engine that is the span_near path and, on an
+// analyzed index, the analyzed one.
+func benchPlans(ctx context.Context, w io.Writer, store BookStore) []benchPlan {
+	es, ok := store.(*ElasticStore)
+	if !ok {
+		return []benchPlan{{"span_near", func(ctx context.Context, terms []string) (int, error) {
+			return legacySearch(ctx, store.Search, terms)
+		}}}
+	}
+	if docs, err := es.client.Count(es.index).Do(ctx); err == nil {
+		fmt.Fprintf(w, "index %s: %d books\n", es.index, docs)
+	}
+	plans := []benchPlan{{"span_near", func(ctx context.Context, terms []string) (int, error) {
+		return legacySearch(ctx, es.searchSpan, terms)
+	}}}
+	if !analyzedIndex(es.index) {
+		fmt.Fprintf(w, "index %s has no analyzed fields; reindex it to compare\n", es.index)
+		return plans
+	}
+	return append(plans, benchPlan{"analyzed", func(ctx context.Context, terms []string) (int, error) {
+		q := newSpanQuery("content", terms)
+		q.Size = 1000
+		hits, err := es.searchAnalyzed(ctx, q)
+		return len(hits), err
+	}})
+}
+
+// legacySearch replays what searchEndpoint did before the analyzed
+// mapping: up to 1000 span hits, then, if fewer than 30 came back, one
+// more query per term with that term left out.
+func legacySearch(ctx context.Context, search func(context.Context, SpanQuery) ([]SearchHit, error), terms []string) (int, error) {
+	q := newSpanQuery("content", terms)
+	q.Size = 1000
+	hits, err := search(ctx, q)
+	if err != nil {
+		return 0, err
+	}
+	total := len(hits)
+	if len(terms) > 1 && total < 30 {
+		for i := range terms {
+			rest := append(append([]string{}, terms[:i]...), terms[i+1:]...)
+			q := newSpanQuery("content", rest)
+			q.Size = 30
+			more, err := search(ctx, q)
+			if err != nil {
+				return 0, err
+			}
+			total += len(more)
+		}
+	}
+	return total, nil
+}
+
+func readBenchQueries(path string) ([][]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var queries [][]string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if terms := normalizeQuery(line); len(terms) > 0 {
+			queries = append(queries, terms)
+		}
+	}
+	return queries, scanner.Err()
+}
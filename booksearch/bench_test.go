@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/olivere/elastic"
+)
+
+// benchLibrary builds n books of words drawn from the benchmark queries
+// and the Gutenberg fixtures, so every query has hits and near misses.
+func benchLibrary(b *testing.B, n, words int) []Book {
+	b.Helper()
+	queries, err := readBenchQueries(filepath.Join("testdata", "bench", "queries.txt"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	var vocabulary []string
+	for _, terms := range queries {
+		vocabulary = append(vocabulary, terms...)
+	}
+	texts, _ := filepath.Glob(filepath.Join("testdata", "gutenberg", "*.txt"))
+	for _, text := range texts {
+		data, err := ioutil.ReadFile(text)
+		if err != nil {
+			b.Fatal(err)
+		}
+		vocabulary = append(vocabulary, normalizeQuery(string(data))...)
+	}
+
+	rnd := rand.New(rand.NewSource(1))
+	books := make([]Book, n)
+	for i := range books {
+		content := make([]string, 0, words)
+		for len(content) < words {
+			if rnd.Intn(50) == 0 {
+				// Now and then a whole query, as a phrase.
+				content = append(content, queries[rnd.Intn(len(queries))]...)
+				continue
+			}
+			content = append(content, vocabulary[rnd.Intn(len(vocabulary))])
+		}
+		id := fmt.Sprint(i + 1)
+		books[i] = Book{ID: id, Title: "Book " + id, Author: "Someone", Content: strings.Join(content, " ")}
+	}
+	return books
+}
+
+// benchmarkPlans runs each plan as a sub-benchmark, one query of
+// testdata/bench/queries.txt per iteration.
+func benchmarkPlans(b *testing.B, plans []benchPlan) {
+	queries, err := readBenchQueries(filepath.Join("testdata", "bench", "queries.txt"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	ctx := context.Background()
+	for _, plan := range plans {
+		b.Run(plan.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := plan.search(ctx, queries[i%len(queries)]); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkSearchSpan times the span path of the memory engine over a
+// generated library of 1000 books of 2000 words.
+func BenchmarkSearchSpan(b *testing.B) {
+	store := NewMemoryStore()
+	if err := store.Bulk(context.Background(), benchLibrary(b, 1000, 2000)); err != nil {
+		b.Fatal(err)
+	}
+	benchmarkPlans(b, benchPlans(context.Background(), ioutil.Discard, store))
+}
+
+// benchElastic connects to the cluster at $BENCH_ELASTIC_URL, skipping
+// the benchmark if it is not set.
+func benchElastic(b *testing.B) *elastic.Client {
+	b.Helper()
+	url := os.Getenv("BENCH_ELASTIC_URL")
+	if url == "" {
+		b.Skip("BENCH_ELASTIC_URL is not set")
+	}
+	cfg := defaultElasticConfig
+	cfg.URLs = url
+	cfg.StartupAttempts = 1
+	client, err := connectElastic(cfg)
+	if err != nil {
+		b.Fatal(err)
+	}
+	if elasticCluster, err = detectCluster(context.Background(), client); err != nil {
+		b.Fatal(err)
+	}
+	return client
+}
+
+// BenchmarkSearchElastic times the span path and, on an analyzed index,
+// the analyzed path against the books alias of the cluster at
+// $BENCH_ELASTIC_URL. It only reads; index the books to measure first.
+func BenchmarkSearchElastic(b *testing.B) {
+	client := benchElastic(b)
+	ctx := context.Background()
+	current, err := aliasTarget(ctx, client, elasticIndexName)
+	if err != nil {
+		b.Fatal(err)
+	}
+	if current == "" {
+		b.Skipf("no %s alias on %s", elasticIndexName, os.Getenv("BENCH_ELASTIC_URL"))
+	}
+	setServedVersion(elasticIndexName, booksIndex.indexVersion(current))
+
+	store := NewElasticStore(client, elasticIndexName, elasticCluster.docType())
+	benchmarkPlans(b, benchPlans(ctx, ioutil.Discard, store))
+}
+
+// BenchmarkSearchElasticFresh indexes a generated library of 5000 books of
+// 2000 words into a fresh index of the current books mapping, under an
+// alias of its own, and times both plans against it. The index is deleted
+// afterwards.
+func BenchmarkSearchElasticFresh(b *testing.B) {
+	client := benchElastic(b)
+	ctx := context.Background()
+	d := booksIndex
+	d.Alias = "bench_" + booksIndex.Alias
+	name := d.indexName(d.Version)
+	if _, err := client.CreateIndex(name).BodyJson(d.body()).Do(ctx); err != nil {
+		b.Fatalf("create index %s: %v", name, err)
+	}
+	b.Cleanup(func() {
+		if _, err := client.DeleteIndex(name).Do(context.Background()); err != nil {
+			b.Log(err)
+		}
+	})
+	if _, err := client.Alias().Add(name, d.Alias).Do(ctx); err != nil {
+		b.Fatal(err)
+	}
+	indexDefinitions[d.Alias] = d
+	setServedVersion(d.Alias, d.Version)
+	b.Cleanup(func() { delete(indexDefinitions, d.Alias) })
+
+	store := NewElasticStore(client, d.Alias, elasticCluster.docType())
+	books := benchLibrary(b, 5000, 2000)
+	for len(books) > 0 {
+		n := 200
+		if n > len(books) {
+			n = len(books)
+		}
+		if err := store.Bulk(ctx, books[:n]); err != nil {
+			b.Fatal(err)
+		}
+		books = books[n:]
+	}
+	if _, err := client.Refresh(name).Do(ctx); err != nil {
+		b.Fatal(err)
+	}
+	benchmarkPlans(b, benchPlans(ctx, ioutil.Discard, store))
+}
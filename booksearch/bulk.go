@@ -0,0 +1,333 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// bulkChunkLines and bulkChunkBytes bound how much of a bulk request
+	// is held in memory and sent to the store at once.
+	bulkChunkLines = 100
+	bulkChunkBytes = 8 << 20
+	// maxBulkLine is the longest line accepted, one book with its content.
+	maxBulkLine = 64 << 20
+
+	bulkIndex  = "index"
+	bulkUpdate = "update"
+	bulkDelete = "delete"
+)
+
+// BulkLine is one line of a POST /books/_bulk body: a CreateBookRequest
+// and what to do with it. Action defaults to index; update merges the
+// fields given into the book, as PATCH /v1/books/:id does; delete only
+// needs the id.
+type BulkLine struct {
+	Action string `json:"action"`
+	CreateBookRequest
+}
+
+// BulkItem is the outcome of one line, numbered from 1. Status is the HTTP
+// status the single-book endpoint would have answered.
+type BulkItem struct {
+	Line   int    `json:"line"`
+	ID     string `json:"id,omitempty"`
+	Action string `json:"action,omitempty"`
+	Status int    `json:"status"`
+	Result string `json:"result,omitempty"`
+	Error  string `json:"error,omitempty"`
+	// Details lists the fields that failed validation.
+	Details []FieldError `json:"details,omitempty"`
+}
+
+type BulkResponse struct {
+	Took   int64      `json:"took_ms"`
+	DryRun bool       `json:"dry_run"`
+	Errors bool       `json:"errors"`
+	Items  []BulkItem `json:"items"`
+}
+
+// bulkOp is a parsed line waiting in a chunk; item is its index in
+// BulkResponse.Items. An index line carries its request, an update its
+// line as a merge patch.
+type bulkOp struct {
+	item   int
+	action string
+	book   Book
+	req    CreateBookRequest
+	patch  map[string]json.RawMessage
+}
+
+// validate checks a line before anything is written: an index line as
+// POST /v1/books would, an update or delete by its id. The fields of an
+// update are checked against the book it changes when it is applied.
+func (l BulkLine) validate() []FieldError {
+	switch l.Action {
+	case bulkIndex, bulkUpdate, bulkDelete:
+	default:
+		return []FieldError{{"action", fmt.Sprintf("is %q: use index, update or delete", l.Action)}}
+	}
+	if l.ID == "" {
+		return []FieldError{{"id", "is required"}}
+	}
+	if l.Action == bulkIndex {
+		return validateBookRequest(l.ID, l.CreateBookRequest)
+	}
+	return validateBookID(l.ID)
+}
+
+// bulkBooksEndpoint reads NDJSON lines of books and applies them in
+// chunks of at most bulkChunkLines lines or bulkChunkBytes bytes. A bad
+// line fails on its own; the others are still applied. With
+// dry_run=true, lines are only parsed and validated, and updates and
+// deletes are checked against the books that exist.
+func bulkBooksEndpoint(c *gin.Context) {
+	dryRun, _ := strconv.ParseBool(c.Query("dry_run"))
+	start := time.Now()
+	res := BulkResponse{DryRun: dryRun, Items: make([]BulkItem, 0)}
+
+	reader := bufio.NewReader(c.Request.Body)
+	var chunk []bulkOp
+	chunkBytes := 0
+	// written holds the books earlier lines of a dry run would have
+	// written, and nil for those they would have deleted.
+	written := map[string]*Book{}
+	flush := func() {
+		if dryRun {
+			checkBulkChunk(c, res.Items, chunk, written)
+		} else {
+			applyBulkChunk(c, res.Items, chunk)
+		}
+		chunk, chunkBytes = chunk[:0], 0
+	}
+
+	line := 0
+	for {
+		raw, err := readBulkLine(reader)
+		if err == io.EOF {
+			break
+		}
+		line++
+		res.Items = append(res.Items, BulkItem{Line: line})
+		item := &res.Items[len(res.Items)-1]
+		if err == errBulkLineTooLong {
+			item.Status, item.Error = http.StatusRequestEntityTooLarge, err.Error()
+			continue
+		}
+		if err != nil {
+			log.Println(err)
+			errorResponse(c, http.StatusBadRequest, err.Error())
+			return
+		}
+		if len(bytes.TrimSpace(raw)) == 0 {
+			item.Status, item.Result = http.StatusOK, "skipped"
+			continue
+		}
+
+		var l BulkLine
+		if err := json.Unmarshal(raw, &l); err != nil {
+			item.Status, item.Error = http.StatusBadRequest, "Malformed JSON: "+err.Error()
+			continue
+		}
+		if l.Action == "" {
+			l.Action = bulkIndex
+		}
+		item.ID, item.Action = l.ID, l.Action
+		if errs := l.validate(); len(errs) > 0 {
+			setBulkFieldErrors(item, errs)
+			continue
+		}
+		op := bulkOp{item: line - 1, action: l.Action, book: Book{ID: l.ID}}
+		switch l.Action {
+		case bulkIndex:
+			op.book, op.req = newBook(l.CreateBookRequest), l.CreateBookRequest
+		case bulkUpdate:
+			json.Unmarshal(raw, &op.patch)
+			delete(op.patch, "action")
+			delete(op.patch, "id")
+		}
+		chunk = append(chunk, op)
+		chunkBytes += len(raw)
+		if len(chunk) == bulkChunkLines || chunkBytes >= bulkChunkBytes {
+			flush()
+		}
+	}
+	flush()
+
+	for _, item := range res.Items {
+		if item.Error != "" {
+			res.Errors = true
+			break
+		}
+	}
+	res.Took = time.Since(start).Milliseconds()
+	c.JSON(http.StatusOK, res)
+}
+
+var errBulkLineTooLong = fmt.Errorf("line longer than %d bytes", maxBulkLine)
+
+// readBulkLine reads one line without its newline. A line over
+// maxBulkLine is skipped to its end and reported as errBulkLineTooLong.
+func readBulkLine(r *bufio.Reader) ([]byte, error) {
+	var line []byte
+	tooLong := false
+	for {
+		part, err := r.ReadSlice('\n')
+		if !tooLong {
+			if len(line)+len(part) > maxBulkLine {
+				tooLong, line = true, nil
+			} else {
+				line = append(line, part...)
+			}
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err == io.EOF && (len(line) > 0 || tooLong) {
+			err = nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if tooLong {
+			return nil, errBulkLineTooLong
+		}
+		return bytes.TrimRight(line, "\r\n"), nil
+	}
+}
+
+// applyBulkChunk writes a chunk in order, indexing the new books of runs
+// of consecutive index lines with one Bulk call.
+func applyBulkChunk(ctx context.Context, items []BulkItem, chunk []bulkOp) {
+	for i := 0; i < len(chunk); {
+		op := chunk[i]
+		switch op.action {
+		case bulkIndex:
+			j := i
+			for j < len(chunk) && chunk[j].action == bulkIndex {
+				j++
+			}
+			applyBulkIndex(ctx, items, chunk[i:j])
+			i = j
+			continue
+		case bulkUpdate:
+			_, _, errs, err := editBook(ctx, op.book.ID, "", func(existing Book) (Book, []FieldError) {
+				return mergePatchBook(existing, op.patch)
+			})
+			if len(errs) > 0 {
+				setBulkFieldErrors(&items[op.item], errs)
+				break
+			}
+			setBulkResult(&items[op.item], err, "updated")
+		case bulkDelete:
+			_, err := bookStore.Delete(ctx, op.book.ID)
+			setBulkResult(&items[op.item], err, "deleted")
+		}
+		i++
+	}
+}
+
+// applyBulkIndex indexes a run of index lines. A line for a book that
+// exists replaces it as PUT /v1/books/:id does, keeping what replacement
+// keeps; the new books go to the store with one Bulk call.
+func applyBulkIndex(ctx context.Context, items []BulkItem, ops []bulkOp) {
+	var fresh []bulkOp
+	for _, op := range ops {
+		_, _, _, err := editBook(ctx, op.book.ID, "", func(existing Book) (Book, []FieldError) {
+			return replacement(existing, op.req), nil
+		})
+		if err == ErrNotFound {
+			fresh = append(fresh, op)
+			continue
+		}
+		setBulkResult(&items[op.item], err, "indexed")
+	}
+	if len(fresh) == 0 {
+		return
+	}
+	books := make([]Book, len(fresh))
+	for i, op := range fresh {
+		books[i] = op.book
+	}
+	err := bookStore.Bulk(ctx, books)
+	bulkErr, partial := err.(*BulkError)
+	for _, op := range fresh {
+		if partial {
+			setBulkResult(&items[op.item], bulkErr.Failed[op.book.ID], "indexed")
+		} else {
+			setBulkResult(&items[op.item], err, "indexed")
+		}
+	}
+	if err != nil && !partial {
+		log.Println(err)
+	}
+}
+
+// checkBulkChunk is the dry run of a chunk: books to update or delete
+// must exist, in the store or by an earlier line, and an update must
+// leave its book valid.
+func checkBulkChunk(ctx context.Context, items []BulkItem, chunk []bulkOp, written map[string]*Book) {
+	for _, op := range chunk {
+		if op.action == bulkIndex {
+			book := op.book
+			written[op.book.ID] = &book
+			setBulkResult(&items[op.item], nil, "valid")
+			continue
+		}
+		book, known := written[op.book.ID]
+		if !known {
+			src, err := bookStore.Get(ctx, op.book.ID)
+			if err == nil {
+				book = new(Book)
+				err = json.Unmarshal(src, book)
+			}
+			if err != nil && err != ErrNotFound {
+				setBulkResult(&items[op.item], err, "valid")
+				continue
+			}
+		}
+		if book == nil {
+			setBulkResult(&items[op.item], ErrNotFound, "valid")
+			continue
+		}
+		if op.action == bulkDelete {
+			written[op.book.ID] = nil
+			setBulkResult(&items[op.item], nil, "valid")
+			continue
+		}
+		updated, errs := mergePatchBook(*book, op.patch)
+		if len(errs) > 0 {
+			setBulkFieldErrors(&items[op.item], errs)
+			continue
+		}
+		written[op.book.ID] = &updated
+		setBulkResult(&items[op.item], nil, "valid")
+	}
+}
+
+func setBulkResult(item *BulkItem, err error, result string) {
+	switch {
+	case err == nil:
+		item.Status, item.Result = http.StatusOK, result
+	case err == ErrNotFound:
+		item.Status, item.Error = http.StatusNotFound, err.Error()
+	case err == ErrPreconditionFailed:
+		item.Status, item.Error = http.StatusConflict, "the book was changed by another request; retry the line"
+	default:
+		item.Status, item.Error = http.StatusInternalServerError, err.Error()
+	}
+}
+
+func setBulkFieldErrors(item *BulkItem, errs []FieldError) {
+	item.Status, item.Error, item.Details = http.StatusUnprocessableEntity, fieldErrorMessage(errs), errs
+}
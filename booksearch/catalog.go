@@ -0,0 +1,522 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// CatalogRecord is the metadata the Gutenberg RDF catalog holds for an
+// ebook. It is embedded in Book, so its fields are stored at the top level
+// of the document.
+type CatalogRecord struct {
+	Subjects    []string `json:"subjects,omitempty"`
+	Bookshelves []string `json:"bookshelves,omitempty"`
+	Languages   []string `json:"languages,omitempty"`
+	LoCC        []string `json:"locc,omitempty"`
+	Authors     []Person `json:"authors,omitempty"`
+	Translators []Person `json:"translators,omitempty"`
+	Editors     []Person `json:"editors,omitempty"`
+	Downloads   int      `json:"downloads,omitempty"`
+	Formats     []string `json:"formats,omitempty"`
+}
+
+type Person struct {
+	Name      string `json:"name"`
+	BirthYear int    `json:"birth_year,omitempty"`
+	DeathYear int    `json:"death_year,omitempty"`
+}
+
+// catalogFilters maps the search filter parameters to the document fields
+// they match.
+var catalogFilters = map[string]string{
+	"subject":    "subjects",
+	"bookshelf":  "bookshelves",
+	"language":   "languages",
+	"locc":       "locc",
+	"author":     "authors.name",
+	"translator": "translators.name",
+	"editor":     "editors.name",
+	"format":     "formats",
+}
+
+// Catalog holds the records of an imported RDF catalog, keyed by ebook ID.
+type Catalog struct {
+	mu      sync.RWMutex
+	records map[string]CatalogRecord
+	// maxID is the highest numeric ebook ID in records.
+	maxID int
+}
+
+func NewCatalog() *Catalog {
+	return &Catalog{records: make(map[string]CatalogRecord)}
+}
+
+func (c *Catalog) Get(id string) (CatalogRecord, bool) {
+	if c == nil {
+		return CatalogRecord{}, false
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	r, ok := c.records[id]
+	return r, ok
+}
+
+func (c *Catalog) Len() int {
+	if c == nil {
+		return 0
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return len(c.records)
+}
+
+// MaxID returns the highest numeric ebook ID in the catalog, 0 if there
+// is none.
+func (c *Catalog) MaxID() int {
+	if c == nil {
+		return 0
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.maxID
+}
+
+func (c *Catalog) IDs() []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	ids := make([]string, 0, len(c.records))
+	for id := range c.records {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// Enrich copies the catalog record for book.ID, if any, onto book.
+func (c *Catalog) Enrich(book *Book) bool {
+	r, ok := c.Get(book.ID)
+	if ok {
+		book.CatalogRecord = r
+	}
+	return ok
+}
+
+func (c *Catalog) add(id string, r CatalogRecord) {
+	c.mu.Lock()
+	c.records[id] = r
+	if n, err := strconv.Atoi(id); err == nil && n > c.maxID {
+		c.maxID = n
+	}
+	c.mu.Unlock()
+}
+
+// LoadCatalog reads the RDF files of the Gutenberg catalog from p: the
+// rdf-files tarball (.tar, .tar.bz2, .tar.gz or .zip), a directory holding
+// the unpacked cache/epub tree, or a single .rdf file.
+func LoadCatalog(p string) (*Catalog, error) {
+	c := NewCatalog()
+	fi, err := os.Stat(p)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case fi.IsDir():
+		err = filepath.Walk(p, func(name string, fi os.FileInfo, err error) error {
+			if err != nil || fi.IsDir() || !strings.HasSuffix(name, ".rdf") {
+				return err
+			}
+			f, err := os.Open(name)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			return c.read(name, f)
+		})
+	case strings.HasSuffix(p, ".zip"):
+		err = c.readZip(p)
+	case strings.HasSuffix(p, ".rdf"):
+		var f *os.File
+		if f, err = os.Open(p); err == nil {
+			err = c.read(p, f)
+			f.Close()
+		}
+	default:
+		err = c.readTar(p)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *Catalog) readTar(p string) error {
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var r io.Reader = f
+	switch {
+	case strings.HasSuffix(p, ".bz2"):
+		r = bzip2.NewReader(f)
+	case strings.HasSuffix(p, ".gz"), strings.HasSuffix(p, ".tgz"):
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		r = gz
+	}
+	tr := tar.NewReader(r)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if h.Typeflag != tar.TypeReg || !strings.HasSuffix(h.Name, ".rdf") {
+			continue
+		}
+		if err := c.read(h.Name, tr); err != nil {
+			return err
+		}
+	}
+}
+
+func (c *Catalog) readZip(p string) error {
+	zr, err := zip.OpenReader(p)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+	for _, f := range zr.File {
+		if !strings.HasSuffix(f.Name, ".rdf") {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return err
+		}
+		err = c.read(f.Name, rc)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// read adds the ebooks described by one RDF file. A file that does not
+// parse is logged and skipped so one bad entry cannot stop an import.
+func (c *Catalog) read(name string, r io.Reader) error {
+	var doc rdfDocument
+	if err := xml.NewDecoder(r).Decode(&doc); err != nil {
+		log.Printf("catalog: skipping %s: %v", name, err)
+		return nil
+	}
+	agents := make(map[string]rdfAgent)
+	for _, a := range doc.Agents {
+		agents[a.About] = a
+	}
+	for _, e := range doc.Ebooks {
+		id := path.Base(e.About)
+		if _, err := strconv.Atoi(id); err != nil {
+			continue
+		}
+		c.add(id, e.record(agents))
+	}
+	return nil
+}
+
+// The RDF/XML is matched on local names only; the catalog does not reuse
+// them across namespaces for anything we read.
+type rdfDocument struct {
+	Ebooks []rdfEbook `xml:"ebook"`
+	Agents []rdfAgent `xml:"agent"`
+}
+
+type rdfEbook struct {
+	About       string           `xml:"about,attr"`
+	Creators    []rdfAgentRef    `xml:"creator"`
+	Translators []rdfAgentRef    `xml:"trl"`
+	Editors     []rdfAgentRef    `xml:"edt"`
+	Languages   []rdfDescription `xml:"language>Description"`
+	Subjects    []rdfDescription `xml:"subject>Description"`
+	Bookshelves []rdfDescription `xml:"bookshelf>Description"`
+	Downloads   string           `xml:"downloads"`
+	Files       []rdfFile        `xml:"hasFormat>file"`
+}
+
+// rdfAgentRef is either an inline agent or a reference to one described
+// elsewhere in the file.
+type rdfAgentRef struct {
+	Resource string    `xml:"resource,attr"`
+	Agent    *rdfAgent `xml:"agent"`
+}
+
+type rdfAgent struct {
+	About     string `xml:"about,attr"`
+	Name      string `xml:"name"`
+	BirthDate string `xml:"birthdate"`
+	DeathDate string `xml:"deathdate"`
+}
+
+type rdfDescription struct {
+	MemberOf struct {
+		Resource string `xml:"resource,attr"`
+	} `xml:"memberOf"`
+	Values []string `xml:"value"`
+}
+
+type rdfFile struct {
+	Formats []rdfDescription `xml:"format>Description"`
+}
+
+func (e rdfEbook) record(agents map[string]rdfAgent) CatalogRecord {
+	var r CatalogRecord
+	r.Authors = people(e.Creators, agents)
+	r.Translators = people(e.Translators, agents)
+	r.Editors = people(e.Editors, agents)
+	for _, d := range e.Languages {
+		r.Languages = appendUnique(r.Languages, d.Values...)
+	}
+	for _, d := range e.Subjects {
+		switch path.Base(d.MemberOf.Resource) {
+		case "LCSH":
+			r.Subjects = appendUnique(r.Subjects, d.Values...)
+		case "LCC":
+			r.LoCC = appendUnique(r.LoCC, d.Values...)
+		}
+	}
+	for _, d := range e.Bookshelves {
+		r.Bookshelves = appendUnique(r.Bookshelves, d.Values...)
+	}
+	r.Downloads, _ = strconv.Atoi(strings.TrimSpace(e.Downloads))
+	for _, f := range e.Files {
+		for _, d := range f.Formats {
+			for _, v := range d.Values {
+				// "text/plain; charset=utf-8" is filed as text/plain.
+				mime := strings.TrimSpace(strings.SplitN(v, ";", 2)[0])
+				r.Formats = appendUnique(r.Formats, mime)
+			}
+		}
+	}
+	return r
+}
+
+func people(refs []rdfAgentRef, agents map[string]rdfAgent) []Person {
+	var list []Person
+	for _, ref := range refs {
+		a, ok := agents[ref.Resource]
+		if ref.Agent != nil {
+			a, ok = *ref.Agent, true
+		}
+		if !ok || a.Name == "" {
+			continue
+		}
+		p := Person{Name: strings.TrimSpace(a.Name)}
+		p.BirthYear, _ = strconv.Atoi(strings.TrimSpace(a.BirthDate))
+		p.DeathYear, _ = strconv.Atoi(strings.TrimSpace(a.DeathDate))
+		list = append(list, p)
+	}
+	return list
+}
+
+func appendUnique(list []string, values ...string) []string {
+	for _, v := range values {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		dup := false
+		for _, have := range list {
+			if have == v {
+				dup = true
+				break
+			}
+		}
+		if !dup {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+// CatalogImport reports the progress of applying a catalog to the books
+// already in the index.
+type CatalogImport struct {
+	Path       string `json:"path"`
+	Running    bool   `json:"running"`
+	Records    int    `json:"records"`
+	Updated    int    `json:"updated"`
+	Unchanged  int    `json:"unchanged"`
+	NotIndexed int    `json:"not_indexed"`
+	LastError  string `json:"last_error,omitempty"`
+}
+
+var (
+	catalogImportMu sync.Mutex
+	catalogImport   CatalogImport
+
+	// loadedCatalog is replaced by an import while crawls and requests read
+	// it; go through currentCatalog and setCatalog.
+	catalogMu     sync.RWMutex
+	loadedCatalog *Catalog
+)
+
+// currentCatalog returns the catalog crawls are enriched from, or nil.
+func currentCatalog() *Catalog {
+	catalogMu.RLock()
+	defer catalogMu.RUnlock()
+	return loadedCatalog
+}
+
+func setCatalog(c *Catalog) {
+	catalogMu.Lock()
+	loadedCatalog = c
+	catalogMu.Unlock()
+}
+
+// importCatalog loads the catalog at p, makes it the catalog new crawls are
+// enriched from, and adds its metadata to every book already indexed. If
+// loaded is set, it is called once the load is over, whether or not it
+// failed, and before any book is visited.
+func importCatalog(ctx context.Context, p string, loaded func()) error {
+	catalogImportMu.Lock()
+	if catalogImport.Running {
+		catalogImportMu.Unlock()
+		return fmt.Errorf("a catalog import is already running")
+	}
+	catalogImport = CatalogImport{Path: p, Running: true}
+	catalogImportMu.Unlock()
+
+	c, err := LoadCatalog(p)
+	if err == nil {
+		setCatalog(c)
+		log.Printf("catalog: loaded %d records from %s", c.Len(), p)
+	}
+	if loaded != nil {
+		loaded()
+	}
+	if err == nil {
+		err = applyCatalog(ctx, c)
+	}
+
+	catalogImportMu.Lock()
+	defer catalogImportMu.Unlock()
+	catalogImport.Running = false
+	if err != nil {
+		catalogImport.LastError = err.Error()
+	}
+	return err
+}
+
+// applyCatalog writes the catalog fields of every indexed book that c has
+// a record for and whose stored fields differ. Only those fields are
+// written, and only if the book is still at the version read, so an edit
+// that lands in between is kept; the book is then read again.
+func applyCatalog(ctx context.Context, c *Catalog) error {
+	ids := c.IDs()
+	catalogImportMu.Lock()
+	catalogImport.Records = len(ids)
+	catalogImportMu.Unlock()
+
+	for _, id := range ids {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		r, _ := c.Get(id)
+		result, err := applyCatalogRecord(ctx, id, r)
+		if err != nil {
+			return err
+		}
+		catalogImportMu.Lock()
+		switch result {
+		case "updated":
+			catalogImport.Updated++
+		case "unchanged":
+			catalogImport.Unchanged++
+		case "not_indexed":
+			catalogImport.NotIndexed++
+		}
+		catalogImportMu.Unlock()
+	}
+	return nil
+}
+
+// catalogAttempts bounds how often applyCatalogRecord retries a book that
+// keeps changing under it.
+const catalogAttempts = 3
+
+func applyCatalogRecord(ctx context.Context, id string, r CatalogRecord) (string, error) {
+	want, err := json.Marshal(r)
+	if err != nil {
+		return "", err
+	}
+	for attempt := 0; attempt < catalogAttempts; attempt++ {
+		src, v, err := bookStore.GetVersion(ctx, id)
+		if err == ErrNotFound {
+			return "not_indexed", nil
+		}
+		if err != nil {
+			return "", err
+		}
+		var book Book
+		if err := json.Unmarshal(src, &book); err != nil {
+			return "", err
+		}
+		if have, err := json.Marshal(book.CatalogRecord); err == nil && bytes.Equal(have, want) {
+			return "unchanged", nil
+		}
+		_, err = bookStore.UpdateFields(ctx, id, r.fields(), v)
+		switch err {
+		case nil:
+			return "updated", nil
+		case ErrNotFound:
+			return "not_indexed", nil
+		case ErrPreconditionFailed:
+			continue
+		}
+		return "", err
+	}
+	log.Printf("catalog: book %s kept changing, left as it is", id)
+	return "", nil
+}
+
+// fields are the book fields r is stored as, for UpdateFields. A field r
+// has no value for is nil, so a stale value is cleared.
+func (r CatalogRecord) fields() map[string]interface{} {
+	return map[string]interface{}{
+		"subjects":    r.Subjects,
+		"bookshelves": r.Bookshelves,
+		"languages":   r.Languages,
+		"locc":        r.LoCC,
+		"authors":     r.Authors,
+		"translators": r.Translators,
+		"editors":     r.Editors,
+		"downloads":   r.Downloads,
+		"formats":     r.Formats,
+	}
+}
+
+func catalogStatus() CatalogImport {
+	catalogImportMu.Lock()
+	defer catalogImportMu.Unlock()
+	return catalogImport
+}
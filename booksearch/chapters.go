@@ -0,0 +1,395 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Chapter is one entry of a book's outline. Start and End are byte
+// offsets into Book.Content; a chapter runs up to the next heading of the
+// same or a higher level, so a BOOK contains its CHAPTERs. Index is the
+// 1-based position in the outline, Number the number the heading gives
+// (0 for PREFACE and the like).
+type Chapter struct {
+	Index  int    `json:"index"`
+	Kind   string `json:"kind"`
+	Level  int    `json:"level"`
+	Number int    `json:"number,omitempty"`
+	Label  string `json:"label"`
+	Title  string `json:"title,omitempty"`
+	Start  int    `json:"start"`
+	End    int    `json:"end"`
+}
+
+// headingLevels maps heading keywords to outline levels.
+var headingLevels = map[string]int{
+	"volume": 1, "book": 1, "part": 1, "act": 1,
+	"chapter": 2, "scene": 2, "stave": 2, "letter": 2, "canto": 2, "section": 2,
+}
+
+// maxHeadingLine bounds the length of a heading line; longer lines are
+// prose, whatever they start with.
+const maxHeadingLine = 100
+
+var (
+	headingRe  = regexp.MustCompile(`^(?i:(volume|vol\.|book|part|actus|act|chapter|chap\.|scene|scena|scaena|scoena|stave|letter|canto|section))\s+(?i:the\s+)?([IVXLCDMivxlcdm]+|\d+|[A-Za-z]+)\b\.?\s*(.*)$`)
+	numeralRe  = regexp.MustCompile(`^([IVXLCDM]+|\d+)(?:\.\s+(.+)|\.)?$`)
+	sectionRe  = regexp.MustCompile(`^(PREFACE|INTRODUCTION|PROLOGUE|EPILOGUE|CONCLUSION|AFTERWORD|APPENDIX|FOREWORD)\.?$`)
+	contentsRe = regexp.MustCompile(`^(?i:(?:table of )?contents)\.?$`)
+	tocPageRe  = regexp.MustCompile(`\s*(?:\.\s*){2,}\d*$|\s{2,}\d+$`)
+)
+
+var numberWords = map[string]int{
+	"one": 1, "two": 2, "three": 3, "four": 4, "five": 5, "six": 6, "seven": 7,
+	"eight": 8, "nine": 9, "ten": 10, "eleven": 11, "twelve": 12, "thirteen": 13,
+	"fourteen": 14, "fifteen": 15, "sixteen": 16, "seventeen": 17, "eighteen": 18,
+	"nineteen": 19, "twenty": 20,
+	"first": 1, "second": 2, "third": 3, "fourth": 4, "fifth": 5, "sixth": 6,
+	"seventh": 7, "eighth": 8, "ninth": 9, "tenth": 10, "eleventh": 11, "twelfth": 12,
+	"last": 0,
+	// Acts and scenes of the early folio texts: "Actus Tertius. Scena Prima."
+	"primus": 1, "prima": 1, "secundus": 2, "secunda": 2, "tertius": 3, "tertia": 3,
+	"quartus": 4, "quarta": 4, "quintus": 5, "quinta": 5, "sextus": 6, "sexta": 6,
+	"septimus": 7, "septima": 7,
+}
+
+// heading is a candidate found while scanning; bare headings are a
+// number alone.
+type heading struct {
+	Chapter
+	bare bool
+}
+
+func (h heading) key() string {
+	return h.Kind + " " + strconv.Itoa(h.Number)
+}
+
+// detectChapters builds the outline of a book from headings that stand in
+// a paragraph of their own: CHAPTER I, BOOK II, PART THE FIRST, bare
+// roman numerals counting up, PREFACE and the like. Headings listed in a
+// CONTENTS block are not taken for chapters, but their titles are used
+// for chapters whose heading has none. Bare numerals in a book that also
+// has labelled chapters are taken for sections of them.
+func detectChapters(content string, paragraphs []Paragraph) []Chapter {
+	var found []heading
+	contents := -1
+	lastNumeral := 0
+	labeled := false
+	for i, p := range paragraphs {
+		lines := paragraphLines(content, p)
+		if len(lines) > 2 || len(lines[0]) > maxHeadingLine {
+			continue
+		}
+		if contents < 0 && contentsRe.MatchString(lines[0]) {
+			contents = p.Start
+			continue
+		}
+		h, ok := parseHeading(lines[0])
+		if !ok {
+			continue
+		}
+		if h.bare {
+			// A lone number is only a heading when it counts on from the
+			// previous one, or starts a new count.
+			if h.Number != 1 && h.Number != lastNumeral+1 {
+				continue
+			}
+			lastNumeral = h.Number
+			if labeled {
+				// Numbered sections within CHAPTER headings.
+				h.Kind, h.Level = "subsection", 3
+			}
+		} else if h.Level == 1 {
+			lastNumeral = 0
+		} else if h.Number > 0 {
+			labeled = true
+		}
+		if h.Title == "" && len(lines) == 2 {
+			h.Title = lines[1]
+		}
+		if h.Title == "" && i+2 < len(paragraphs) {
+			h.Title = headingTitle(paragraphLines(content, paragraphs[i+1]))
+		}
+		h.Start = p.Start
+		if sub, ok := parseHeading(h.Title); ok && !sub.bare && sub.Level > h.Level {
+			// "ACT I. SCENE 1. Elsinore." opens both.
+			sub.Start = h.Start
+			h.Label = strings.TrimSpace(strings.TrimSuffix(lines[0], h.Title))
+			h.Title = ""
+			found = append(found, h, sub)
+			continue
+		}
+		found = append(found, h)
+	}
+
+	titles := map[string]string{}
+	if contents >= 0 {
+		found = dropContents(content, paragraphs, found, contents, titles)
+	}
+
+	chapters := make([]Chapter, 0, len(found))
+	for i, h := range found {
+		if h.Title == "" {
+			h.Title = titles[h.key()]
+		}
+		h.Index = i + 1
+		h.End = len(content)
+		for _, next := range found[i+1:] {
+			if next.Level <= h.Level {
+				h.End = next.Start
+				break
+			}
+		}
+		chapters = append(chapters, h.Chapter)
+	}
+	return chapters
+}
+
+// dropContents removes the headings that belong to the CONTENTS block
+// starting at offset contents, recording their titles. The block ends
+// where its first entry appears a second time, which is where the book
+// proper starts. Entries listed line by line are not headings, but their
+// titles are read all the same.
+func dropContents(content string, paragraphs []Paragraph, found []heading, contents int, titles map[string]string) []heading {
+	first := len(found)
+	for i, h := range found {
+		if h.Start > contents {
+			first = i
+			break
+		}
+	}
+	bookStart := first
+	for i := first + 1; i < len(found); i++ {
+		if found[i].key() == found[first].key() {
+			bookStart = i
+			break
+		}
+	}
+	for _, entry := range found[first:bookStart] {
+		if entry.Title != "" {
+			titles[entry.key()] = entry.Title
+		}
+	}
+	found = append(found[:first], found[bookStart:]...)
+
+	end := len(content)
+	if first < len(found) {
+		end = found[first].Start
+	}
+	for _, p := range paragraphs {
+		if p.Start <= contents {
+			continue
+		}
+		if p.Start >= end {
+			break
+		}
+		for _, line := range paragraphLines(content, p) {
+			h, ok := parseHeading(tocPageRe.ReplaceAllString(line, ""))
+			if _, seen := titles[h.key()]; ok && h.Title != "" && !seen {
+				titles[h.key()] = h.Title
+			}
+		}
+	}
+	return found
+}
+
+// parseHeading reads a heading line. The title is whatever follows the
+// number on the same line.
+func parseHeading(line string) (heading, bool) {
+	var h heading
+	if m := sectionRe.FindStringSubmatch(line); m != nil {
+		h.Kind, h.Level, h.Label = strings.ToLower(m[1]), 2, line
+		return h, true
+	}
+	if m := headingRe.FindStringSubmatch(line); m != nil {
+		kind := strings.TrimSuffix(strings.ToLower(m[1]), ".")
+		switch kind {
+		case "vol":
+			kind = "volume"
+		case "chap":
+			kind = "chapter"
+		case "actus":
+			kind = "act"
+		case "scena", "scaena", "scoena":
+			kind = "scene"
+		}
+		n, ok := parseHeadingNumber(m[2])
+		if !ok {
+			return h, false
+		}
+		h.Kind, h.Level, h.Number = kind, headingLevels[kind], n
+		h.Title = cleanHeadingTitle(m[3])
+		h.Label = strings.TrimSpace(strings.TrimSuffix(line, m[3]))
+		return h, true
+	}
+	if m := numeralRe.FindStringSubmatch(line); m != nil {
+		n, ok := parseHeadingNumber(m[1])
+		if !ok || n == 0 {
+			return h, false
+		}
+		h.Kind, h.Level, h.Number, h.bare = "chapter", 2, n, true
+		h.Title = cleanHeadingTitle(m[2])
+		h.Label = strings.TrimSpace(strings.TrimSuffix(line, m[2]))
+		return h, true
+	}
+	return h, false
+}
+
+func parseHeadingNumber(s string) (int, bool) {
+	if n, err := strconv.Atoi(s); err == nil {
+		return n, true
+	}
+	if n, ok := numberWords[strings.ToLower(s)]; ok {
+		return n, true
+	}
+	return parseRoman(strings.ToUpper(s))
+}
+
+var romanValues = map[byte]int{'I': 1, 'V': 5, 'X': 10, 'L': 50, 'C': 100, 'D': 500, 'M': 1000}
+
+// parseRoman reads a roman numeral, rejecting malformed ones such as
+// "IIII" or "VX" by writing the value back out and comparing.
+func parseRoman(s string) (int, bool) {
+	n := 0
+	for i := 0; i < len(s); i++ {
+		v, ok := romanValues[s[i]]
+		if !ok {
+			return 0, false
+		}
+		if i+1 < len(s) && romanValues[s[i+1]] > v {
+			n -= v
+		} else {
+			n += v
+		}
+	}
+	if n <= 0 || n >= 4000 || formatRoman(n) != s {
+		return 0, false
+	}
+	return n, true
+}
+
+func formatRoman(n int) string {
+	values := []int{1000, 900, 500, 400, 100, 90, 50, 40, 10, 9, 5, 4, 1}
+	symbols := []string{"M", "CM", "D", "CD", "C", "XC", "L", "XL", "X", "IX", "V", "IV", "I"}
+	var sb strings.Builder
+	for i, v := range values {
+		for n >= v {
+			sb.WriteString(symbols[i])
+			n -= v
+		}
+	}
+	return sb.String()
+}
+
+func cleanHeadingTitle(s string) string {
+	return strings.TrimSpace(strings.TrimLeft(s, ".:-—– "))
+}
+
+// headingTitle returns the paragraph after a heading without a title if
+// it reads as one: a single short line in title case or capitals, not the
+// first line of prose or speech.
+func headingTitle(lines []string) string {
+	if len(lines) != 1 || len(lines[0]) > 60 || strings.ContainsAny(lines[0], `"`) {
+		return ""
+	}
+	if _, ok := parseHeading(lines[0]); ok {
+		return ""
+	}
+	for _, word := range strings.Fields(lines[0]) {
+		r := []rune(word)
+		if len(r) > 3 && unicode.IsLower(r[0]) {
+			return ""
+		}
+	}
+	if !unicode.IsUpper([]rune(lines[0])[0]) {
+		return ""
+	}
+	return strings.TrimSuffix(lines[0], ".")
+}
+
+func paragraphLines(content string, p Paragraph) []string {
+	lines := make([]string, 0, len(p.Lines))
+	for i, start := range p.Lines {
+		lines = append(lines, strings.TrimSpace(content[start:lineEnd(p, i)]))
+	}
+	return lines
+}
+
+// chapterAt returns the innermost chapter containing offset, or nil.
+func chapterAt(chapters []Chapter, offset int) *Chapter {
+	var at *Chapter
+	for i := range chapters {
+		if chapters[i].Start > offset {
+			break
+		}
+		if offset < chapters[i].End {
+			at = &chapters[i]
+		}
+	}
+	return at
+}
+
+func chaptersEndpoint(c *gin.Context) {
+	book, ok := bookTextFor(c)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"id":       book.ID,
+		"title":    book.Title,
+		"chapters": book.Chapters,
+	})
+}
+
+// chapterEndpoint returns the text of the nth entry of a book's outline.
+func chapterEndpoint(c *gin.Context) {
+	n, err := strconv.Atoi(c.Param("n"))
+	if err != nil {
+		errorResponse(c, http.StatusBadRequest, "Chapter must be a number")
+		return
+	}
+	book, ok := bookTextFor(c)
+	if !ok {
+		return
+	}
+	if n < 1 || n > len(book.Chapters) {
+		errorResponse(c, http.StatusNotFound, "Chapter not found")
+		return
+	}
+	ch := book.Chapters[n-1]
+	c.JSON(http.StatusOK, gin.H{
+		"id":       book.ID,
+		"title":    book.Title,
+		"chapters": len(book.Chapters),
+		"chapter":  ch,
+		"text":     strings.TrimSpace(book.Content[ch.Start:ch.End]),
+	})
+}
+
+// bookTextFor loads the book named in the route, answering the request
+// itself if it cannot.
+func bookTextFor(c *gin.Context) (bookText, bool) {
+	src, err := bookStore.Get(c, c.Param("id"))
+	if err == ErrNotFound {
+		errorResponse(c, http.StatusNotFound, "Book not found")
+		return bookText{}, false
+	}
+	if err != nil {
+		log.Println(err)
+		errorResponse(c, http.StatusInternalServerError, err.Error())
+		return bookText{}, false
+	}
+	book, err := decodeBookText(src)
+	if err != nil {
+		log.Println(err)
+		errorResponse(c, http.StatusInternalServerError, err.Error())
+		return bookText{}, false
+	}
+	return book, true
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	encodingUTF8        = "utf-8"
+	encodingASCII       = "us-ascii"
+	encodingLatin1      = "iso-8859-1"
+	encodingLatin9      = "iso-8859-15"
+	encodingWindows1252 = "windows-1252"
+
+	// charsetHeaderLimit bounds how far into a file the header is searched
+	// for a charset declaration when no *** START marker is found.
+	charsetHeaderLimit = 64 << 10
+)
+
+var charsetHeaderRe = regexp.MustCompile(`(?im)^[ \t]*Character set encoding:[ \t]*([^\r\n]*)`)
+
+// windows1252 maps bytes 0x80-0x9F to the characters Windows-1252 puts
+// there. The five unassigned bytes keep their Latin-1 meaning.
+var windows1252 = [32]rune{
+	0x20AC, 0x0081, 0x201A, 0x0192, 0x201E, 0x2026, 0x2020, 0x2021,
+	0x02C6, 0x2030, 0x0160, 0x2039, 0x0152, 0x008D, 0x017D, 0x008F,
+	0x0090, 0x2018, 0x2019, 0x201C, 0x201D, 0x2022, 0x2013, 0x2014,
+	0x02DC, 0x2122, 0x0161, 0x203A, 0x0153, 0x009D, 0x017E, 0x0178,
+}
+
+// latin9 holds the eight bytes where ISO-8859-15 differs from Latin-1.
+var latin9 = map[byte]rune{
+	0xA4: 0x20AC, 0xA6: 0x0160, 0xA8: 0x0161, 0xB4: 0x017D,
+	0xB8: 0x017E, 0xBC: 0x0152, 0xBD: 0x0153, 0xBE: 0x0178,
+}
+
+// decodeText converts an ebook to UTF-8 and returns it together with the
+// encoding it was stored in. The "Character set encoding:" header is
+// honoured unless the bytes contradict it; otherwise the encoding is
+// guessed.
+func decodeText(data []byte) (string, string) {
+	data = bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))
+	declared := declaredCharset(data)
+	enc := declared
+	switch declared {
+	case encodingUTF8:
+		if !utf8.Valid(data) {
+			enc = guessCharset(data)
+		}
+	case encodingASCII:
+		if !isASCII(data) {
+			enc = guessCharset(data)
+		}
+	case encodingLatin1, encodingLatin9, encodingWindows1252:
+		// Text that is valid UTF-8 and not plain ASCII is practically never
+		// Latin-1; Gutenberg kept stale headers on some converted files.
+		if !isASCII(data) && utf8.Valid(data) {
+			enc = encodingUTF8
+		} else if declared == encodingLatin1 && hasC1(data) {
+			// Windows-1252 is routinely labelled Latin-1; not worth a log.
+			return transcode(data, encodingWindows1252), encodingWindows1252
+		}
+	default:
+		enc = guessCharset(data)
+	}
+	if declared != "" && enc != declared {
+		log.Printf("charset: header says %s, decoding as %s", declared, enc)
+	}
+	return transcode(data, enc), enc
+}
+
+// declaredCharset returns the canonical name of the encoding the header
+// declares, or "" if there is no declaration or it is not one we know.
+func declaredCharset(data []byte) string {
+	header := data
+	if i := bytes.Index(header, []byte("*** START")); i >= 0 {
+		header = header[:i]
+	} else if len(header) > charsetHeaderLimit {
+		header = header[:charsetHeaderLimit]
+	}
+	m := charsetHeaderRe.FindSubmatch(header)
+	if m == nil {
+		return ""
+	}
+	return canonicalCharset(string(m[1]))
+}
+
+func canonicalCharset(label string) string {
+	l := strings.ToLower(strings.TrimSpace(label))
+	l = strings.NewReplacer(" ", "-", "_", "-").Replace(l)
+	switch {
+	case strings.Contains(l, "utf-8"), strings.Contains(l, "utf8"):
+		return encodingUTF8
+	case strings.Contains(l, "8859-15"), strings.Contains(l, "latin-9"), strings.Contains(l, "latin9"):
+		return encodingLatin9
+	case strings.Contains(l, "8859-1"), strings.Contains(l, "latin-1"), strings.Contains(l, "latin1"):
+		return encodingLatin1
+	case strings.Contains(l, "1252"):
+		return encodingWindows1252
+	case strings.Contains(l, "ascii"):
+		return encodingASCII
+	}
+	return ""
+}
+
+// guessCharset picks an encoding from the bytes alone: ASCII, UTF-8 if
+// the text is valid UTF-8, else Windows-1252 if it uses the 0x80-0x9F
+// range (C1 controls never appear in real text), else Latin-1.
+func guessCharset(data []byte) string {
+	if isASCII(data) {
+		return encodingASCII
+	}
+	if utf8.Valid(data) {
+		return encodingUTF8
+	}
+	if hasC1(data) {
+		return encodingWindows1252
+	}
+	return encodingLatin1
+}
+
+func hasC1(data []byte) bool {
+	for _, b := range data {
+		if b >= 0x80 && b <= 0x9F {
+			return true
+		}
+	}
+	return false
+}
+
+func isASCII(data []byte) bool {
+	for _, b := range data {
+		if b >= 0x80 {
+			return false
+		}
+	}
+	return true
+}
+
+func transcode(data []byte, enc string) string {
+	switch enc {
+	case encodingUTF8, encodingASCII:
+		return string(data)
+	}
+	var sb strings.Builder
+	sb.Grow(len(data) + len(data)/8)
+	for _, b := range data {
+		switch {
+		case b < 0x80:
+			sb.WriteByte(b)
+		case enc == encodingWindows1252 && b <= 0x9F:
+			sb.WriteRune(windows1252[b-0x80])
+		case enc == encodingLatin9 && latin9[b] != 0:
+			sb.WriteRune(latin9[b])
+		default:
+			sb.WriteRune(rune(b))
+		}
+	}
+	return sb.String()
+}
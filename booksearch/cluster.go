@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/olivere/elastic"
+)
+
+// typelessType is the type name clusters without mapping types accept in
+// document paths, as in /books/_doc/1.
+const typelessType = "_doc"
+
+// Cluster describes the search cluster the elastic engine talks to. The
+// client speaks the Elasticsearch 6 API; what differs from 7 on, and in
+// OpenSearch, is decided from this.
+type Cluster struct {
+	Distribution string `json:"distribution"`
+	Version      string `json:"version"`
+	Major        int    `json:"major"`
+	// Typeless clusters have dropped mapping types: mappings are not
+	// keyed by type, and documents live under _doc.
+	Typeless bool `json:"typeless"`
+}
+
+// elasticCluster is set by detectCluster at startup.
+var elasticCluster = Cluster{Distribution: "elasticsearch", Version: "6", Major: 6}
+
+// detectCluster asks the cluster for its version. Elasticsearch 6, 7 and
+// 8 and OpenSearch 1 and 2 are supported.
+func detectCluster(ctx context.Context, client *elastic.Client) (Cluster, error) {
+	res, err := client.PerformRequest(ctx, elastic.PerformRequestOptions{Method: "GET", Path: "/"})
+	if err != nil {
+		return Cluster{}, err
+	}
+	var info struct {
+		Version struct {
+			Number       string `json:"number"`
+			Distribution string `json:"distribution"`
+		} `json:"version"`
+	}
+	if err := json.Unmarshal(res.Body, &info); err != nil {
+		return Cluster{}, fmt.Errorf("reading cluster version: %v", err)
+	}
+	c := Cluster{Distribution: "elasticsearch", Version: info.Version.Number}
+	if info.Version.Distribution == "opensearch" {
+		c.Distribution = "opensearch"
+	}
+	c.Major, err = strconv.Atoi(strings.SplitN(c.Version, ".", 2)[0])
+	if err != nil {
+		return Cluster{}, fmt.Errorf("unrecognized cluster version %q", c.Version)
+	}
+	switch {
+	case c.Distribution == "opensearch":
+		// OpenSearch forked from Elasticsearch 7.10 and has no types.
+		c.Typeless = true
+	case c.Major < 6:
+		return Cluster{}, fmt.Errorf("elasticsearch %s is not supported; 6.0 or later is required", c.Version)
+	case c.Major >= 7:
+		c.Typeless = true
+	}
+	return c, nil
+}
+
+// docType is the type name to index documents under.
+func (c Cluster) docType() string {
+	if c.Typeless {
+		return typelessType
+	}
+	return elasticTypeName
+}
+
+// maxAnalyzedOffset lifts the limit on how much of a field the plain
+// highlighter may re-analyze. Elasticsearch 7 and OpenSearch fail a
+// highlighted search on any document longer than the default of a million
+// characters, which is a long book.
+const maxAnalyzedOffset = 100000000
+
+// searchResult is a search response, decoded by hand because the client
+// expects hits.total to be a number.
+type searchResult struct {
+	ScrollID string `json:"_scroll_id"`
+	Hits     struct {
+		Total totalHits         `json:"total"`
+		Hits  []searchResultHit `json:"hits"`
+	} `json:"hits"`
+}
+
+type searchResultHit struct {
+	ID        string              `json:"_id"`
+	Score     *float64            `json:"_score"`
+	Source    json.RawMessage     `json:"_source"`
+	Highlight map[string][]string `json:"highlight"`
+	Sort      []json.RawMessage   `json:"sort"`
+}
+
+// totalHits is hits.total: a number in Elasticsearch 6, an object with a
+// value and a relation ("eq" or "gte") from 7 on and in OpenSearch.
+type totalHits struct {
+	Value    int64  `json:"value"`
+	Relation string `json:"relation"`
+}
+
+func (t *totalHits) UnmarshalJSON(data []byte) error {
+	if len(data) > 0 && data[0] == '{' {
+		type object totalHits
+		return json.Unmarshal(data, (*object)(t))
+	}
+	t.Relation = "eq"
+	return json.Unmarshal(data, &t.Value)
+}
+
+// rawSearch posts a search body to index and decodes the response.
+func rawSearch(ctx context.Context, client *elastic.Client, index string, body interface{}) (*searchResult, error) {
+	res, err := client.PerformRequest(ctx, elastic.PerformRequestOptions{
+		Method: "POST",
+		Path:   "/" + index + "/_search",
+		Body:   body,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return decodeSearchResult(res)
+}
+
+func decodeSearchResult(res *elastic.Response) (*searchResult, error) {
+	var result searchResult
+	if err := json.Unmarshal(res.Body, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
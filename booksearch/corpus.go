@@ -0,0 +1,235 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var errNoSuchEbook = errors.New("no such ebook")
+
+// CorpusSource hands out the raw text of an ebook by its Gutenberg ID.
+type CorpusSource interface {
+	Open(ctx context.Context, id string) (io.ReadCloser, error)
+}
+
+// WalkableSource is a CorpusSource that can also list every ebook it holds.
+type WalkableSource interface {
+	CorpusSource
+	Walk(ctx context.Context, fn func(id string) error) error
+}
+
+func newCorpusSource(location string, cfg CrawlerConfig) (CorpusSource, error) {
+	if strings.HasPrefix(location, "http://") || strings.HasPrefix(location, "https://") {
+		return NewHTTPSource(location, cfg), nil
+	}
+	return NewDirSource(location)
+}
+
+// DirSource reads ebooks from a local directory: either a Gutenberg mirror
+// (1/2/3/1234/1234.txt, -0.txt, -8.txt, .zip) or a flat folder of .txt
+// files named by ID.
+type DirSource struct {
+	Root  string
+	files map[string][]string
+}
+
+var ebookFileName = regexp.MustCompile(`^(.+?)(-0|-8)?\.(txt|zip)$`)
+
+// variantRank orders the files of one ebook: UTF-8, then plain, then
+// Latin-1, with plain text preferred over zips.
+var variantRank = map[string]int{
+	"-0.txt": 0, ".txt": 1, "-8.txt": 2,
+	"-0.zip": 3, ".zip": 4, "-8.zip": 5,
+}
+
+func NewDirSource(root string) (*DirSource, error) {
+	info, err := os.Stat(root)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", root)
+	}
+	return &DirSource{Root: root}, nil
+}
+
+func (s *DirSource) Open(ctx context.Context, id string) (io.ReadCloser, error) {
+	for _, path := range s.candidates(id) {
+		if _, err := os.Stat(path); err == nil {
+			return openEbookFile(path)
+		}
+	}
+	if s.files == nil {
+		if err := s.scan(ctx); err != nil {
+			return nil, err
+		}
+	}
+	if paths, ok := s.files[id]; ok {
+		return openEbookFile(paths[0])
+	}
+	return nil, errNoSuchEbook
+}
+
+func (s *DirSource) Walk(ctx context.Context, fn func(id string) error) error {
+	if err := s.scan(ctx); err != nil {
+		return err
+	}
+	ids := make([]string, 0, len(s.files))
+	for id := range s.files {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return lessID(ids[i], ids[j]) })
+	for _, id := range ids {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := fn(id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// candidates lists where a mirror keeps ebook id: every digit but the last
+// becomes a directory, and single-digit IDs live under 0/.
+func (s *DirSource) candidates(id string) []string {
+	paths := make([]string, 0)
+	dirs := []string{s.Root}
+	if n, err := strconv.Atoi(id); err == nil && n > 0 {
+		parts := []string{s.Root}
+		if len(id) == 1 {
+			parts = append(parts, "0")
+		}
+		for _, c := range id[:len(id)-1] {
+			parts = append(parts, string(c))
+		}
+		parts = append(parts, id)
+		dirs = append([]string{filepath.Join(parts...)}, dirs...)
+	}
+	for _, dir := range dirs {
+		for _, suffix := range []string{"-0.txt", ".txt", "-8.txt", "-0.zip", ".zip", "-8.zip"} {
+			paths = append(paths, filepath.Join(dir, id+suffix))
+		}
+	}
+	return paths
+}
+
+// scan walks the whole tree once and remembers every ebook file, best
+// variant first.
+func (s *DirSource) scan(ctx context.Context) error {
+	files := make(map[string][]string)
+	err := filepath.Walk(s.Root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if (strings.HasPrefix(info.Name(), ".") || info.Name() == "old") && path != s.Root {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		m := ebookFileName.FindStringSubmatch(info.Name())
+		if m == nil || strings.HasSuffix(m[1], "-h") {
+			return nil
+		}
+		files[m[1]] = append(files[m[1]], path)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for id, paths := range files {
+		sort.SliceStable(paths, func(i, j int) bool {
+			return variantRank[variantOf(paths[i], id)] < variantRank[variantOf(paths[j], id)]
+		})
+		files[id] = paths
+	}
+	s.files = files
+	return nil
+}
+
+func variantOf(path, id string) string {
+	return strings.TrimPrefix(filepath.Base(path), id)
+}
+
+func openEbookFile(path string) (io.ReadCloser, error) {
+	if !strings.HasSuffix(path, ".zip") {
+		return os.Open(path)
+	}
+	zr, err := zip.OpenReader(path)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range zr.File {
+		if strings.HasSuffix(strings.ToLower(f.Name), ".txt") {
+			rc, err := f.Open()
+			if err != nil {
+				zr.Close()
+				return nil, err
+			}
+			return &zipEntry{ReadCloser: rc, zr: zr}, nil
+		}
+	}
+	zr.Close()
+	return nil, fmt.Errorf("%s: no .txt entry", path)
+}
+
+type zipEntry struct {
+	io.ReadCloser
+	zr *zip.ReadCloser
+}
+
+func (z *zipEntry) Close() error {
+	z.ReadCloser.Close()
+	return z.zr.Close()
+}
+
+// bookFromText transcodes an ebook to UTF-8, parses it and returns the Book
+// to index, or false when it cannot be read or no title could be found.
+func bookFromText(id string, r io.Reader) (Book, bool) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return Book{}, false
+	}
+	text, encoding := decodeText(data)
+	ebook := parseEbook(text)
+	h := ebook.Header
+	if h.Title == "" {
+		return Book{}, false
+	}
+	released := bookReleaseDate(h)
+	book := Book{
+		ID:               id,
+		Title:            h.Title,
+		Author:           h.Author,
+		CreatedAt:        time.Now().UTC(),
+		ReleasedAt:       released.Time,
+		ReleasePrecision: released.Precision,
+		ReleaseDateRaw:   released.Raw,
+		Content:          ebook.Body,
+		Encoding:         encoding,
+		Translator:       h.Translator,
+		Editor:           h.Editor,
+		Illustrator:      h.Illustrator,
+		Language:         h.Language,
+		PostingDate:      h.PostingDate,
+		LastUpdated:      h.LastUpdated,
+		EbookNumber:      h.EbookNumber,
+	}
+	normalizeBook(&book, normalizeConfig)
+	return book, true
+}
@@ -0,0 +1,441 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	crawlIdle    = "idle"
+	crawlRunning = "running"
+	crawlPaused  = "paused"
+
+	jobSchedule = "schedule"
+	jobRange    = "range"
+	jobIngest   = "ingest"
+
+	rateWindow = 5 * time.Minute
+)
+
+var errCrawlActive = errors.New("a crawl is already active")
+
+// CrawlController runs one crawl job at a time in the background and lets
+// operators pause, resume, cancel and retune it while it runs.
+//
+// A schedule job crawls a batch from the ledger every interval, forever.
+// Range and ingest jobs crawl a fixed list of IDs back to back and finish.
+type CrawlController struct {
+	mu        sync.Mutex
+	state     string
+	job       *crawlJob
+	batchSize int
+	interval  time.Duration
+	cancel    context.CancelFunc
+	resumed   chan struct{}
+	wake      chan struct{}
+	progress  CrawlProgress
+	recent    []time.Time
+}
+
+type crawlJob struct {
+	kind string
+	ids  []string
+	pos  int
+}
+
+type CrawlProgress struct {
+	State          string     `json:"state"`
+	Job            string     `json:"job,omitempty"`
+	BatchSize      int        `json:"batch_size"`
+	Interval       string     `json:"interval"`
+	Cursor         int        `json:"cursor"`
+	CurrentID      string     `json:"current_id,omitempty"`
+	StartedAt      *time.Time `json:"started_at,omitempty"`
+	NextBatchAt    *time.Time `json:"next_batch_at,omitempty"`
+	Total          int        `json:"total,omitempty"`
+	Processed      int        `json:"processed"`
+	Indexed        int        `json:"indexed"`
+	Missing        int        `json:"missing"`
+	Unparsable     int        `json:"unparsable"`
+	Failed         int        `json:"failed"`
+	LastError      string     `json:"last_error,omitempty"`
+	BooksPerMinute float64    `json:"books_per_minute"`
+	ETA            string     `json:"eta,omitempty"`
+	// NoETA says why ETA is left out.
+	NoETA string `json:"no_eta,omitempty"`
+}
+
+// NewCrawlController returns an idle controller. A zero batchSize or
+// interval selects the legacy schedule: 10 books a minute until the cursor
+// passes 4000, then 100 books a day.
+func NewCrawlController(batchSize int, interval time.Duration) *CrawlController {
+	return &CrawlController{
+		state:     crawlIdle,
+		batchSize: batchSize,
+		interval:  interval,
+		wake:      make(chan struct{}, 1),
+	}
+}
+
+// StartSchedule starts the scheduled crawl from the ledger cursor.
+// batchSize and interval are applied as by Configure, but only if the
+// crawl starts.
+func (cc *CrawlController) StartSchedule(batchSize int, interval time.Duration) error {
+	return cc.start(&crawlJob{kind: jobSchedule}, batchSize, interval)
+}
+
+// StartRange crawls the IDs from..to inclusive, whatever their ledger
+// status. batchSize and interval are as for StartSchedule.
+func (cc *CrawlController) StartRange(from, to, batchSize int, interval time.Duration) error {
+	if from < 1 || to < from {
+		return errors.New("invalid ID range")
+	}
+	ids := make([]string, 0, to-from+1)
+	for id := from; id <= to; id++ {
+		ids = append(ids, strconv.Itoa(id))
+	}
+	return cc.start(&crawlJob{kind: jobRange, ids: ids}, batchSize, interval)
+}
+
+// StartIngest crawls every ebook of a walkable source that the ledger does
+// not already have indexed.
+func (cc *CrawlController) StartIngest(ctx context.Context, src WalkableSource) error {
+	ids := make([]string, 0)
+	err := src.Walk(ctx, func(id string) error {
+		if e, ok := crawlLedger.Get(id); !ok || e.Status != statusIndexed {
+			ids = append(ids, id)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return cc.start(&crawlJob{kind: jobIngest, ids: ids}, 0, 0)
+}
+
+func (cc *CrawlController) start(job *crawlJob, batchSize int, interval time.Duration) error {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	if cc.state != crawlIdle {
+		return errCrawlActive
+	}
+	if batchSize > 0 {
+		cc.batchSize = batchSize
+	}
+	if interval > 0 {
+		cc.interval = interval
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	now := time.Now().UTC()
+	cc.state = crawlRunning
+	cc.job = job
+	cc.cancel = cancel
+	cc.resumed = nil
+	cc.recent = nil
+	cc.progress = CrawlProgress{Job: job.kind, StartedAt: &now, Total: len(job.ids)}
+	go cc.run(ctx, job)
+	return nil
+}
+
+func (cc *CrawlController) Pause() error {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	if cc.state != crawlRunning {
+		return errors.New("no running crawl to pause")
+	}
+	cc.state = crawlPaused
+	cc.resumed = make(chan struct{})
+	return nil
+}
+
+func (cc *CrawlController) Resume() error {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	if cc.state != crawlPaused {
+		return errors.New("crawl is not paused")
+	}
+	cc.state = crawlRunning
+	close(cc.resumed)
+	cc.resumed = nil
+	return nil
+}
+
+// Cancel stops the active job. IDs already being fetched finish; the rest
+// are left for the next crawl.
+func (cc *CrawlController) Cancel() error {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	if cc.state == crawlIdle {
+		return errors.New("no active crawl")
+	}
+	cc.cancel()
+	return nil
+}
+
+// Configure changes batch size and interval; they take effect from the next
+// batch. Zero leaves a setting unchanged.
+func (cc *CrawlController) Configure(batchSize int, interval time.Duration) {
+	cc.mu.Lock()
+	if batchSize > 0 {
+		cc.batchSize = batchSize
+	}
+	if interval > 0 {
+		cc.interval = interval
+	}
+	cc.mu.Unlock()
+	select {
+	case cc.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (cc *CrawlController) Progress() CrawlProgress {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	p := cc.progress
+	p.State = cc.state
+	batchSize, interval := cc.schedule()
+	p.BatchSize = batchSize
+	p.Interval = interval.String()
+	p.Cursor = crawlLedger.Cursor()
+	p.BooksPerMinute = cc.rate()
+	switch {
+	case cc.state == crawlIdle:
+	case p.Job == jobSchedule:
+		cc.scheduleETA(&p, batchSize, interval)
+	case p.Total > p.Processed && p.BooksPerMinute > 0:
+		remaining := float64(p.Total - p.Processed)
+		p.ETA = time.Duration(remaining / p.BooksPerMinute * float64(time.Minute)).Round(time.Second).String()
+	case p.Total > p.Processed:
+		p.NoETA = "no books finished yet to measure the rate by"
+	}
+	return p
+}
+
+// scheduleETA estimates a schedule job, which runs until the ledger cursor
+// passes the last ebook of the catalog. It is paced by the schedule rather
+// than by how fast books are fetched. The caller holds cc.mu.
+func (cc *CrawlController) scheduleETA(p *CrawlProgress, batchSize int, interval time.Duration) {
+	maxID := currentCatalog().MaxID()
+	if maxID == 0 {
+		p.NoETA = "no catalog is loaded, so the number of ebooks left is unknown"
+		return
+	}
+	remaining := len(crawlLedger.IDs(statusQueued))
+	if maxID >= p.Cursor {
+		remaining += maxID - p.Cursor + 1
+	}
+	p.Total = p.Processed + remaining
+	if remaining == 0 {
+		return
+	}
+	// The first batch runs now or at NextBatchAt, the rest an interval
+	// apart.
+	batches := (remaining + batchSize - 1) / batchSize
+	eta := time.Duration(batches-1) * interval
+	if p.NextBatchAt != nil {
+		if wait := time.Until(*p.NextBatchAt); wait > 0 {
+			eta += wait
+		}
+	}
+	p.ETA = eta.Round(time.Second).String()
+}
+
+// schedule returns the effective batch size and interval. The caller holds
+// cc.mu.
+func (cc *CrawlController) schedule() (int, time.Duration) {
+	batchSize, interval := 10, time.Minute
+	if crawlLedger.Cursor() > 4000 {
+		batchSize, interval = 100, 24*time.Hour
+	}
+	if cc.batchSize > 0 {
+		batchSize = cc.batchSize
+	}
+	if cc.interval > 0 {
+		interval = cc.interval
+	}
+	return batchSize, interval
+}
+
+// rate is the number of IDs finished per minute over the last rateWindow.
+// The caller holds cc.mu.
+func (cc *CrawlController) rate() float64 {
+	if len(cc.recent) == 0 || cc.progress.StartedAt == nil {
+		return 0
+	}
+	window := rateWindow
+	if elapsed := time.Since(*cc.progress.StartedAt); elapsed < window {
+		window = elapsed
+	}
+	cutoff := time.Now().Add(-window)
+	n := 0
+	for _, t := range cc.recent {
+		if t.After(cutoff) {
+			n++
+		}
+	}
+	if window < time.Second {
+		return 0
+	}
+	return float64(n) / window.Minutes()
+}
+
+func (cc *CrawlController) run(ctx context.Context, job *crawlJob) {
+	defer func() {
+		cc.mu.Lock()
+		cc.state = crawlIdle
+		cc.progress.NextBatchAt = nil
+		cc.cancel()
+		cc.mu.Unlock()
+		log.Printf("%s crawl finished", job.kind)
+	}()
+
+	// The legacy ticker waited one interval before the first batch.
+	if job.kind == jobSchedule && !cc.sleep(ctx) {
+		return
+	}
+	for {
+		if err := cc.waitResumed(ctx, ""); err != nil {
+			return
+		}
+		cc.mu.Lock()
+		batchSize, _ := cc.schedule()
+		cc.mu.Unlock()
+
+		ids, commit := cc.nextBatch(job, batchSize)
+		if len(ids) == 0 && job.kind != jobSchedule {
+			return
+		}
+		crawler := &Crawler{
+			Config:      crawlerConfig,
+			Source:      corpus,
+			Store:       bookStore,
+			Catalog:     currentCatalog(),
+			OnResult:    cc.onResult,
+			BeforeFetch: cc.waitResumed,
+		}
+		report := crawler.Crawl(ctx, ids)
+		commit(report)
+		for id, err := range report.Failed {
+			log.Printf("ebook %s failed: %v", id, err)
+		}
+		log.Printf("crawled %d books: %d indexed, %d missing, %d unparsable, %d failed",
+			len(ids)-len(report.Skipped), len(report.Indexed), len(report.Missing), len(report.Unparsable), len(report.Failed))
+		if ctx.Err() != nil {
+			return
+		}
+		if job.kind == jobSchedule && !cc.sleep(ctx) {
+			return
+		}
+	}
+}
+
+// nextBatch picks the next IDs to crawl. For a schedule job these are the
+// re-queued IDs first, then fresh IDs from the ledger cursor; commit moves
+// the cursor past the fresh IDs that were attempted.
+func (cc *CrawlController) nextBatch(job *crawlJob, batchSize int) ([]string, func(*CrawlReport)) {
+	if job.kind != jobSchedule {
+		end := job.pos + batchSize
+		if end > len(job.ids) {
+			end = len(job.ids)
+		}
+		ids := job.ids[job.pos:end]
+		job.pos = end
+		return ids, func(*CrawlReport) {}
+	}
+
+	ids := crawlLedger.IDs(statusQueued)
+	if len(ids) > batchSize {
+		ids = ids[:batchSize]
+	}
+	start := crawlLedger.Cursor()
+	end := start + batchSize - len(ids)
+	for index := start; index < end; index++ {
+		ids = append(ids, strconv.Itoa(index))
+	}
+	return ids, func(report *CrawlReport) {
+		cursor := end
+		for _, id := range report.Skipped {
+			if n, err := strconv.Atoi(id); err == nil && n >= start && n < cursor {
+				cursor = n
+			}
+		}
+		if err := crawlLedger.SetCursor(cursor); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+func (cc *CrawlController) onResult(r CrawlResult) {
+	crawlLedger.record(r)
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	cc.progress.Processed++
+	switch r.Status {
+	case statusIndexed:
+		cc.progress.Indexed++
+	case statusMissing:
+		cc.progress.Missing++
+	case statusUnparsable:
+		cc.progress.Unparsable++
+	default:
+		cc.progress.Failed++
+		if r.Err != nil {
+			cc.progress.LastError = r.ID + ": " + r.Err.Error()
+		}
+	}
+	now := time.Now()
+	cc.recent = append(cc.recent, now)
+	for len(cc.recent) > 0 && now.Sub(cc.recent[0]) > rateWindow {
+		cc.recent = cc.recent[1:]
+	}
+}
+
+// waitResumed blocks while the crawl is paused. It is also the crawler's
+// BeforeFetch hook, so it records the ID about to be fetched.
+func (cc *CrawlController) waitResumed(ctx context.Context, id string) error {
+	for {
+		cc.mu.Lock()
+		resumed := cc.resumed
+		if resumed == nil && id != "" {
+			cc.progress.CurrentID = id
+		}
+		cc.mu.Unlock()
+		if resumed == nil {
+			return ctx.Err()
+		}
+		select {
+		case <-resumed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// sleep waits one interval, restarting the wait when the interval is
+// changed. It returns false if ctx is cancelled.
+func (cc *CrawlController) sleep(ctx context.Context) bool {
+	started := time.Now()
+	for {
+		cc.mu.Lock()
+		_, interval := cc.schedule()
+		next := started.Add(interval).UTC()
+		cc.progress.NextBatchAt = &next
+		cc.mu.Unlock()
+
+		select {
+		case <-time.After(time.Until(next)):
+			cc.mu.Lock()
+			cc.progress.NextBatchAt = nil
+			cc.mu.Unlock()
+			return true
+		case <-cc.wake:
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
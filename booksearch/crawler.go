@@ -0,0 +1,362 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	statusIndexed    = "indexed"
+	statusMissing    = "missing"
+	statusUnparsable = "unparsable"
+	statusFailed     = "failed"
+	// statusSkipped is an ID the crawl was cancelled before finishing. It
+	// is reported but not passed to OnResult.
+	statusSkipped = "skipped"
+)
+
+type CrawlerConfig struct {
+	Workers      int
+	BatchSize    int
+	HostInterval time.Duration
+	UserAgent    string
+	Timeout      time.Duration
+	MaxRetries   int
+	Backoff      time.Duration
+	MaxBackoff   time.Duration
+}
+
+var defaultCrawlerConfig = CrawlerConfig{
+	Workers:      4,
+	BatchSize:    50,
+	HostInterval: time.Second,
+	UserAgent:    "booksearch-crawler/1.0 (+https://github.com/PrE-Ren/booksearch)",
+	Timeout:      60 * time.Second,
+	MaxRetries:   4,
+	Backoff:      2 * time.Second,
+	MaxBackoff:   2 * time.Minute,
+}
+
+// Crawler fetches ebooks from a CorpusSource with a pool of workers and
+// bulk-indexes them. A failing ID is recorded and the crawl moves on.
+type Crawler struct {
+	Config CrawlerConfig
+	Source CorpusSource
+	Store  BookStore
+	// Catalog, if set, adds RDF catalog metadata to every fetched book.
+	Catalog *Catalog
+	// OnResult, if set, is called from a single goroutine for every ID
+	// once its outcome is final.
+	OnResult func(CrawlResult)
+	// BeforeFetch, if set, is called before each ID is handed to a worker.
+	// It may block; an error stops the crawl there.
+	BeforeFetch func(ctx context.Context, id string) error
+}
+
+type CrawlResult struct {
+	ID     string
+	Status string
+	Err    error
+	Book   *Book
+}
+
+type CrawlReport struct {
+	Indexed    []string
+	Missing    []string
+	Unparsable []string
+	Failed     map[string]error
+	Skipped    []string
+}
+
+// Crawl fetches ids concurrently and returns the outcome of each. It stops
+// handing out new IDs when ctx is cancelled.
+func (c *Crawler) Crawl(ctx context.Context, ids []string) *CrawlReport {
+	workers := c.Config.Workers
+	if workers < 1 {
+		workers = 1
+	}
+	batchSize := c.Config.BatchSize
+	if batchSize < 1 {
+		batchSize = 1
+	}
+
+	jobs := make(chan string)
+	results := make(chan CrawlResult)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for id := range jobs {
+				results <- c.fetch(ctx, id)
+			}
+		}()
+	}
+	var unsent []string
+	go func() {
+		defer close(results)
+		defer wg.Wait()
+		defer close(jobs)
+		for i, id := range ids {
+			if c.BeforeFetch != nil {
+				if err := c.BeforeFetch(ctx, id); err != nil {
+					unsent = ids[i:]
+					return
+				}
+			}
+			select {
+			case jobs <- id:
+			case <-ctx.Done():
+				unsent = ids[i:]
+				return
+			}
+		}
+	}()
+
+	report := &CrawlReport{Failed: make(map[string]error)}
+	record := func(r CrawlResult) {
+		switch r.Status {
+		case statusIndexed:
+			report.Indexed = append(report.Indexed, r.ID)
+		case statusMissing:
+			report.Missing = append(report.Missing, r.ID)
+		case statusUnparsable:
+			report.Unparsable = append(report.Unparsable, r.ID)
+		case statusSkipped:
+			report.Skipped = append(report.Skipped, r.ID)
+			return
+		default:
+			report.Failed[r.ID] = r.Err
+		}
+		if c.OnResult != nil {
+			c.OnResult(r)
+		}
+	}
+
+	pending := make([]CrawlResult, 0, batchSize)
+	flush := func() {
+		if len(pending) == 0 {
+			return
+		}
+		books := make([]Book, len(pending))
+		for i, r := range pending {
+			books[i] = *r.Book
+		}
+		err := c.Store.Bulk(context.Background(), books)
+		bulkErr, partial := err.(*BulkError)
+		for _, r := range pending {
+			if partial {
+				if itemErr, ok := bulkErr.Failed[r.ID]; ok {
+					r.Status = statusFailed
+					r.Err = fmt.Errorf("bulk index: %v", itemErr)
+				}
+			} else if err != nil {
+				r.Status = statusFailed
+				r.Err = fmt.Errorf("bulk index: %v", err)
+			}
+			record(r)
+		}
+		pending = pending[:0]
+	}
+	for r := range results {
+		if r.Status != statusIndexed {
+			record(r)
+			continue
+		}
+		pending = append(pending, r)
+		if len(pending) == batchSize {
+			flush()
+		}
+	}
+	flush()
+	report.Skipped = append(report.Skipped, unsent...)
+	return report
+}
+
+func (c *Crawler) fetch(ctx context.Context, id string) CrawlResult {
+	rc, err := c.Source.Open(ctx, id)
+	if err == errNoSuchEbook {
+		return CrawlResult{ID: id, Status: statusMissing}
+	}
+	if err != nil && ctx.Err() != nil {
+		return CrawlResult{ID: id, Status: statusSkipped, Err: err}
+	}
+	if err != nil {
+		return CrawlResult{ID: id, Status: statusFailed, Err: err}
+	}
+	defer rc.Close()
+	book, ok := bookFromText(id, rc)
+	if !ok {
+		return CrawlResult{ID: id, Status: statusUnparsable}
+	}
+	c.Catalog.Enrich(&book)
+	return CrawlResult{ID: id, Status: statusIndexed, Book: &book}
+}
+
+// HTTPSource fetches ebooks from a Gutenberg files/ URL. Requests to the
+// same host are spaced out, and 429 or 5xx responses and network errors are
+// retried with exponential backoff.
+type HTTPSource struct {
+	BaseURL string
+	Client  *http.Client
+	Config  CrawlerConfig
+	limiter *hostLimiter
+}
+
+func NewHTTPSource(baseURL string, cfg CrawlerConfig) *HTTPSource {
+	return &HTTPSource{
+		BaseURL: baseURL,
+		Client:  &http.Client{Timeout: cfg.Timeout},
+		Config:  cfg,
+		limiter: newHostLimiter(cfg.HostInterval),
+	}
+}
+
+type retryableError struct {
+	err        error
+	retryAfter time.Duration
+}
+
+func (e *retryableError) Error() string {
+	return e.err.Error()
+}
+
+func (s *HTTPSource) Open(ctx context.Context, id string) (io.ReadCloser, error) {
+	u := strings.TrimSuffix(s.BaseURL, "/") + "/" + id + "/" + id + ".txt"
+	var err error
+	for attempt := 0; attempt <= s.Config.MaxRetries; attempt++ {
+		if attempt > 0 {
+			wait := backoff(s.Config.Backoff, s.Config.MaxBackoff, attempt)
+			if re, ok := err.(*retryableError); ok && re.retryAfter > wait {
+				wait = re.retryAfter
+			}
+			select {
+			case <-time.After(wait):
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+		var body []byte
+		body, err = s.get(ctx, u)
+		if err == nil {
+			return ioutil.NopCloser(bytes.NewReader(body)), nil
+		}
+		if _, ok := err.(*retryableError); !ok {
+			return nil, err
+		}
+		log.Printf("%v (attempt %d)", err, attempt+1)
+	}
+	return nil, err
+}
+
+func (s *HTTPSource) get(ctx context.Context, u string) ([]byte, error) {
+	if err := s.limiter.wait(ctx, u); err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	if s.Config.UserAgent != "" {
+		req.Header.Set("User-Agent", s.Config.UserAgent)
+	}
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	res, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, &retryableError{err: err}
+	}
+	defer res.Body.Close()
+	switch {
+	case res.StatusCode == http.StatusOK:
+		body, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			return nil, &retryableError{err: err}
+		}
+		return body, nil
+	case res.StatusCode == http.StatusNotFound:
+		return nil, errNoSuchEbook
+	case res.StatusCode == http.StatusTooManyRequests || res.StatusCode >= 500:
+		return nil, &retryableError{
+			err:        fmt.Errorf("GET %s: %s", u, res.Status),
+			retryAfter: parseRetryAfter(res.Header.Get("Retry-After")),
+		}
+	default:
+		return nil, fmt.Errorf("GET %s: %s", u, res.Status)
+	}
+}
+
+func parseRetryAfter(v string) time.Duration {
+	if v == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(v); err == nil {
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return time.Until(t)
+	}
+	return 0
+}
+
+// backoff returns the delay before retry number attempt: base doubled per
+// attempt, capped at max, with up to 50% jitter.
+func backoff(base, max time.Duration, attempt int) time.Duration {
+	d := base << uint(attempt-1)
+	if d > max || d <= 0 {
+		d = max
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// hostLimiter spaces out requests to the same host by at least interval.
+type hostLimiter struct {
+	mu       sync.Mutex
+	interval time.Duration
+	next     map[string]time.Time
+}
+
+func newHostLimiter(interval time.Duration) *hostLimiter {
+	return &hostLimiter{interval: interval, next: make(map[string]time.Time)}
+}
+
+func (l *hostLimiter) wait(ctx context.Context, rawurl string) error {
+	if l == nil || l.interval <= 0 {
+		return nil
+	}
+	host := rawurl
+	if u, err := url.Parse(rawurl); err == nil {
+		host = u.Host
+	}
+	l.mu.Lock()
+	now := time.Now()
+	at := l.next[host]
+	if at.Before(now) {
+		at = now
+	}
+	l.next[host] = at.Add(l.interval)
+	l.mu.Unlock()
+
+	select {
+	case <-time.After(time.Until(at)):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
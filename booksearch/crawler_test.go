@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// gutenbergServer stands in for a Gutenberg files/ host. respond picks the
+// answer to each request for an ebook by how many came before it.
+type gutenbergServer struct {
+	*httptest.Server
+	respond func(id string, attempt int, w http.ResponseWriter)
+
+	mu       sync.Mutex
+	attempts map[string]int
+	times    []time.Time
+}
+
+func newGutenbergServer(t *testing.T, respond func(id string, attempt int, w http.ResponseWriter)) *gutenbergServer {
+	s := &gutenbergServer{respond: respond, attempts: map[string]int{}}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// /<id>/<id>.txt
+		id := strings.Split(strings.Trim(r.URL.Path, "/"), "/")[0]
+		s.mu.Lock()
+		attempt := s.attempts[id]
+		s.attempts[id]++
+		s.times = append(s.times, time.Now())
+		s.mu.Unlock()
+		s.respond(id, attempt, w)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *gutenbergServer) requests(id string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.attempts[id]
+}
+
+func serveEbook(id string, w http.ResponseWriter) {
+	fmt.Fprintf(w, "Title: Book %s\nAuthor: Someone\n\n*** START OF THE PROJECT GUTENBERG EBOOK %s ***\nThe text of book %s.\n*** END OF THE PROJECT GUTENBERG EBOOK %s ***\n", id, id, id, id)
+}
+
+func testCrawlerConfig() CrawlerConfig {
+	cfg := defaultCrawlerConfig
+	cfg.HostInterval = 0
+	cfg.Backoff = time.Millisecond
+	cfg.MaxBackoff = 5 * time.Millisecond
+	cfg.MaxRetries = 3
+	cfg.Timeout = 5 * time.Second
+	return cfg
+}
+
+func crawl(t *testing.T, server *gutenbergServer, cfg CrawlerConfig, ids ...string) (*CrawlReport, *MemoryStore) {
+	t.Helper()
+	store := NewMemoryStore()
+	c := &Crawler{Config: cfg, Source: NewHTTPSource(server.URL, cfg), Store: store}
+	return c.Crawl(context.Background(), ids), store
+}
+
+func TestCrawlRetriesAfter429(t *testing.T) {
+	server := newGutenbergServer(t, func(id string, attempt int, w http.ResponseWriter) {
+		if attempt == 0 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		serveEbook(id, w)
+	})
+	report, store := crawl(t, server, testCrawlerConfig(), "1")
+
+	if len(report.Indexed) != 1 || len(report.Failed) != 0 {
+		t.Fatalf("report: %+v", report)
+	}
+	if _, err := store.Get(context.Background(), "1"); err != nil {
+		t.Fatalf("book not stored: %v", err)
+	}
+	if n := server.requests("1"); n != 2 {
+		t.Fatalf("%d requests, want 2", n)
+	}
+	// The backoff alone is milliseconds; the wait must honour Retry-After.
+	if gap := server.times[1].Sub(server.times[0]); gap < 900*time.Millisecond {
+		t.Fatalf("retried after %v, before the Retry-After of 1s", gap)
+	}
+}
+
+func TestCrawlRetries5xx(t *testing.T) {
+	server := newGutenbergServer(t, func(id string, attempt int, w http.ResponseWriter) {
+		if attempt == 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		serveEbook(id, w)
+	})
+	report, _ := crawl(t, server, testCrawlerConfig(), "1", "2")
+
+	if len(report.Indexed) != 2 || len(report.Failed) != 0 {
+		t.Fatalf("report: %+v", report)
+	}
+	for _, id := range []string{"1", "2"} {
+		if n := server.requests(id); n != 2 {
+			t.Errorf("%d requests for %s, want 2", n, id)
+		}
+	}
+}
+
+func TestCrawlGivesUpAfterMaxRetries(t *testing.T) {
+	server := newGutenbergServer(t, func(id string, attempt int, w http.ResponseWriter) {
+		w.WriteHeader(http.StatusBadGateway)
+	})
+	cfg := testCrawlerConfig()
+	report, _ := crawl(t, server, cfg, "1")
+
+	if _, ok := report.Failed["1"]; !ok || len(report.Indexed) != 0 {
+		t.Fatalf("report: %+v", report)
+	}
+	if n := server.requests("1"); n != cfg.MaxRetries+1 {
+		t.Fatalf("%d requests, want %d", n, cfg.MaxRetries+1)
+	}
+}
+
+func TestCrawlRecordsMissingEbook(t *testing.T) {
+	server := newGutenbergServer(t, func(id string, attempt int, w http.ResponseWriter) {
+		if id == "404" {
+			http.NotFound(w, nil)
+			return
+		}
+		serveEbook(id, w)
+	})
+	report, _ := crawl(t, server, testCrawlerConfig(), "1", "404")
+
+	if len(report.Missing) != 1 || report.Missing[0] != "404" {
+		t.Fatalf("missing: %v", report.Missing)
+	}
+	if len(report.Indexed) != 1 || len(report.Failed) != 0 {
+		t.Fatalf("report: %+v", report)
+	}
+	// A 404 is final and not retried.
+	if n := server.requests("404"); n != 1 {
+		t.Fatalf("%d requests for the missing ebook, want 1", n)
+	}
+}
+
+func TestCrawlSpacesRequestsPerHost(t *testing.T) {
+	server := newGutenbergServer(t, func(id string, attempt int, w http.ResponseWriter) {
+		serveEbook(id, w)
+	})
+	cfg := testCrawlerConfig()
+	cfg.Workers = 4
+	cfg.HostInterval = 50 * time.Millisecond
+	report, _ := crawl(t, server, cfg, "1", "2", "3", "4", "5", "6")
+
+	if len(report.Indexed) != 6 {
+		t.Fatalf("report: %+v", report)
+	}
+	for i := 1; i < len(server.times); i++ {
+		// Allow for timer slack; without the limiter the four workers
+		// would hit the server together.
+		if gap := server.times[i].Sub(server.times[i-1]); gap < 40*time.Millisecond {
+			t.Fatalf("requests %d and %d were %v apart, want at least %v", i-1, i, gap, cfg.HostInterval)
+		}
+	}
+}
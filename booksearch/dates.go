@@ -0,0 +1,237 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	precisionDay     = "day"
+	precisionMonth   = "month"
+	precisionYear    = "year"
+	precisionUnknown = "unknown"
+)
+
+// ReleaseDate is a parsed header date. Time is nil when the raw string
+// could not be read; month and year precision dates fall on the first day
+// of the period.
+type ReleaseDate struct {
+	Time      *time.Time
+	Precision string
+	Raw       string
+}
+
+var (
+	isoDateRe   = regexp.MustCompile(`^(\d{4})-(\d{1,2})(?:-(\d{1,2}))?$`)
+	bracketRe   = regexp.MustCompile(`\[[^\]]*\]?`)
+	dateTokenRe = regexp.MustCompile(`\p{L}+|\d+`)
+)
+
+// monthNames maps English, French, German, Spanish, Italian, Dutch and
+// Portuguese month names to months. English names may also be abbreviated
+// to three or more letters ("Sept", "Dec.").
+var monthNames = map[string]time.Month{
+	"january": 1, "february": 2, "march": 3, "april": 4, "may": 5, "june": 6,
+	"july": 7, "august": 8, "september": 9, "october": 10, "november": 11, "december": 12,
+
+	"janvier": 1, "février": 2, "fevrier": 2, "mars": 3, "avril": 4, "mai": 5, "juin": 6,
+	"juillet": 7, "août": 8, "aout": 8, "septembre": 9, "octobre": 10, "novembre": 11, "décembre": 12, "decembre": 12,
+
+	"januar": 1, "jänner": 1, "februar": 2, "märz": 3, "maerz": 3, "juni": 6,
+	"juli": 7, "oktober": 10, "dezember": 12,
+
+	"enero": 1, "febrero": 2, "marzo": 3, "abril": 4, "mayo": 5, "junio": 6,
+	"julio": 7, "agosto": 8, "septiembre": 9, "setiembre": 9, "octubre": 10, "noviembre": 11, "diciembre": 12,
+
+	"gennaio": 1, "febbraio": 2, "aprile": 4, "maggio": 5, "giugno": 6,
+	"luglio": 7, "settembre": 9, "ottobre": 10, "dicembre": 12,
+
+	"januari": 1, "februari": 2, "maart": 3, "mei": 5, "augustus": 8,
+
+	"janeiro": 1, "fevereiro": 2, "março": 3, "marco": 3, "maio": 5, "junho": 6,
+	"julho": 7, "setembro": 9, "outubro": 10, "novembro": 11, "dezembro": 12,
+}
+
+var englishMonths = []string{
+	"january", "february", "march", "april", "may", "june",
+	"july", "august", "september", "october", "november", "december",
+}
+
+// dateFillers are words that may appear between the parts of a date,
+// including ordinal suffixes, which the tokenizer splits off ("1st",
+// "1er", "1º").
+var dateFillers = map[string]bool{
+	"of": true, "the": true, "de": true, "del": true, "den": true, "der": true, "le": true,
+	"st": true, "nd": true, "rd": true, "th": true, "er": true, "re": true, "e": true, "º": true, "ª": true,
+}
+
+// parseReleaseDate reads a header date such as "June 1, 1998", "Sept.
+// 2004", "1st June 1998", "1er janvier 2005" or "March 15, 2005 [EBook
+// #14591] [Last updated: ...]". It never guesses: anything it cannot read
+// completely is returned with precision "unknown".
+func parseReleaseDate(raw string) ReleaseDate {
+	d := ReleaseDate{Precision: precisionUnknown, Raw: strings.TrimSpace(raw)}
+	s := strings.TrimSpace(bracketRe.ReplaceAllString(d.Raw, " "))
+	if s == "" {
+		return d
+	}
+
+	if m := isoDateRe.FindStringSubmatch(s); m != nil {
+		year, _ := strconv.Atoi(m[1])
+		month, _ := strconv.Atoi(m[2])
+		day := 0
+		if m[3] != "" {
+			day, _ = strconv.Atoi(m[3])
+		}
+		return d.set(year, time.Month(month), day)
+	}
+
+	year, month, day := 0, time.Month(0), 0
+	for _, tok := range dateTokenRe.FindAllString(strings.ToLower(s), -1) {
+		if n, err := strconv.Atoi(tok); err == nil {
+			switch {
+			case len(tok) == 4 && year == 0:
+				year = n
+			case len(tok) <= 2 && day == 0:
+				day = n
+			default:
+				return d
+			}
+			continue
+		}
+		if dateFillers[tok] {
+			continue
+		}
+		m, ok := lookupMonth(tok)
+		if !ok || month != 0 {
+			return d
+		}
+		month = m
+	}
+	if day != 0 && month == 0 {
+		return d
+	}
+	return d.set(year, month, day)
+}
+
+func lookupMonth(word string) (time.Month, bool) {
+	if m, ok := monthNames[word]; ok {
+		return m, true
+	}
+	if len(word) >= 3 {
+		for i, name := range englishMonths {
+			if strings.HasPrefix(name, word) {
+				return time.Month(i + 1), true
+			}
+		}
+	}
+	return 0, false
+}
+
+// set fills in the date if year, month and day form a real calendar
+// date. A zero month or day lowers the precision.
+func (d ReleaseDate) set(year int, month time.Month, day int) ReleaseDate {
+	if year < 1000 || month > 12 || day < 0 || day > 31 {
+		return d
+	}
+	precision := precisionDay
+	switch {
+	case month == 0:
+		month, day, precision = 1, 1, precisionYear
+	case day == 0:
+		day, precision = 1, precisionMonth
+	}
+	t := time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+	if t.Day() != day {
+		return d
+	}
+	d.Time = &t
+	d.Precision = precision
+	return d
+}
+
+// bookReleaseDate picks the date of an ebook from its header: the release
+// date, or the posting date when there is no readable release date. The
+// raw string is kept either way.
+func bookReleaseDate(h EbookHeader) ReleaseDate {
+	d := parseReleaseDate(h.ReleaseDate)
+	if d.Time == nil && h.PostingDate != "" {
+		if posted := parseReleaseDate(h.PostingDate); posted.Time != nil || d.Raw == "" {
+			return posted
+		}
+	}
+	return d
+}
+
+// releasedBefore orders books by release date with unknown dates last,
+// whichever direction is asked for.
+func releasedBefore(a, b *time.Time, newestFirst bool) bool {
+	if a == nil || b == nil {
+		return a != nil && b == nil
+	}
+	if newestFirst {
+		return a.After(*b)
+	}
+	return a.Before(*b)
+}
+
+// inRange reports whether t falls in [from, before). A nil bound is
+// open; an unknown date never matches a bounded range.
+func inRange(t, from, before *time.Time) bool {
+	if from == nil && before == nil {
+		return true
+	}
+	return t != nil && (from == nil || !t.Before(*from)) && (before == nil || t.Before(*before))
+}
+
+// parseDateRange reads the query parameters from and to as the start and
+// the exclusive end of a range, the bounds every date filter uses. Both
+// take YYYY, YYYY-MM, YYYY-MM-DD or an RFC 3339 timestamp, and both are
+// inclusive as written: a bare date as to covers the whole year, month or
+// day it names, a timestamp its millisecond.
+func parseDateRange(c *gin.Context, from, to string) (start, before *time.Time, err error) {
+	if v := c.Query(from); v != "" {
+		t, _, err := parseDateBound(v)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %v", from, err)
+		}
+		start = &t
+	}
+	if v := c.Query(to); v != "" {
+		t, next, err := parseDateBound(v)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %v", to, err)
+		}
+		end := next(t)
+		before = &end
+	}
+	if start != nil && before != nil && !start.Before(*before) {
+		return nil, nil, fmt.Errorf("%s is after %s", from, to)
+	}
+	return start, before, nil
+}
+
+// parseDateBound reads a date filter value and returns the start of the
+// period it names, and how to get from there to the start of the next.
+func parseDateBound(v string) (time.Time, func(time.Time) time.Time, error) {
+	steps := []struct {
+		layout string
+		next   func(time.Time) time.Time
+	}{
+		{"2006-01-02", func(t time.Time) time.Time { return t.AddDate(0, 0, 1) }},
+		{"2006-01", func(t time.Time) time.Time { return t.AddDate(0, 1, 0) }},
+		{"2006", func(t time.Time) time.Time { return t.AddDate(1, 0, 0) }},
+		{time.RFC3339, func(t time.Time) time.Time { return t.Truncate(time.Millisecond).Add(time.Millisecond) }},
+	}
+	for _, step := range steps {
+		if t, err := time.Parse(step.layout, v); err == nil {
+			return t, step.next, nil
+		}
+	}
+	return time.Time{}, nil, fmt.Errorf("%q is not a date (YYYY, YYYY-MM, YYYY-MM-DD or RFC 3339)", v)
+}
@@ -0,0 +1,845 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	manifestName      = "MANIFEST"
+	memtableMaxDocs   = 64
+	memtableMaxBytes  = 32 << 20
+	maxSegments       = 10
+	segmentsPerMerge  = 5
+	walRecordHeadSize = 8
+	// maxWALRecord bounds one logged document, so a corrupt length at the
+	// tail of the log cannot make replay allocate gigabytes.
+	maxWALRecord = 256 << 20
+)
+
+// DiskStore is the embedded BookStore. Writes go to a write-ahead log and an
+// in-memory table, which is flushed into immutable segments on disk. The
+// MANIFEST names the live segments, the documents deleted from each and the
+// current log; it is replaced atomically, so a crash at any point leaves
+// either the old or the new index.
+type DiskStore struct {
+	mu       sync.RWMutex
+	dir      string
+	manifest manifest
+	segments []*segment
+	memtable *MemoryStore
+	memBytes int
+	live     map[string]docRef
+	wal      *os.File
+	// walErr is set when a failed append could not be cut back out of the
+	// log; the store then refuses writes, since later records would be
+	// replayed after a torn one and lost.
+	walErr error
+	// versions counts the writes to each book since the store was opened.
+	versions map[string]int64
+	// meta holds what List filters and sorts on for every live book. It is
+	// built by the first listing and kept up to date from then on.
+	meta map[string]listDoc
+}
+
+type manifest struct {
+	Generation int64            `json:"generation"`
+	NextID     int64            `json:"next_id"`
+	Segments   []string         `json:"segments"`
+	Deleted    map[string][]int `json:"deleted"`
+	WAL        string           `json:"wal"`
+}
+
+// docRef locates the live version of a document: a segment ordinal, or the
+// memtable when seg is nil.
+type docRef struct {
+	seg *segment
+	ord int
+}
+
+type walRecord struct {
+	Op     string          `json:"op"`
+	ID     string          `json:"id"`
+	Source json.RawMessage `json:"source,omitempty"`
+}
+
+func OpenDiskStore(dir string) (*DiskStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	s := &DiskStore{
+		dir:      dir,
+		memtable: newMemoryStore(indexedFields),
+		live:     make(map[string]docRef),
+		versions: make(map[string]int64),
+	}
+	if err := s.readManifest(); err != nil {
+		return nil, err
+	}
+	for _, name := range s.manifest.Segments {
+		seg, err := openSegment(filepath.Join(dir, name), name)
+		if err != nil {
+			s.Close()
+			return nil, fmt.Errorf("open segment %s: %v", name, err)
+		}
+		s.segments = append(s.segments, seg)
+	}
+	s.buildLive()
+	s.removeOrphans()
+	if err := s.replayWAL(); err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *DiskStore) Get(ctx context.Context, id string) (json.RawMessage, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.get(id)
+}
+
+func (s *DiskStore) GetVersion(ctx context.Context, id string) (json.RawMessage, Version, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	src, err := s.get(id)
+	if err != nil {
+		return nil, Version{}, err
+	}
+	return src, Version{s.versions[id], processTerm}, nil
+}
+
+func (s *DiskStore) Replace(ctx context.Context, book Book, ifMatch Version) (Version, error) {
+	src, err := json.Marshal(book)
+	if err != nil {
+		return Version{}, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.get(book.ID); err != nil {
+		return Version{}, err
+	}
+	if (Version{s.versions[book.ID], processTerm}) != ifMatch {
+		return Version{}, ErrPreconditionFailed
+	}
+	if err := s.apply([]walRecord{{Op: "index", ID: book.ID, Source: src}}); err != nil {
+		return Version{}, err
+	}
+	return Version{s.versions[book.ID], processTerm}, nil
+}
+
+func (s *DiskStore) UpdateFields(ctx context.Context, id string, fields map[string]interface{}, ifMatch Version) (Version, error) {
+	patch, err := json.Marshal(fields)
+	if err != nil {
+		return Version{}, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	src, err := s.get(id)
+	if err != nil {
+		return Version{}, err
+	}
+	if (Version{s.versions[id], processTerm}) != ifMatch {
+		return Version{}, ErrPreconditionFailed
+	}
+	merged, err := mergeSource(src, patch)
+	if err != nil {
+		return Version{}, err
+	}
+	if err := s.apply([]walRecord{{Op: "index", ID: id, Source: merged}}); err != nil {
+		return Version{}, err
+	}
+	return Version{s.versions[id], processTerm}, nil
+}
+
+func (s *DiskStore) Index(ctx context.Context, book Book) error {
+	src, err := json.Marshal(book)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.apply([]walRecord{{Op: "index", ID: book.ID, Source: src}})
+}
+
+func (s *DiskStore) Create(ctx context.Context, book Book) error {
+	src, err := json.Marshal(book)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.get(book.ID); err == nil {
+		return ErrConflict
+	} else if err != ErrNotFound {
+		return err
+	}
+	return s.apply([]walRecord{{Op: "index", ID: book.ID, Source: src}})
+}
+
+func (s *DiskStore) Update(ctx context.Context, book Book) error {
+	patch, err := json.Marshal(book)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	src, err := s.get(book.ID)
+	if err != nil {
+		return err
+	}
+	merged, err := mergeSource(src, patch)
+	if err != nil {
+		return err
+	}
+	return s.apply([]walRecord{{Op: "index", ID: book.ID, Source: merged}})
+}
+
+func (s *DiskStore) Delete(ctx context.Context, id string) (*DeleteResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.live[id]; !ok {
+		return nil, ErrNotFound
+	}
+	return s.deleteLocked(id)
+}
+
+func (s *DiskStore) DeleteIf(ctx context.Context, id string, ifMatch Version) (*DeleteResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.live[id]; !ok {
+		return nil, ErrNotFound
+	}
+	if (Version{s.versions[id], processTerm}) != ifMatch {
+		return nil, ErrPreconditionFailed
+	}
+	return s.deleteLocked(id)
+}
+
+func (s *DiskStore) deleteLocked(id string) (*DeleteResult, error) {
+	if err := s.apply([]walRecord{{Op: "delete", ID: id}}); err != nil {
+		return nil, err
+	}
+	return &DeleteResult{
+		Index:  elasticIndexName,
+		Type:   elasticTypeName,
+		ID:     id,
+		Result: "deleted",
+	}, nil
+}
+
+func (s *DiskStore) Bulk(ctx context.Context, books []Book) error {
+	records := make([]walRecord, len(books))
+	for i, book := range books {
+		src, err := json.Marshal(book)
+		if err != nil {
+			return err
+		}
+		records[i] = walRecord{Op: "index", ID: book.ID, Source: src}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.apply(records)
+}
+
+func (s *DiskStore) Search(ctx context.Context, q SpanQuery) ([]SearchHit, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	found := make([]spanHit, 0)
+	for _, h := range s.memtable.spanHits(q) {
+		if ref, ok := s.live[h.id]; ok && ref.seg == nil {
+			found = append(found, h)
+		}
+	}
+	for _, seg := range s.segments {
+		hits, err := s.segmentSpanHits(seg, q)
+		if err != nil {
+			return nil, err
+		}
+		found = append(found, hits...)
+	}
+	sortSpanHits(found)
+
+	hits := make([]SearchHit, 0)
+	for _, h := range pageSpanHits(found, q.From, q.Size) {
+		src, err := s.get(h.id)
+		if err != nil {
+			return nil, err
+		}
+		hit := SearchHit{ID: h.id, Source: src}
+		if q.HighlightField != "" {
+			hit.Highlight = map[string][]string{}
+			if q.HighlightField == q.Field {
+				var fields map[string]interface{}
+				json.Unmarshal(src, &fields)
+				text, _ := fields[q.Field].(string)
+				hit.Highlight[q.HighlightField] = highlightSpans(text, h.matches)
+			}
+		}
+		hits = append(hits, hit)
+	}
+	return hits, nil
+}
+
+// Export reads the books one at a time from their segments.
+func (s *DiskStore) Export(ctx context.Context, q ExportQuery, fn func(json.RawMessage) error) error {
+	return exportDocs(ctx, s.IDs(), func(id string) (json.RawMessage, error) { return s.Get(ctx, id) }, q, fn)
+}
+
+func (s *DiskStore) List(ctx context.Context, q ListQuery) (ListPage, error) {
+	docs, err := s.listMeta()
+	if err != nil {
+		return ListPage{}, err
+	}
+	return listDocs(ctx, docs, func(id string) (json.RawMessage, error) { return s.Get(ctx, id) }, q)
+}
+
+// listMeta returns the listDoc of every live book, reading them all the
+// first time.
+func (s *DiskStore) listMeta() ([]listDoc, error) {
+	s.mu.RLock()
+	built := s.meta != nil
+	s.mu.RUnlock()
+	if !built {
+		s.mu.Lock()
+		if s.meta == nil {
+			meta := make(map[string]listDoc, len(s.live))
+			for id := range s.live {
+				src, err := s.get(id)
+				if err != nil {
+					s.mu.Unlock()
+					return nil, err
+				}
+				meta[id] = listDocOf(id, src)
+			}
+			s.meta = meta
+		}
+		s.mu.Unlock()
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	docs := make([]listDoc, 0, len(s.meta))
+	for _, doc := range s.meta {
+		docs = append(docs, doc)
+	}
+	return docs, nil
+}
+
+// IDs returns the IDs of the live documents.
+func (s *DiskStore) IDs() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	ids := make([]string, 0, len(s.live))
+	for id := range s.live {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// Close flushes the memtable and releases the index files.
+func (s *DiskStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var err error
+	if s.wal != nil && len(s.memtable.docs) > 0 {
+		err = s.flush()
+	}
+	if s.wal != nil {
+		s.wal.Close()
+		s.wal = nil
+	}
+	for _, seg := range s.segments {
+		seg.close()
+	}
+	s.segments = nil
+	return err
+}
+
+func (s *DiskStore) get(id string) (json.RawMessage, error) {
+	ref, ok := s.live[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	if ref.seg == nil {
+		return s.memtable.docs[id], nil
+	}
+	return ref.seg.source(ref.ord)
+}
+
+func (s *DiskStore) segmentSpanHits(seg *segment, q SpanQuery) ([]spanHit, error) {
+	sf, ok := seg.fields[q.Field]
+	if !ok {
+		return nil, nil
+	}
+	clauses := make([]map[string][]int, len(q.Terms))
+	for i, term := range q.Terms {
+		expanded := expandFuzzy(term, q.Fuzziness[i], func(yield func(string)) {
+			for _, t := range sf.terms {
+				yield(t)
+			}
+		})
+		clauses[i] = make(map[string][]int)
+		for _, t := range expanded {
+			lists, err := seg.postings(q.Field, t)
+			if err != nil {
+				return nil, err
+			}
+			for ord, positions := range lists {
+				id := seg.ids[ord]
+				if ref := s.live[id]; ref.seg != seg || ref.ord != ord {
+					continue
+				}
+				clauses[i][id] = append(clauses[i][id], positions...)
+			}
+		}
+	}
+	var keep func(string) bool
+	if q.filtered() {
+		keep = func(id string) bool {
+			src, err := seg.source(s.live[id].ord)
+			return err == nil && q.matchSource(src)
+		}
+	}
+	return collectSpanHits(clauses, q, keep), nil
+}
+
+// apply logs records durably, then applies them to the memtable.
+func (s *DiskStore) apply(records []walRecord) error {
+	if err := s.appendWAL(records); err != nil {
+		return err
+	}
+	for _, r := range records {
+		s.applyRecord(r)
+	}
+	if len(s.memtable.docs) >= memtableMaxDocs || s.memBytes >= memtableMaxBytes {
+		if err := s.flush(); err != nil {
+			log.Println("flush failed:", err)
+		}
+	}
+	return nil
+}
+
+func (s *DiskStore) applyRecord(r walRecord) {
+	s.versions[r.ID]++
+	switch r.Op {
+	case "index":
+		if old, ok := s.memtable.docs[r.ID]; ok {
+			s.memBytes -= len(old)
+		}
+		s.memtable.put(r.ID, r.Source)
+		s.memBytes += len(r.Source)
+		s.live[r.ID] = docRef{}
+		if s.meta != nil {
+			s.meta[r.ID] = listDocOf(r.ID, r.Source)
+		}
+	case "delete":
+		if old, ok := s.memtable.docs[r.ID]; ok {
+			s.memBytes -= len(old)
+			s.memtable.remove(r.ID)
+			delete(s.memtable.docs, r.ID)
+		}
+		delete(s.live, r.ID)
+		if s.meta != nil {
+			delete(s.meta, r.ID)
+		}
+	}
+}
+
+// flush writes the memtable out as a new segment, commits a manifest that
+// includes it and starts a fresh log.
+func (s *DiskStore) flush() error {
+	ids := make([]string, 0, len(s.memtable.docs))
+	for id := range s.memtable.docs {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	docs := make([]segmentDoc, len(ids))
+	for i, id := range ids {
+		docs[i] = segmentDoc{id: id, src: s.memtable.docs[id]}
+	}
+
+	next := s.manifest
+	segs := append([]*segment(nil), s.segments...)
+	var seg *segment
+	if len(docs) > 0 {
+		name := s.nextName(&next, "seg", ".dat")
+		path := filepath.Join(s.dir, name)
+		if err := writeSegment(path, docs); err != nil {
+			return err
+		}
+		var err error
+		if seg, err = openSegment(path, name); err != nil {
+			return err
+		}
+		segs = append(segs, seg)
+	}
+	wal := s.nextName(&next, "wal", ".log")
+	if err := s.commit(next, segs, wal, func(id string) docRef {
+		if ref, ok := s.live[id]; ok && ref.seg == nil {
+			return docRef{seg: seg, ord: sort.SearchStrings(ids, id)}
+		}
+		return s.live[id]
+	}); err != nil {
+		if seg != nil {
+			seg.close()
+			os.Remove(filepath.Join(s.dir, seg.name))
+		}
+		return err
+	}
+
+	s.memtable = newMemoryStore(indexedFields)
+	s.memBytes = 0
+	if len(s.segments) > maxSegments {
+		if err := s.merge(); err != nil {
+			log.Println("merge failed:", err)
+		}
+	}
+	return nil
+}
+
+// merge rewrites the smallest segments as one.
+func (s *DiskStore) merge() error {
+	liveCount := make(map[*segment]int)
+	for _, ref := range s.live {
+		if ref.seg != nil {
+			liveCount[ref.seg]++
+		}
+	}
+	bySize := append([]*segment(nil), s.segments...)
+	sort.SliceStable(bySize, func(i, j int) bool {
+		return liveCount[bySize[i]] < liveCount[bySize[j]]
+	})
+	victims := make(map[*segment]bool)
+	for _, seg := range bySize[:segmentsPerMerge] {
+		victims[seg] = true
+	}
+
+	docs := make([]segmentDoc, 0)
+	for _, seg := range s.segments {
+		if !victims[seg] {
+			continue
+		}
+		for ord, id := range seg.ids {
+			if ref := s.live[id]; ref.seg != seg || ref.ord != ord {
+				continue
+			}
+			src, err := seg.source(ord)
+			if err != nil {
+				return err
+			}
+			docs = append(docs, segmentDoc{id: id, src: src})
+		}
+	}
+	sort.Slice(docs, func(i, j int) bool { return docs[i].id < docs[j].id })
+	ords := make(map[string]int, len(docs))
+	for i, d := range docs {
+		ords[d.id] = i
+	}
+
+	next := s.manifest
+	segs := make([]*segment, 0, len(s.segments))
+	for _, seg := range s.segments {
+		if !victims[seg] {
+			segs = append(segs, seg)
+		}
+	}
+	name := s.nextName(&next, "seg", ".dat")
+	path := filepath.Join(s.dir, name)
+	if err := writeSegment(path, docs); err != nil {
+		return err
+	}
+	merged, err := openSegment(path, name)
+	if err != nil {
+		return err
+	}
+	segs = append(segs, merged)
+	if err := s.commit(next, segs, s.manifest.WAL, func(id string) docRef {
+		ref := s.live[id]
+		if victims[ref.seg] {
+			return docRef{seg: merged, ord: ords[id]}
+		}
+		return ref
+	}); err != nil {
+		merged.close()
+		os.Remove(path)
+		return err
+	}
+	for seg := range victims {
+		seg.close()
+		os.Remove(filepath.Join(s.dir, seg.name))
+	}
+	return nil
+}
+
+// commit atomically installs a manifest listing segs and wal, then swaps the
+// in-memory state over. relocate maps every live ID to its new location.
+func (s *DiskStore) commit(next manifest, segs []*segment, wal string, relocate func(id string) docRef) error {
+	live := make(map[string]docRef, len(s.live))
+	for id := range s.live {
+		live[id] = relocate(id)
+	}
+	next.Generation++
+	next.Segments = make([]string, len(segs))
+	next.Deleted = make(map[string][]int)
+	for i, seg := range segs {
+		next.Segments[i] = seg.name
+		for ord, id := range seg.ids {
+			if ref, ok := live[id]; !ok || ref.seg != seg || ref.ord != ord {
+				next.Deleted[seg.name] = append(next.Deleted[seg.name], ord)
+			}
+		}
+	}
+
+	oldWAL := s.manifest.WAL
+	var f *os.File
+	if wal != oldWAL {
+		var err error
+		f, err = os.OpenFile(filepath.Join(s.dir, wal), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+		if err != nil {
+			return err
+		}
+	}
+	next.WAL = wal
+	if err := s.writeManifest(next); err != nil {
+		if f != nil {
+			f.Close()
+			os.Remove(filepath.Join(s.dir, wal))
+		}
+		return err
+	}
+	if f != nil {
+		if s.wal != nil {
+			s.wal.Close()
+		}
+		s.wal = f
+		if oldWAL != "" {
+			os.Remove(filepath.Join(s.dir, oldWAL))
+		}
+	}
+	s.manifest = next
+	s.segments = segs
+	s.live = live
+	return nil
+}
+
+func (s *DiskStore) nextName(m *manifest, prefix, ext string) string {
+	m.NextID++
+	return fmt.Sprintf("%s_%08d%s", prefix, m.NextID, ext)
+}
+
+func (s *DiskStore) readManifest() error {
+	data, err := ioutil.ReadFile(filepath.Join(s.dir, manifestName))
+	if os.IsNotExist(err) {
+		s.manifest = manifest{Deleted: make(map[string][]int)}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, &s.manifest); err != nil {
+		return fmt.Errorf("read %s: %v", manifestName, err)
+	}
+	return nil
+}
+
+func (s *DiskStore) writeManifest(m manifest) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(s.dir, manifestName+".tmp")
+	f, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(s.dir, manifestName)); err != nil {
+		return err
+	}
+	return syncDir(s.dir)
+}
+
+// buildLive resolves which segment holds the live version of each ID.
+func (s *DiskStore) buildLive() {
+	for _, seg := range s.segments {
+		deleted := make(map[int]bool)
+		for _, ord := range s.manifest.Deleted[seg.name] {
+			deleted[ord] = true
+		}
+		for ord, id := range seg.ids {
+			if !deleted[ord] {
+				s.live[id] = docRef{seg: seg, ord: ord}
+			}
+		}
+	}
+}
+
+// removeOrphans deletes files left behind by a flush or merge that crashed
+// before its manifest was committed.
+func (s *DiskStore) removeOrphans() {
+	keep := map[string]bool{manifestName: true, s.manifest.WAL: true}
+	for _, name := range s.manifest.Segments {
+		keep[name] = true
+	}
+	entries, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return
+	}
+	for _, e := range entries {
+		name := e.Name()
+		if keep[name] || !(strings.HasPrefix(name, "seg_") || strings.HasPrefix(name, "wal_") || strings.HasSuffix(name, ".tmp")) {
+			continue
+		}
+		log.Println("removing orphaned index file", name)
+		os.Remove(filepath.Join(s.dir, name))
+	}
+}
+
+// replayWAL re-applies the current log. A torn record at the tail, left by a
+// crash mid-append, is truncated away.
+func (s *DiskStore) replayWAL() error {
+	if s.manifest.WAL == "" {
+		next := s.manifest
+		wal := s.nextName(&next, "wal", ".log")
+		return s.commit(next, s.segments, wal, func(id string) docRef { return s.live[id] })
+	}
+	f, err := os.OpenFile(filepath.Join(s.dir, s.manifest.WAL), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	r := bufio.NewReader(f)
+	var good int64
+	count := 0
+	for {
+		rec, n, err := readWALRecord(r)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Printf("truncating %s at offset %d: %v", s.manifest.WAL, good, err)
+			if err := f.Truncate(good); err != nil {
+				f.Close()
+				return err
+			}
+			break
+		}
+		s.applyRecord(rec)
+		good += n
+		count++
+	}
+	if _, err := f.Seek(good, io.SeekStart); err != nil {
+		f.Close()
+		return err
+	}
+	s.wal = f
+	if count > 0 {
+		log.Printf("replayed %d records from %s", count, s.manifest.WAL)
+	}
+	return nil
+}
+
+// appendWAL logs records and syncs them. A write or sync that fails is
+// truncated back out of the log, so it cannot hide the records after it.
+func (s *DiskStore) appendWAL(records []walRecord) error {
+	if s.walErr != nil {
+		return s.walErr
+	}
+	var buf []byte
+	for _, r := range records {
+		payload, err := json.Marshal(r)
+		if err != nil {
+			return err
+		}
+		if len(payload) > maxWALRecord {
+			return fmt.Errorf("document %s is larger than %d bytes", r.ID, maxWALRecord)
+		}
+		head := make([]byte, walRecordHeadSize)
+		binary.LittleEndian.PutUint32(head[0:], uint32(len(payload)))
+		binary.LittleEndian.PutUint32(head[4:], crc32.ChecksumIEEE(payload))
+		buf = append(buf, head...)
+		buf = append(buf, payload...)
+	}
+	end, err := s.wal.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	_, err = s.wal.Write(buf)
+	if err == nil {
+		err = s.wal.Sync()
+	}
+	if err != nil {
+		if terr := s.rewindWAL(end); terr != nil {
+			s.walErr = fmt.Errorf("write-ahead log %s is damaged, reopen the store: %v", s.manifest.WAL, terr)
+			log.Println(s.walErr)
+		}
+		return err
+	}
+	return nil
+}
+
+// rewindWAL cuts the log back to end, the offset of the last good record.
+func (s *DiskStore) rewindWAL(end int64) error {
+	if err := s.wal.Truncate(end); err != nil {
+		return err
+	}
+	if _, err := s.wal.Seek(end, io.SeekStart); err != nil {
+		return err
+	}
+	return s.wal.Sync()
+}
+
+func readWALRecord(r *bufio.Reader) (walRecord, int64, error) {
+	var rec walRecord
+	head := make([]byte, walRecordHeadSize)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return rec, 0, err
+	}
+	size := binary.LittleEndian.Uint32(head[0:])
+	if size > maxWALRecord {
+		return rec, 0, fmt.Errorf("record length %d is out of range", size)
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return rec, 0, io.ErrUnexpectedEOF
+	}
+	if crc32.ChecksumIEEE(payload) != binary.LittleEndian.Uint32(head[4:]) {
+		return rec, 0, fmt.Errorf("checksum mismatch")
+	}
+	if err := json.Unmarshal(payload, &rec); err != nil {
+		return rec, 0, err
+	}
+	return rec, int64(walRecordHeadSize) + int64(size), nil
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func tempDir(t *testing.T) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "booksearch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+func openTestDiskStore(t *testing.T, dir string) *DiskStore {
+	t.Helper()
+	s, err := OpenDiskStore(dir)
+	if err != nil {
+		t.Fatalf("OpenDiskStore: %v", err)
+	}
+	return s
+}
+
+func indexTestBooks(t *testing.T, s *DiskStore, ids ...string) {
+	t.Helper()
+	for _, id := range ids {
+		if err := s.Index(context.Background(), Book{ID: id, Title: "Book " + id, Content: "text of book " + id}); err != nil {
+			t.Fatalf("Index %s: %v", id, err)
+		}
+	}
+}
+
+// crash drops the store without the flush Close would do, as a killed
+// process would.
+func crash(s *DiskStore) {
+	s.wal.Close()
+	for _, seg := range s.segments {
+		seg.close()
+	}
+}
+
+func assertBooks(t *testing.T, s *DiskStore, present, absent []string) {
+	t.Helper()
+	for _, id := range present {
+		if _, err := s.Get(context.Background(), id); err != nil {
+			t.Errorf("Get %s: %v", id, err)
+		}
+	}
+	for _, id := range absent {
+		if _, err := s.Get(context.Background(), id); err != ErrNotFound {
+			t.Errorf("Get %s: got %v, want ErrNotFound", id, err)
+		}
+	}
+}
+
+func TestDiskStoreTornWALRecord(t *testing.T) {
+	dir := tempDir(t)
+	s := openTestDiskStore(t, dir)
+	indexTestBooks(t, s, "1", "2", "3")
+	wal := filepath.Join(dir, s.manifest.WAL)
+	crash(s)
+
+	info, err := os.Stat(wal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Cut the last record in half.
+	if err := os.Truncate(wal, info.Size()-10); err != nil {
+		t.Fatal(err)
+	}
+
+	s = openTestDiskStore(t, dir)
+	assertBooks(t, s, []string{"1", "2"}, []string{"3"})
+	// A write after the torn record was cut away must survive the next
+	// reopen.
+	indexTestBooks(t, s, "4")
+	crash(s)
+
+	s = openTestDiskStore(t, dir)
+	defer s.Close()
+	assertBooks(t, s, []string{"1", "2", "4"}, []string{"3"})
+}
+
+func TestDiskStoreCorruptWALLength(t *testing.T) {
+	dir := tempDir(t)
+	s := openTestDiskStore(t, dir)
+	indexTestBooks(t, s, "1")
+	wal := filepath.Join(dir, s.manifest.WAL)
+	crash(s)
+	before, err := os.Stat(wal)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A header claiming a 4 GB record, as garbage at the tail might.
+	f, err := os.OpenFile(wal, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	head := make([]byte, walRecordHeadSize)
+	binary.LittleEndian.PutUint32(head, 0xffffffff)
+	f.Write(head)
+	f.Close()
+
+	s = openTestDiskStore(t, dir)
+	defer s.Close()
+	assertBooks(t, s, []string{"1"}, nil)
+	info, err := os.Stat(wal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != before.Size() {
+		t.Fatalf("log is %d bytes after replay, want the %d before the garbage", info.Size(), before.Size())
+	}
+	indexTestBooks(t, s, "2")
+	assertBooks(t, s, []string{"1", "2"}, nil)
+}
+
+func TestDiskStoreCorruptSegmentFooter(t *testing.T) {
+	dir := tempDir(t)
+	s := openTestDiskStore(t, dir)
+	indexTestBooks(t, s, "1", "2")
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.manifest.Segments) != 1 {
+		t.Fatalf("segments after close: %v", s.manifest.Segments)
+	}
+	path := filepath.Join(dir, s.manifest.Segments[0])
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Flip a byte of the meta checksum in the footer.
+	data[len(data)-len(segmentMagic)-1] ^= 0xff
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = OpenDiskStore(dir)
+	if err == nil || !strings.Contains(err.Error(), errCorruptSegment.Error()) {
+		t.Fatalf("OpenDiskStore with a corrupt segment: got %v, want %v", err, errCorruptSegment)
+	}
+}
+
+func TestDiskStoreStaleManifestTmp(t *testing.T) {
+	dir := tempDir(t)
+	s := openTestDiskStore(t, dir)
+	indexTestBooks(t, s, "1", "2")
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// A crash while writing the next manifest leaves a half-written
+	// MANIFEST.tmp and an uncommitted segment.
+	tmp := filepath.Join(dir, manifestName+".tmp")
+	if err := ioutil.WriteFile(tmp, []byte(`{"generation": 99, "segm`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	orphan := filepath.Join(dir, "seg_99999999.dat")
+	if err := ioutil.WriteFile(orphan, []byte("partial"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s = openTestDiskStore(t, dir)
+	defer s.Close()
+	assertBooks(t, s, []string{"1", "2"}, nil)
+	for _, path := range []string{tmp, orphan} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("%s was not removed: %v", filepath.Base(path), err)
+		}
+	}
+}
+
+func TestDiskStoreFailedAppendStopsWrites(t *testing.T) {
+	dir := tempDir(t)
+	s := openTestDiskStore(t, dir)
+	indexTestBooks(t, s, "1")
+	wal := s.wal
+	// A handle that can neither write nor truncate the log.
+	ro, err := os.Open(wal.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.wal = ro
+	if err := s.Index(context.Background(), Book{ID: "2", Title: "Two", Content: "two"}); err == nil {
+		t.Fatal("Index succeeded on a log that cannot be written")
+	}
+	s.wal = wal
+	ro.Close()
+	if err := s.Index(context.Background(), Book{ID: "3", Title: "Three", Content: "three"}); err == nil {
+		t.Fatal("Index succeeded after an append that could not be cut back")
+	}
+	crash(s)
+
+	s = openTestDiskStore(t, dir)
+	defer s.Close()
+	assertBooks(t, s, []string{"1"}, []string{"2", "3"})
+}
+
+// listTitles pages through a listing by title two books at a time.
+func listTitles(t *testing.T, s *DiskStore) []string {
+	t.Helper()
+	q := ListQuery{ListFilter: ListFilter{Sort: "title"}, Limit: 2}
+	var titles []string
+	for {
+		page, err := s.List(context.Background(), q)
+		if err != nil {
+			t.Fatalf("List: %v", err)
+		}
+		for _, src := range page.Books {
+			var book Book
+			if err := json.Unmarshal(src, &book); err != nil {
+				t.Fatal(err)
+			}
+			titles = append(titles, book.Title)
+		}
+		if page.Next == nil {
+			return titles
+		}
+		q.After = page.Next
+	}
+}
+
+func TestDiskStoreListFollowsWrites(t *testing.T) {
+	dir := tempDir(t)
+	s := openTestDiskStore(t, dir)
+	ctx := context.Background()
+	for _, b := range []Book{{ID: "1", Title: "Cc"}, {ID: "2", Title: "Aa"}, {ID: "3", Title: "Bb"}} {
+		if err := s.Index(ctx, b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := strings.Join(listTitles(t, s), ","); got != "Aa,Bb,Cc" {
+		t.Fatalf("listed %s, want Aa,Bb,Cc", got)
+	}
+
+	// Writes after the first listing reach the listing table.
+	if _, err := s.Delete(ctx, "3"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Index(ctx, Book{ID: "1", Title: "Ab"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Index(ctx, Book{ID: "4", Title: "Dd"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(listTitles(t, s), ","); got != "Aa,Ab,Dd" {
+		t.Fatalf("listed %s, want Aa,Ab,Dd", got)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	s = openTestDiskStore(t, dir)
+	defer s.Close()
+	if got := strings.Join(listTitles(t, s), ","); got != "Aa,Ab,Dd" {
+		t.Fatalf("listed %s after reopening, want Aa,Ab,Dd", got)
+	}
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/olivere/elastic"
+)
+
+// ElasticConfig holds the connection settings of the elastic engine.
+type ElasticConfig struct {
+	// URLs is a comma-separated list of node URLs.
+	URLs     string
+	Username string
+	Password string
+	// APIKey is the base64 "id:key" credential sent as
+	// "Authorization: ApiKey ..."; it excludes Username and Password.
+	APIKey string
+	// CAFile is a PEM bundle trusted in addition to the system roots.
+	CAFile  string
+	Timeout time.Duration
+	// MaxRetries and Backoff govern retries of requests that failed to
+	// reach a node; the backoff doubles per attempt up to MaxBackoff.
+	MaxRetries int
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	Sniff      bool
+	// StartupAttempts bounds how often connecting is tried at startup,
+	// StartupBackoff doubling between attempts up to MaxBackoff.
+	StartupAttempts int
+	StartupBackoff  time.Duration
+	HealthInterval  time.Duration
+}
+
+var defaultElasticConfig = ElasticConfig{
+	URLs:            "http://elasticsearch:9200",
+	Timeout:         30 * time.Second,
+	MaxRetries:      3,
+	Backoff:         100 * time.Millisecond,
+	MaxBackoff:      30 * time.Second,
+	StartupAttempts: 10,
+	StartupBackoff:  time.Second,
+	HealthInterval:  10 * time.Second,
+}
+
+// clientOptions turns cfg into client options, failing on settings that
+// no number of retries will fix. Secrets not given as flags are read from
+// $ES_PASSWORD and $ES_API_KEY, which keeps them out of the process list.
+func (cfg ElasticConfig) clientOptions() ([]elastic.ClientOptionFunc, error) {
+	if cfg.Password == "" {
+		cfg.Password = os.Getenv("ES_PASSWORD")
+	}
+	if cfg.APIKey == "" {
+		cfg.APIKey = os.Getenv("ES_API_KEY")
+	}
+	urls := splitList(cfg.URLs)
+	if len(urls) == 0 {
+		return nil, errors.New("no elasticsearch URL given")
+	}
+	if cfg.APIKey != "" && (cfg.Username != "" || cfg.Password != "") {
+		return nil, errors.New("give either an elasticsearch API key or a username and password, not both")
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if cfg.CAFile != "" {
+		pem, err := ioutil.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%s has no PEM certificates", cfg.CAFile)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+
+	options := []elastic.ClientOptionFunc{
+		elastic.SetURL(urls...),
+		elastic.SetHttpClient(&http.Client{Transport: transport, Timeout: cfg.Timeout}),
+		elastic.SetSniff(cfg.Sniff),
+		elastic.SetHealthcheckTimeoutStartup(cfg.Timeout),
+		elastic.SetHealthcheckTimeout(cfg.Timeout),
+		elastic.SetRetrier(boundedRetrier{elastic.NewExponentialBackoff(cfg.Backoff, cfg.MaxBackoff), cfg.MaxRetries}),
+	}
+	if strings.HasPrefix(urls[0], "https://") {
+		// Nodes found by sniffing are reached the same way.
+		options = append(options, elastic.SetScheme("https"))
+	}
+	if cfg.Username != "" || cfg.Password != "" {
+		options = append(options, elastic.SetBasicAuth(cfg.Username, cfg.Password))
+	}
+	if cfg.APIKey != "" {
+		options = append(options, elastic.SetHeaders(http.Header{"Authorization": {"ApiKey " + cfg.APIKey}}))
+	}
+	return options, nil
+}
+
+// boundedRetrier retries a request that failed to reach a node at most
+// max times.
+type boundedRetrier struct {
+	backoff elastic.Backoff
+	max     int
+}
+
+func (r boundedRetrier) Retry(ctx context.Context, retry int, req *http.Request, resp *http.Response, err error) (time.Duration, bool, error) {
+	if retry > r.max {
+		return 0, false, nil
+	}
+	wait, ok := r.backoff.Next(retry)
+	return wait, ok, nil
+}
+
+// connectElastic creates the client, trying cfg.StartupAttempts times
+// before giving up.
+func connectElastic(cfg ElasticConfig) (*elastic.Client, error) {
+	options, err := cfg.clientOptions()
+	if err != nil {
+		return nil, err
+	}
+	attempts := cfg.StartupAttempts
+	if attempts < 1 {
+		attempts = 1
+	}
+	wait := cfg.StartupBackoff
+	for attempt := 1; ; attempt++ {
+		client, err := elastic.NewClient(options...)
+		if err == nil {
+			return client, nil
+		}
+		if attempt == attempts {
+			return nil, fmt.Errorf("elasticsearch at %s unreachable after %d attempts: %v", cfg.URLs, attempts, err)
+		}
+		log.Printf("elastic: attempt %d of %d: %v; retrying in %v", attempt, attempts, err, wait)
+		time.Sleep(wait)
+		if wait *= 2; wait > cfg.MaxBackoff {
+			wait = cfg.MaxBackoff
+		}
+	}
+}
+
+// Readiness reports whether the service can serve requests. With the
+// elastic engine it follows the health of the cluster.
+type Readiness struct {
+	Ready         bool       `json:"ready"`
+	Engine        string     `json:"engine"`
+	ClusterStatus string     `json:"cluster_status,omitempty"`
+	CheckedAt     *time.Time `json:"checked_at,omitempty"`
+	Error         string     `json:"error,omitempty"`
+}
+
+var (
+	readinessMu sync.RWMutex
+	readiness   Readiness
+)
+
+func setReadiness(r Readiness) {
+	readinessMu.Lock()
+	defer readinessMu.Unlock()
+	readiness = r
+}
+
+func currentReadiness() Readiness {
+	readinessMu.RLock()
+	defer readinessMu.RUnlock()
+	return readiness
+}
+
+// monitorElastic checks cluster health every interval. A cluster that is
+// unreachable or red makes the service unready and pauses a running
+// crawl, which is resumed when the cluster recovers.
+func monitorElastic(ctx context.Context, client *elastic.Client, cfg ElasticConfig) {
+	paused := false
+	check := func() {
+		r := Readiness{Engine: "elastic"}
+		checkCtx, cancel := context.WithTimeout(ctx, cfg.Timeout)
+		health, err := client.ClusterHealth().Do(checkCtx)
+		cancel()
+		now := time.Now()
+		r.CheckedAt = &now
+		switch {
+		case err != nil:
+			r.Error = err.Error()
+		case health.Status == "red":
+			r.ClusterStatus = health.Status
+			r.Error = "cluster status is red"
+		default:
+			r.ClusterStatus = health.Status
+			r.Ready = true
+		}
+		if was := currentReadiness(); was.Ready != r.Ready && was.CheckedAt != nil {
+			if r.Ready {
+				log.Printf("elastic: cluster is back (%s)", r.ClusterStatus)
+			} else {
+				log.Printf("elastic: cluster is down: %s", r.Error)
+			}
+		}
+		setReadiness(r)
+
+		if crawlControl == nil {
+			return
+		}
+		if !r.Ready && !paused {
+			paused = crawlControl.Pause() == nil
+		} else if r.Ready && paused {
+			paused = false
+			if err := crawlControl.Resume(); err != nil {
+				log.Println(err)
+			}
+		}
+	}
+
+	check()
+	ticker := time.NewTicker(cfg.HealthInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			check()
+		}
+	}
+}
+
+// healthEndpoint answers as long as the process serves HTTP.
+func healthEndpoint(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+// readyEndpoint answers 503 while the storage engine cannot serve
+// requests.
+func readyEndpoint(c *gin.Context) {
+	r := currentReadiness()
+	if !r.Ready {
+		c.JSON(http.StatusServiceUnavailable, r)
+		return
+	}
+	c.JSON(http.StatusOK, r)
+}
@@ -0,0 +1,514 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/olivere/elastic"
+)
+
+type ElasticStore struct {
+	client *elastic.Client
+	index  string
+	typ    string
+}
+
+// NewElasticStore returns a store for index. Pass typelessType as typ on
+// clusters without mapping types.
+func NewElasticStore(client *elastic.Client, index, typ string) *ElasticStore {
+	return &ElasticStore{client: client, index: index, typ: typ}
+}
+
+func (s *ElasticStore) typeless() bool {
+	return s.typ == typelessType
+}
+
+// bulkIndex is a bulk index request for a document of the store.
+func (s *ElasticStore) bulkIndex(id string, doc interface{}) *elastic.BulkIndexRequest {
+	req := elastic.NewBulkIndexRequest().Index(s.index).Id(id).Doc(doc)
+	if !s.typeless() {
+		req = req.Type(s.typ)
+	}
+	return req
+}
+
+func (s *ElasticStore) Get(ctx context.Context, id string) (json.RawMessage, error) {
+	res, err := s.client.Get().Index(s.index).Type(s.typ).Id(id).Do(ctx)
+	if elastic.IsNotFound(err) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if res.Source == nil {
+		return nil, ErrNotFound
+	}
+	return *res.Source, nil
+}
+
+// seqNoVersions reports whether the cluster does optimistic concurrency
+// with sequence numbers; Elasticsearch 6 uses the document version, which
+// Version carries as SeqNo with a zero term.
+func seqNoVersions() bool {
+	return elasticCluster.Major >= 7 || elasticCluster.Distribution == "opensearch"
+}
+
+func (s *ElasticStore) GetVersion(ctx context.Context, id string) (json.RawMessage, Version, error) {
+	res, err := s.client.Get().Index(s.index).Type(s.typ).Id(id).Do(ctx)
+	if elastic.IsNotFound(err) {
+		return nil, Version{}, ErrNotFound
+	}
+	if err != nil {
+		return nil, Version{}, err
+	}
+	if res.Source == nil {
+		return nil, Version{}, ErrNotFound
+	}
+	var v Version
+	switch {
+	case seqNoVersions() && res.SeqNo != nil && res.PrimaryTerm != nil:
+		v = Version{*res.SeqNo, *res.PrimaryTerm}
+	case res.Version != nil:
+		v = Version{SeqNo: *res.Version}
+	}
+	return *res.Source, v, nil
+}
+
+func (s *ElasticStore) Replace(ctx context.Context, book Book, ifMatch Version) (Version, error) {
+	defer holdWrites(s.index, book.ID)()
+	index := s.client.Index().Index(s.index).Type(s.typ).Id(book.ID).BodyJson(book)
+	if seqNoVersions() {
+		index = index.IfSeqNo(ifMatch.SeqNo).IfPrimaryTerm(ifMatch.PrimaryTerm)
+	} else {
+		index = index.Version(ifMatch.SeqNo)
+	}
+	res, err := index.Do(ctx)
+	if elastic.IsConflict(err) {
+		return Version{}, s.conflict(ctx, book.ID)
+	}
+	if err != nil {
+		return Version{}, err
+	}
+	if seqNoVersions() {
+		return Version{res.SeqNo, res.PrimaryTerm}, nil
+	}
+	return Version{SeqNo: res.Version}, nil
+}
+
+func (s *ElasticStore) UpdateFields(ctx context.Context, id string, fields map[string]interface{}, ifMatch Version) (Version, error) {
+	defer holdWrites(s.index, id)()
+	var res *elastic.UpdateResponse
+	var err error
+	if s.typeless() {
+		params := url.Values{
+			"if_seq_no":       {strconv.FormatInt(ifMatch.SeqNo, 10)},
+			"if_primary_term": {strconv.FormatInt(ifMatch.PrimaryTerm, 10)},
+		}
+		var raw *elastic.Response
+		raw, err = s.client.PerformRequest(ctx, elastic.PerformRequestOptions{
+			Method: "POST",
+			Path:   "/" + url.PathEscape(s.index) + "/_update/" + url.PathEscape(id),
+			Params: params,
+			Body:   map[string]interface{}{"doc": fields},
+		})
+		if err == nil {
+			res = new(elastic.UpdateResponse)
+			err = json.Unmarshal(raw.Body, res)
+		}
+	} else {
+		update := s.client.Update().Index(s.index).Type(s.typ).Id(id).Doc(fields)
+		if seqNoVersions() {
+			update = update.IfSeqNo(ifMatch.SeqNo).IfPrimaryTerm(ifMatch.PrimaryTerm)
+		} else {
+			update = update.Version(ifMatch.SeqNo)
+		}
+		res, err = update.Do(ctx)
+	}
+	if elastic.IsNotFound(err) {
+		return Version{}, ErrNotFound
+	}
+	if elastic.IsConflict(err) {
+		return Version{}, ErrPreconditionFailed
+	}
+	if err != nil {
+		return Version{}, err
+	}
+	if seqNoVersions() {
+		return Version{res.SeqNo, res.PrimaryTerm}, nil
+	}
+	return Version{SeqNo: res.Version}, nil
+}
+
+func (s *ElasticStore) Index(ctx context.Context, book Book) error {
+	defer holdWrites(s.index, book.ID)()
+	_, err := s.client.Index().Index(s.index).Type(s.typ).Id(book.ID).BodyJson(book).Do(ctx)
+	return err
+}
+
+func (s *ElasticStore) Create(ctx context.Context, book Book) error {
+	defer holdWrites(s.index, book.ID)()
+	_, err := s.client.Index().Index(s.index).Type(s.typ).Id(book.ID).OpType("create").BodyJson(book).Do(ctx)
+	if elastic.IsConflict(err) {
+		return ErrConflict
+	}
+	return err
+}
+
+func (s *ElasticStore) Update(ctx context.Context, book Book) error {
+	defer holdWrites(s.index, book.ID)()
+	var err error
+	if s.typeless() {
+		// Elasticsearch 8 and OpenSearch 2 only know /{index}/_update/{id}.
+		_, err = s.client.PerformRequest(ctx, elastic.PerformRequestOptions{
+			Method: "POST",
+			Path:   "/" + url.PathEscape(s.index) + "/_update/" + url.PathEscape(book.ID),
+			Body:   map[string]interface{}{"doc": book},
+		})
+	} else {
+		_, err = s.client.Update().Index(s.index).Type(s.typ).Id(book.ID).Doc(book).Do(ctx)
+	}
+	if elastic.IsNotFound(err) {
+		return ErrNotFound
+	}
+	return err
+}
+
+// conflict tells apart the two reasons a conditional write of id is
+// refused with a conflict: the document is gone, or at another version.
+func (s *ElasticStore) conflict(ctx context.Context, id string) error {
+	exists, err := s.client.Exists().Index(s.index).Type(s.typ).Id(id).Do(ctx)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return ErrNotFound
+	}
+	return ErrPreconditionFailed
+}
+
+func (s *ElasticStore) Delete(ctx context.Context, id string) (*DeleteResult, error) {
+	defer holdWrites(s.index, id)()
+	return s.delete(ctx, s.client.Delete().Index(s.index).Type(s.typ).Id(id))
+}
+
+func (s *ElasticStore) DeleteIf(ctx context.Context, id string, ifMatch Version) (*DeleteResult, error) {
+	defer holdWrites(s.index, id)()
+	del := s.client.Delete().Index(s.index).Type(s.typ).Id(id)
+	if seqNoVersions() {
+		del = del.IfSeqNo(ifMatch.SeqNo).IfPrimaryTerm(ifMatch.PrimaryTerm)
+	} else {
+		del = del.Version(ifMatch.SeqNo)
+	}
+	res, err := s.delete(ctx, del)
+	if elastic.IsConflict(err) {
+		return nil, s.conflict(ctx, id)
+	}
+	return res, err
+}
+
+func (s *ElasticStore) delete(ctx context.Context, del *elastic.DeleteService) (*DeleteResult, error) {
+	res, err := del.Do(ctx)
+	if elastic.IsNotFound(err) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &DeleteResult{
+		Index:   res.Index,
+		Type:    res.Type,
+		ID:      res.Id,
+		Version: res.Version,
+		Result:  res.Result,
+	}, nil
+}
+
+func (s *ElasticStore) Bulk(ctx context.Context, books []Book) error {
+	if len(books) == 0 {
+		return nil
+	}
+	ids := make([]string, len(books))
+	for i, book := range books {
+		ids[i] = book.ID
+	}
+	defer holdWrites(s.index, ids...)()
+	bulk := s.client.Bulk()
+	for _, book := range books {
+		bulk = bulk.Add(s.bulkIndex(book.ID, book))
+	}
+	res, err := bulk.Do(ctx)
+	if err != nil {
+		return err
+	}
+	return bulkFailure(res)
+}
+
+// bulkFailure reports the items of a bulk request that failed as a
+// *BulkError. Item results carry no _type from Elasticsearch 8 on, so only
+// the ID and the error are used.
+func bulkFailure(res *elastic.BulkResponse) error {
+	failed := res.Failed()
+	if len(failed) == 0 {
+		return nil
+	}
+	err := &BulkError{Failed: make(map[string]error, len(failed))}
+	for _, item := range failed {
+		if item.Error != nil {
+			err.Failed[item.Id] = fmt.Errorf("%s: %s", item.Error.Type, item.Error.Reason)
+		} else {
+			err.Failed[item.Id] = fmt.Errorf("status %d", item.Status)
+		}
+	}
+	return err
+}
+
+// exportScroll is how long the cluster keeps an export's scroll context
+// between pages.
+const exportScroll = "2m"
+
+// Export pages through the books with the scroll API, in index order.
+func (s *ElasticStore) Export(ctx context.Context, q ExportQuery, fn func(json.RawMessage) error) error {
+	body := map[string]interface{}{
+		"query": q.esQuery(),
+		"size":  exportBatchSize,
+		"sort":  []string{"_doc"},
+	}
+	if source := q.esSource(); source != nil {
+		body["_source"] = source
+	}
+	res, err := s.client.PerformRequest(ctx, elastic.PerformRequestOptions{
+		Method: "POST",
+		Path:   "/" + s.index + "/_search",
+		Params: url.Values{"scroll": {exportScroll}},
+		Body:   body,
+	})
+	if err != nil {
+		return err
+	}
+	page, err := decodeSearchResult(res)
+	if err != nil {
+		return err
+	}
+	scrollID := page.ScrollID
+	defer func() {
+		if scrollID == "" {
+			return
+		}
+		_, err := s.client.PerformRequest(context.Background(), elastic.PerformRequestOptions{
+			Method:       "DELETE",
+			Path:         "/_search/scroll",
+			Body:         map[string]interface{}{"scroll_id": []string{scrollID}},
+			IgnoreErrors: []int{http.StatusNotFound},
+		})
+		if err != nil {
+			log.Println(err)
+		}
+	}()
+
+	for len(page.Hits.Hits) > 0 {
+		for _, hit := range page.Hits.Hits {
+			if err := fn(hit.Source); err != nil {
+				return err
+			}
+		}
+		res, err := s.client.PerformRequest(ctx, elastic.PerformRequestOptions{
+			Method: "POST",
+			Path:   "/_search/scroll",
+			Body:   map[string]interface{}{"scroll": exportScroll, "scroll_id": scrollID},
+		})
+		if err != nil {
+			return err
+		}
+		if page, err = decodeSearchResult(res); err != nil {
+			return err
+		}
+		if page.ScrollID != "" {
+			scrollID = page.ScrollID
+		}
+	}
+	return nil
+}
+
+// List pages with search_after, which unlike from and size costs the
+// same however deep the page.
+func (s *ElasticStore) List(ctx context.Context, q ListQuery) (ListPage, error) {
+	body := map[string]interface{}{
+		"query": q.esQuery(),
+		"size":  q.Limit + 1,
+		"sort":  q.esSort(),
+	}
+	if len(q.Exclude) > 0 {
+		body["_source"] = map[string]interface{}{"excludes": q.Exclude}
+	}
+	if len(q.After) > 0 {
+		body["search_after"] = q.After
+	}
+	result, err := rawSearch(ctx, s.client, s.index, body)
+	if err != nil {
+		return ListPage{}, err
+	}
+	var page ListPage
+	for i, hit := range result.Hits.Hits {
+		if i == q.Limit {
+			page.Next = result.Hits.Hits[i-1].Sort
+			break
+		}
+		page.Books = append(page.Books, hit.Source)
+	}
+	return page, nil
+}
+
+// Search runs q against the analyzed subfields when the index has them,
+// and as a span_near query over fuzzy terms when it does not.
+func (s *ElasticStore) Search(ctx context.Context, q SpanQuery) ([]SearchHit, error) {
+	if analyzedSearch(s.index, q.Field) {
+		return s.searchAnalyzed(ctx, q)
+	}
+	return s.searchSpan(ctx, q)
+}
+
+// searchSpan is the query the service was built on: span_near over
+// span_multi fuzzy clauses, highlighted by re-analyzing the field. It
+// works on any text field, and it is slow.
+func (s *ElasticStore) searchSpan(ctx context.Context, q SpanQuery) ([]SearchHit, error) {
+	clause := make([]map[string]interface{}, 0)
+	for i := 0; i < len(q.Terms); i++ {
+		clause = append(clause, map[string]interface{}{
+			"span_multi": map[string]interface{}{
+				"match": map[string]interface{}{
+					"fuzzy": map[string]interface{}{
+						q.Field: map[string]interface{}{
+							"fuzziness": strconv.Itoa(q.Fuzziness[i]),
+							"value":     q.Terms[i],
+						},
+					},
+				},
+			},
+		})
+	}
+
+	esQuery := map[string]interface{}{
+		"span_near": map[string]interface{}{
+			"clauses":  clause,
+			"slop":     q.Slop,
+			"in_order": strconv.FormatBool(q.InOrder),
+		},
+	}
+	var highlight *elastic.Highlight
+	if q.HighlightField != "" {
+		highlight = elastic.NewHighlight().HighlighterType("plain").Field(q.HighlightField)
+	}
+	return s.search(ctx, q, esQuery, highlight, false)
+}
+
+// searchAnalyzed scores documents on three views of the field: the
+// phrase itself within the slop, shingled word pairs and triples, which
+// reward terms that appear together, and stemmed fuzzy terms, of which
+// three in four must match. Documents missing a term still match, ranked
+// lower. Highlighting reads the term vectors.
+func (s *ElasticStore) searchAnalyzed(ctx context.Context, q SpanQuery) ([]SearchHit, error) {
+	text := strings.Join(q.Terms, " ")
+	should := []map[string]interface{}{
+		{"match_phrase": map[string]interface{}{
+			q.Field: map[string]interface{}{"query": text, "slop": q.Slop, "boost": 3},
+		}},
+		{"match": map[string]interface{}{
+			q.Field + ".english": map[string]interface{}{
+				"query":                text,
+				"fuzziness":            "AUTO",
+				"prefix_length":        1,
+				"minimum_should_match": "75%",
+			},
+		}},
+	}
+	if len(q.Terms) > 1 {
+		should = append(should, map[string]interface{}{"match": map[string]interface{}{
+			q.Field + ".shingles": map[string]interface{}{"query": text, "boost": 2},
+		}})
+	}
+	esQuery := map[string]interface{}{
+		"bool": map[string]interface{}{
+			"should":               should,
+			"minimum_should_match": 1,
+		},
+	}
+	var highlight *elastic.Highlight
+	if q.HighlightField != "" {
+		field := elastic.NewHighlighterField(q.HighlightField).HighlighterType("fvh")
+		if analyzedFields[q.HighlightField] {
+			field = field.MatchedFields(q.HighlightField, q.HighlightField+".english", q.HighlightField+".shingles")
+		}
+		highlight = elastic.NewHighlight().Fields(field).Order("score")
+	}
+	return s.search(ctx, q, esQuery, highlight, true)
+}
+
+// search adds q.Filters and the release range to esQuery and runs it.
+// Only scored queries pass on Elasticsearch's score: a span_near score
+// says nothing the handler's own scoring does not.
+func (s *ElasticStore) search(ctx context.Context, q SpanQuery, esQuery map[string]interface{}, highlight *elastic.Highlight, scored bool) ([]SearchHit, error) {
+	if q.filtered() {
+		filter := make([]map[string]interface{}, 0, len(q.Filters)+1)
+		for field, values := range q.Filters {
+			filter = append(filter, map[string]interface{}{
+				"terms": map[string]interface{}{field + ".keyword": values},
+			})
+		}
+		if q.ReleasedFrom != nil || q.ReleasedBefore != nil {
+			bounds := map[string]interface{}{}
+			if q.ReleasedFrom != nil {
+				bounds["gte"] = q.ReleasedFrom.Format(esTimeFormat)
+			}
+			if q.ReleasedBefore != nil {
+				bounds["lt"] = q.ReleasedBefore.Format(esTimeFormat)
+			}
+			filter = append(filter, map[string]interface{}{
+				"range": map[string]interface{}{"released_at": bounds},
+			})
+		}
+		esQuery = map[string]interface{}{
+			"bool": map[string]interface{}{
+				"must":   esQuery,
+				"filter": filter,
+			},
+		}
+	}
+
+	queryJson, err := json.Marshal(esQuery)
+	if err != nil {
+		return nil, err
+	}
+
+	body := map[string]interface{}{
+		"query": json.RawMessage(queryJson),
+		"from":  q.From,
+		"size":  q.Size,
+	}
+	if highlight != nil {
+		source, err := highlight.Source()
+		if err != nil {
+			return nil, err
+		}
+		body["highlight"] = source
+	}
+	result, err := rawSearch(ctx, s.client, s.index, body)
+	if err != nil {
+		return nil, err
+	}
+
+	hits := make([]SearchHit, 0, len(result.Hits.Hits))
+	for _, hit := range result.Hits.Hits {
+		h := SearchHit{ID: hit.ID, Source: hit.Source, Highlight: hit.Highlight}
+		if scored && hit.Score != nil {
+			h.Score = *hit.Score
+		}
+		hits = append(hits, h)
+	}
+	return hits, nil
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// exportBatchSize is how many books a store reads at a time while
+// exporting; with content a book can run to megabytes.
+const exportBatchSize = 50
+
+// esTimeFormat is RFC 3339 with the millisecond precision of date fields.
+const esTimeFormat = "2006-01-02T15:04:05.000Z07:00"
+
+// ExportQuery selects the books streamed by GET /export and the fields
+// written for each.
+type ExportQuery struct {
+	Author string
+	// ReleasedFrom is inclusive, ReleasedBefore exclusive.
+	ReleasedFrom   *time.Time
+	ReleasedBefore *time.Time
+	// FromID and ToID bound numeric ebook IDs, inclusive; zero is
+	// unbounded. Books with other IDs are left out of a range.
+	FromID int64
+	ToID   int64
+	// Fields, if set, are the only top-level fields written, besides id;
+	// Exclude drops fields.
+	Fields  []string
+	Exclude []string
+}
+
+func (q ExportQuery) idRange() bool {
+	return q.FromID > 0 || q.ToID > 0
+}
+
+// exportDoc is the part of a stored book the filters look at.
+type exportDoc struct {
+	ID         string     `json:"id"`
+	Author     string     `json:"author"`
+	ReleasedAt *time.Time `json:"released_at"`
+}
+
+// match reports whether the stored book src passes the filters of q.
+func (q ExportQuery) match(src json.RawMessage) bool {
+	var doc exportDoc
+	if err := json.Unmarshal(src, &doc); err != nil {
+		return false
+	}
+	if q.Author != "" && doc.Author != q.Author {
+		return false
+	}
+	if !inRange(doc.ReleasedAt, q.ReleasedFrom, q.ReleasedBefore) {
+		return false
+	}
+	if q.idRange() {
+		n, err := strconv.ParseInt(doc.ID, 10, 64)
+		if err != nil || n < q.FromID || (q.ToID > 0 && n > q.ToID) {
+			return false
+		}
+	}
+	return true
+}
+
+// project keeps the fields of src selected by q.
+func (q ExportQuery) project(src json.RawMessage) (json.RawMessage, error) {
+	return projectFields(src, q.Fields, q.Exclude)
+}
+
+// projectFields keeps id and fields of the object src, or all of them if
+// fields is empty, and drops those in exclude.
+func projectFields(src json.RawMessage, fields, exclude []string) (json.RawMessage, error) {
+	if len(fields) == 0 && len(exclude) == 0 {
+		return src, nil
+	}
+	var doc map[string]json.RawMessage
+	if err := json.Unmarshal(src, &doc); err != nil {
+		return nil, err
+	}
+	if len(fields) > 0 {
+		keep := map[string]bool{"id": true}
+		for _, f := range fields {
+			keep[f] = true
+		}
+		for f := range doc {
+			if !keep[f] {
+				delete(doc, f)
+			}
+		}
+	}
+	for _, f := range exclude {
+		delete(doc, f)
+	}
+	return json.Marshal(doc)
+}
+
+// esQuery is the Elasticsearch query for the filters of q.
+func (q ExportQuery) esQuery() map[string]interface{} {
+	var filter []map[string]interface{}
+	if q.Author != "" {
+		filter = append(filter, map[string]interface{}{
+			"term": map[string]interface{}{"author.keyword": q.Author},
+		})
+	}
+	if q.ReleasedFrom != nil || q.ReleasedBefore != nil {
+		bounds := map[string]interface{}{}
+		if q.ReleasedFrom != nil {
+			bounds["gte"] = q.ReleasedFrom.Format(esTimeFormat)
+		}
+		if q.ReleasedBefore != nil {
+			bounds["lt"] = q.ReleasedBefore.Format(esTimeFormat)
+		}
+		filter = append(filter, map[string]interface{}{
+			"range": map[string]interface{}{"released_at": bounds},
+		})
+	}
+	if q.idRange() {
+		// IDs are keywords, which compare as strings; the range is numeric.
+		to := q.ToID
+		if to == 0 {
+			to = math.MaxInt64
+		}
+		filter = append(filter, map[string]interface{}{
+			"script": map[string]interface{}{
+				"script": map[string]interface{}{
+					"lang": "painless",
+					"source": `if (doc['id'].size() == 0) { return false; }
+String id = doc['id'].value;
+if (id.length() == 0 || id.length() > 18) { return false; }
+for (int i = 0; i < id.length(); i++) { if (!Character.isDigit(id.charAt(i))) { return false; } }
+long n = Long.parseLong(id);
+return n >= params.from && n <= params.to;`,
+					"params": map[string]interface{}{"from": q.FromID, "to": to},
+				},
+			},
+		})
+	}
+	if len(filter) == 0 {
+		return map[string]interface{}{"match_all": map[string]interface{}{}}
+	}
+	return map[string]interface{}{"bool": map[string]interface{}{"filter": filter}}
+}
+
+// esSource is the _source filter for the projection of q, or nil.
+func (q ExportQuery) esSource() map[string]interface{} {
+	if len(q.Fields) == 0 && len(q.Exclude) == 0 {
+		return nil
+	}
+	source := map[string]interface{}{}
+	if len(q.Fields) > 0 {
+		source["includes"] = append([]string{"id"}, q.Fields...)
+	}
+	if len(q.Exclude) > 0 {
+		source["excludes"] = q.Exclude
+	}
+	return source
+}
+
+// exportDocs is Export for stores that hold every document by ID: the IDs
+// are visited in numeric order and each book is read on its own.
+func exportDocs(ctx context.Context, ids []string, get func(string) (json.RawMessage, error), q ExportQuery, fn func(json.RawMessage) error) error {
+	sortIDs(ids)
+	for _, id := range ids {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		src, err := get(id)
+		if err == ErrNotFound {
+			// Deleted since the IDs were listed.
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if !q.match(src) {
+			continue
+		}
+		if src, err = q.project(src); err != nil {
+			return err
+		}
+		if err := fn(src); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sortIDs orders numeric IDs by value, before any others.
+func sortIDs(ids []string) {
+	sort.Slice(ids, func(i, j int) bool {
+		a, aerr := strconv.ParseInt(ids[i], 10, 64)
+		b, berr := strconv.ParseInt(ids[j], 10, 64)
+		switch {
+		case aerr == nil && berr == nil:
+			return a < b
+		case aerr == nil || berr == nil:
+			return aerr == nil
+		}
+		return ids[i] < ids[j]
+	})
+}
+
+func parseExportQuery(c *gin.Context) (ExportQuery, error) {
+	q := ExportQuery{Author: c.Query("author")}
+	var err error
+	if q.ReleasedFrom, q.ReleasedBefore, err = parseDateRange(c, "from_date", "to_date"); err != nil {
+		return q, err
+	}
+	for name, bound := range map[string]*int64{"from_id": &q.FromID, "to_id": &q.ToID} {
+		if v := c.Query(name); v != "" {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || n < 1 {
+				return q, fmt.Errorf("%s must be a positive ebook number", name)
+			}
+			*bound = n
+		}
+	}
+	if q.ToID > 0 && q.FromID > q.ToID {
+		return q, errors.New("from_id is after to_id")
+	}
+	q.Fields = splitList(c.Query("fields"))
+	q.Exclude = splitList(c.Query("exclude"))
+	return q, nil
+}
+
+func splitList(v string) []string {
+	var items []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// exportEndpoint streams the selected books as NDJSON, one book per line,
+// as the store reads them. Once the first line is out the status cannot
+// change, so the number of books written and any error that cut the
+// export short are sent as the X-Export-Count and X-Export-Error trailers.
+func exportEndpoint(c *gin.Context) {
+	q, err := parseExportQuery(c)
+	if err != nil {
+		errorResponse(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	started, count := false, 0
+	start := func() {
+		started = true
+		c.Header("Content-Type", "application/x-ndjson")
+		c.Header("Trailer", "X-Export-Count, X-Export-Error")
+		c.Status(http.StatusOK)
+		c.Writer.WriteHeaderNow()
+	}
+	var line bytes.Buffer
+	err = bookStore.Export(c, q, func(src json.RawMessage) error {
+		line.Reset()
+		if err := json.Compact(&line, src); err != nil {
+			return err
+		}
+		line.WriteByte('\n')
+		if !started {
+			start()
+		}
+		if _, err := c.Writer.Write(line.Bytes()); err != nil {
+			return err
+		}
+		c.Writer.Flush()
+		count++
+		return nil
+	})
+	if err != nil && !started {
+		log.Println(err)
+		errorResponse(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if !started {
+		start()
+	}
+	c.Writer.Header().Set("X-Export-Count", strconv.Itoa(count))
+	if err != nil {
+		log.Printf("export: stopped after %d books: %v", count, err)
+		c.Writer.Header().Set("X-Export-Error", err.Error())
+	}
+}
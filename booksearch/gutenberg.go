@@ -0,0 +1,266 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"strings"
+)
+
+// EbookHeader is the metadata block at the top of a Project Gutenberg
+// text. Dates are kept as written.
+type EbookHeader struct {
+	Title       string `json:"title"`
+	Author      string `json:"author,omitempty"`
+	Translator  string `json:"translator,omitempty"`
+	Editor      string `json:"editor,omitempty"`
+	Illustrator string `json:"illustrator,omitempty"`
+	Language    string `json:"language,omitempty"`
+	ReleaseDate string `json:"release_date,omitempty"`
+	PostingDate string `json:"posting_date,omitempty"`
+	LastUpdated string `json:"last_updated,omitempty"`
+	EbookNumber string `json:"ebook_number,omitempty"`
+	Encoding    string `json:"encoding,omitempty"`
+}
+
+// ParsedEbook is a Gutenberg text split into its header and the body of
+// the book, without the license, trailer and producer credits.
+type ParsedEbook struct {
+	Header EbookHeader `json:"header"`
+	Body   string      `json:"body"`
+}
+
+var (
+	headerFieldRe = regexp.MustCompile(`(?i)^\s*(title|author|authors|translator|translated by|editor|edited by|illustrator|illustrated by|language|release date|posting date|first posted|date first posted|last updated|most recently updated|character set encoding|credits|original publication)\s*:\s*(.*)$`)
+	ebookNumberRe = regexp.MustCompile(`(?i)\[\s*(?:e-?book|e-?text)\s*(?:no\.?|#)\s*(\d+)\s*\]`)
+	lastUpdatedRe = regexp.MustCompile(`(?i)\[\s*(?:last|most recently) updated:?\s*([^\]]*)\]`)
+	// The oldest texts have no "Title:" line, only a banner such as
+	// "The Project Gutenberg Etext of Hamlet, by William Shakespeare".
+	bannerRe = regexp.MustCompile(`(?i)project gutenberg(?:'s)?\s+(?:e-?book|e-?text|etext)\s+of\s+(.+?)(?:,\s+by\s+(.+?))?\s*\**\s*$`)
+	startRe  = regexp.MustCompile(`(?i)^\s*\*{3}\s*START\b|^\s*\*END\*\s*THE SMALL PRINT`)
+	endRe    = regexp.MustCompile(`(?i)^\s*\*{3}\s*END\b|^\s*END OF (?:THE|THIS) PROJECT GUTENBERG|^\s*End of (?:the |this )?Project Gutenberg|^\s*End of Project Gutenberg's`)
+	creditRe = regexp.MustCompile(`(?i)^\s*(?:produced by|e-?text prepared by|this e-?(?:text|book) was (?:prepared|produced|created) by|prepared by|transcribed (?:by|from)|scanned by|html version by|updated editions will replace)|distributed\s+proofread|pgdp\.net`)
+)
+
+// headerScanLines is how far into a file without a START marker the
+// header fields are looked for.
+const headerScanLines = 100
+
+// parseEbook splits a Gutenberg text into header and body. Header fields
+// are only read above the START marker, so body lines such as "Title:"
+// in a play cannot be mistaken for metadata.
+func parseEbook(text string) ParsedEbook {
+	lines := strings.Split(strings.Replace(text, "\r\n", "\n", -1), "\n")
+
+	start, end := -1, len(lines)
+	for i, line := range lines {
+		if endRe.MatchString(line) && start >= 0 {
+			end = i
+			break
+		}
+		if startRe.MatchString(line) {
+			start = i
+		}
+	}
+
+	headerEnd := start
+	if start < 0 {
+		headerEnd = headerScanLines
+		if headerEnd > len(lines) {
+			headerEnd = len(lines)
+		}
+	}
+	header, last := parseHeader(lines[:headerEnd])
+
+	bodyStart := start + 1
+	if start < 0 {
+		// No marker: the body starts after the last header field, if
+		// any was found.
+		bodyStart = last + 1
+		for i := bodyStart; i < len(lines); i++ {
+			if endRe.MatchString(lines[i]) {
+				end = i
+				break
+			}
+		}
+	}
+	if bodyStart > end {
+		bodyStart = end
+	}
+	body := stripCredits(lines[bodyStart:end])
+	for i, line := range body {
+		body[i] = strings.TrimRight(line, " \t")
+	}
+	return ParsedEbook{Header: header, Body: strings.Join(body, "\n")}
+}
+
+// parseHeader reads the header fields from lines and returns them with the
+// index of the last line that belonged to one (-1 if none did).
+func parseHeader(lines []string) (EbookHeader, int) {
+	var h EbookHeader
+	last := -1
+	var current *string
+	sep := " "
+	for i, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		if m := ebookNumberRe.FindStringSubmatch(line); m != nil && h.EbookNumber == "" {
+			h.EbookNumber = m[1]
+		}
+		if m := lastUpdatedRe.FindStringSubmatch(line); m != nil && h.LastUpdated == "" {
+			h.LastUpdated = strings.TrimSpace(m[1])
+		}
+		if trimmed == "" {
+			current = nil
+			continue
+		}
+		m := headerFieldRe.FindStringSubmatch(line)
+		if m == nil {
+			// A non-blank line right below a field continues it, as in
+			// "Title: Frankenstein\n       or The Modern Prometheus".
+			if current != nil && !strings.HasPrefix(trimmed, "[") && !strings.HasPrefix(trimmed, "***") {
+				*current = joinHeaderValue(*current, cleanHeaderValue(trimmed), sep)
+				last = i
+			}
+			continue
+		}
+		value := cleanHeaderValue(m[2])
+		current, sep = nil, " "
+		switch strings.ToLower(m[1]) {
+		case "title":
+			current = &h.Title
+		case "author", "authors":
+			current, sep = &h.Author, "; "
+		case "translator", "translated by":
+			current, sep = &h.Translator, "; "
+		case "editor", "edited by":
+			current, sep = &h.Editor, "; "
+		case "illustrator", "illustrated by":
+			current, sep = &h.Illustrator, "; "
+		case "language":
+			h.Language = value
+		case "release date":
+			h.ReleaseDate = value
+		case "posting date":
+			h.PostingDate = value
+		case "first posted", "date first posted":
+			if h.PostingDate == "" {
+				h.PostingDate = value
+			}
+		case "last updated", "most recently updated":
+			h.LastUpdated = value
+		case "character set encoding":
+			h.Encoding = value
+		}
+		if current != nil && *current == "" {
+			*current = value
+		} else if current != nil {
+			// A repeated field, e.g. a second "Author:" line.
+			*current = joinHeaderValue(*current, value, "; ")
+		}
+		last = i
+	}
+
+	if h.Title == "" {
+		for i, line := range lines {
+			m := bannerRe.FindStringSubmatch(line)
+			if m == nil {
+				continue
+			}
+			h.Title = strings.TrimSpace(m[1])
+			if h.Author == "" {
+				h.Author = strings.TrimSpace(m[2])
+			}
+			if next := i + 1; h.Author == "" && next < len(lines) {
+				if by := strings.TrimSpace(lines[next]); strings.HasPrefix(strings.ToLower(by), "by ") {
+					h.Author = strings.TrimSpace(by[3:])
+				}
+			}
+			break
+		}
+	}
+	return h, last
+}
+
+// cleanHeaderValue drops the bracketed ebook number and update notes that
+// share a line with a field.
+func cleanHeaderValue(v string) string {
+	v = ebookNumberRe.ReplaceAllString(v, "")
+	v = lastUpdatedRe.ReplaceAllString(v, "")
+	return strings.TrimSpace(v)
+}
+
+func joinHeaderValue(a, b, sep string) string {
+	if b == "" {
+		return a
+	}
+	if a == "" {
+		return b
+	}
+	return a + sep + b
+}
+
+// stripCredits trims blank lines from both ends of the body and drops the
+// producer credit paragraphs that open or close it.
+func stripCredits(lines []string) []string {
+	for {
+		lines = trimBlankLines(lines)
+		n := paragraphEnd(lines, 0)
+		if n == 0 || !isCredit(lines[:n]) {
+			break
+		}
+		lines = lines[n:]
+	}
+	for {
+		lines = trimBlankLines(lines)
+		i := len(lines)
+		for i > 0 && strings.TrimSpace(lines[i-1]) != "" {
+			i--
+		}
+		if i == len(lines) || !isCredit(lines[i:]) {
+			break
+		}
+		lines = lines[:i]
+	}
+	return lines
+}
+
+// isCredit reports whether a paragraph is a producer credit. Long
+// paragraphs are never treated as one, whatever they mention.
+func isCredit(paragraph []string) bool {
+	return len(paragraph) <= 6 && creditRe.MatchString(strings.Join(paragraph, " "))
+}
+
+func paragraphEnd(lines []string, i int) int {
+	for i < len(lines) && strings.TrimSpace(lines[i]) != "" {
+		i++
+	}
+	return i
+}
+
+func trimBlankLines(lines []string) []string {
+	for len(lines) > 0 && strings.TrimSpace(lines[0]) == "" {
+		lines = lines[1:]
+	}
+	for len(lines) > 0 && strings.TrimSpace(lines[len(lines)-1]) == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// printParsedEbook writes the parse of the text file at path as indented
+// JSON. The fixtures under testdata/gutenberg hold the expected output for
+// each header variant.
+func printParsedEbook(w io.Writer, path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	text, _ := decodeText(data)
+	out, err := json.MarshalIndent(parseEbook(text), "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(out, '\n'))
+	return err
+}
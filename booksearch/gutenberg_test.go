@@ -0,0 +1,46 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var updateGolden = flag.Bool("update", false, "rewrite the golden files under testdata from the current output")
+
+// TestParseEbookGolden parses every testdata/gutenberg/*.txt and compares
+// the result with the .json file next to it, as -parse would print it.
+func TestParseEbookGolden(t *testing.T) {
+	texts, err := filepath.Glob(filepath.Join("testdata", "gutenberg", "*.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(texts) == 0 {
+		t.Fatal("no fixtures under testdata/gutenberg")
+	}
+	for _, text := range texts {
+		golden := strings.TrimSuffix(text, ".txt") + ".json"
+		t.Run(filepath.Base(text), func(t *testing.T) {
+			var got bytes.Buffer
+			if err := printParsedEbook(&got, text); err != nil {
+				t.Fatal(err)
+			}
+			if *updateGolden {
+				if err := ioutil.WriteFile(golden, got.Bytes(), 0644); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			want, err := ioutil.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got.Bytes(), want) {
+				t.Errorf("parse of %s differs from %s:\ngot:\n%s\nwant:\n%s", text, golden, got.Bytes(), want)
+			}
+		})
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	idempotencyHeader = "Idempotency-Key"
+	// idempotencyTTL is how long a key and its response are remembered.
+	idempotencyTTL    = 24 * time.Hour
+	maxIdempotencyKey = 255
+)
+
+// idempotentResponse is what a request with an Idempotency-Key answered,
+// kept so a retry gets the same answer without running again.
+type idempotentResponse struct {
+	fingerprint [sha256.Size]byte
+	done        bool
+	status      int
+	header      http.Header
+	body        []byte
+	at          time.Time
+}
+
+var (
+	idempotencyMu    sync.Mutex
+	idempotencyKeys  = map[string]*idempotentResponse{}
+	idempotencySwept time.Time
+)
+
+// idempotent makes a handler safe to retry: the first request with a given
+// Idempotency-Key runs, and later ones with the same key and body get its
+// response replayed, marked Idempotent-Replayed. The same key with another
+// body is a 422, and a retry while the first request still runs a 409.
+// Responses are kept in memory for idempotencyTTL; 5xx responses are not
+// kept, so the request can be retried.
+func idempotent(c *gin.Context) {
+	key := c.GetHeader(idempotencyHeader)
+	if key == "" {
+		c.Next()
+		return
+	}
+	if len(key) > maxIdempotencyKey {
+		apiError(c, http.StatusBadRequest, codeValidation, "Idempotency-Key is longer than 255 characters", nil)
+		return
+	}
+	body, err := ioutil.ReadAll(c.Request.Body)
+	if err != nil {
+		apiError(c, http.StatusBadRequest, codeInvalidJSON, "Unreadable request body", err.Error())
+		return
+	}
+	c.Request.Body = ioutil.NopCloser(bytes.NewReader(body))
+	fingerprint := sha256.Sum256(append([]byte(c.Request.Method+" "+c.Request.URL.Path+"\n"), body...))
+	scope := c.Request.Method + " " + c.FullPath() + " " + key
+
+	idempotencyMu.Lock()
+	sweepIdempotencyKeys()
+	prev, ok := idempotencyKeys[scope]
+	if !ok {
+		idempotencyKeys[scope] = &idempotentResponse{fingerprint: fingerprint, at: time.Now()}
+	}
+	var replay idempotentResponse
+	if ok {
+		replay = *prev
+	}
+	idempotencyMu.Unlock()
+
+	if ok {
+		switch {
+		case replay.fingerprint != fingerprint:
+			apiError(c, http.StatusUnprocessableEntity, codeValidation, "Idempotency-Key was already used with another request", nil)
+		case !replay.done:
+			apiError(c, http.StatusConflict, codeConflict, "A request with this Idempotency-Key is still in progress", nil)
+		default:
+			for name, values := range replay.header {
+				c.Writer.Header()[name] = values
+			}
+			c.Header("Idempotent-Replayed", "true")
+			c.Data(replay.status, replay.header.Get("Content-Type"), replay.body)
+			c.Abort()
+		}
+		return
+	}
+
+	rec := &recordingWriter{ResponseWriter: c.Writer}
+	c.Writer = rec
+	kept := false
+	defer func() {
+		// Also reached when the handler panics.
+		if !kept {
+			idempotencyMu.Lock()
+			delete(idempotencyKeys, scope)
+			idempotencyMu.Unlock()
+		}
+	}()
+	c.Next()
+	if rec.Status() >= 500 {
+		return
+	}
+
+	idempotencyMu.Lock()
+	defer idempotencyMu.Unlock()
+	header := http.Header{}
+	for _, name := range []string{"Content-Type", "Location"} {
+		if v := rec.Header().Get(name); v != "" {
+			header.Set(name, v)
+		}
+	}
+	idempotencyKeys[scope] = &idempotentResponse{
+		fingerprint: fingerprint,
+		done:        true,
+		status:      rec.Status(),
+		header:      header,
+		body:        rec.body.Bytes(),
+		at:          time.Now(),
+	}
+	kept = true
+}
+
+// sweepIdempotencyKeys drops expired keys, at most once a minute. The
+// caller holds idempotencyMu.
+func sweepIdempotencyKeys() {
+	if time.Since(idempotencySwept) < time.Minute {
+		return
+	}
+	idempotencySwept = time.Now()
+	for scope, r := range idempotencyKeys {
+		if r.done && time.Since(r.at) > idempotencyTTL {
+			delete(idempotencyKeys, scope)
+		}
+	}
+}
+
+// recordingWriter keeps a copy of the response body.
+type recordingWriter struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *recordingWriter) Write(b []byte) (int, error) {
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *recordingWriter) WriteString(s string) (int, error) {
+	w.body.WriteString(s)
+	return w.ResponseWriter.WriteString(s)
+}
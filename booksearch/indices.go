@@ -0,0 +1,651 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/olivere/elastic"
+)
+
+// IndexDefinition describes a versioned Elasticsearch index. Version n
+// lives in the index <alias>_v<n>; readers and writers only ever use the
+// alias, so a new version can be built and swapped in while the old one
+// serves traffic.
+type IndexDefinition struct {
+	Alias    string
+	Version  int
+	Settings map[string]interface{}
+	Mappings map[string]interface{}
+	// Analyzed is the first version whose text fields carry the english
+	// and shingles subfields searchAnalyzed relies on.
+	Analyzed int
+}
+
+func (d IndexDefinition) indexName(version int) string {
+	return d.Alias + "_v" + strconv.Itoa(version)
+}
+
+// indexVersion reads the version back from an index name, 0 for an index
+// that predates versioning.
+func (d IndexDefinition) indexVersion(name string) int {
+	v, err := strconv.Atoi(strings.TrimPrefix(name, d.Alias+"_v"))
+	if err != nil {
+		return 0
+	}
+	return v
+}
+
+// body is the create index request for d, with the mappings keyed by
+// type on clusters that still have types.
+func (d IndexDefinition) body() map[string]interface{} {
+	if !elasticCluster.Typeless {
+		return map[string]interface{}{
+			"settings": d.Settings,
+			"mappings": map[string]interface{}{elasticTypeName: d.Mappings},
+		}
+	}
+	settings := make(map[string]interface{}, len(d.Settings)+1)
+	for k, v := range d.Settings {
+		settings[k] = v
+	}
+	settings["highlight.max_analyzed_offset"] = maxAnalyzedOffset
+	return map[string]interface{}{"settings": settings, "mappings": d.Mappings}
+}
+
+func textWithKeyword() map[string]interface{} {
+	return map[string]interface{}{
+		"type": "text",
+		"fields": map[string]interface{}{
+			"keyword": map[string]interface{}{"type": "keyword", "ignore_above": 256},
+		},
+	}
+}
+
+// analysisSettings defines the analyzers of the text fields: folded for
+// the field itself, english (possessives, stop words and stemming) and
+// shingled word pairs and triples for phrase proximity without span
+// queries.
+var analysisSettings = map[string]interface{}{
+	"filter": map[string]interface{}{
+		"english_possessive": map[string]interface{}{"type": "stemmer", "language": "possessive_english"},
+		"english_stop":       map[string]interface{}{"type": "stop", "stopwords": "_english_"},
+		"english_stemmer":    map[string]interface{}{"type": "stemmer", "language": "english"},
+		"word_shingles": map[string]interface{}{
+			"type":             "shingle",
+			"min_shingle_size": 2,
+			"max_shingle_size": 3,
+			"output_unigrams":  false,
+		},
+	},
+	"analyzer": map[string]interface{}{
+		"folded": map[string]interface{}{
+			"tokenizer": "standard",
+			"filter":    []string{"lowercase", "asciifolding"},
+		},
+		"english_stemmed": map[string]interface{}{
+			"tokenizer": "standard",
+			"filter":    []string{"english_possessive", "lowercase", "asciifolding", "english_stop", "english_stemmer"},
+		},
+		"shingled": map[string]interface{}{
+			"tokenizer": "standard",
+			"filter":    []string{"lowercase", "asciifolding", "word_shingles"},
+		},
+	},
+}
+
+// analyzedText maps a text field searched by searchAnalyzed. Term vectors
+// with offsets let the fast vector highlighter work without re-analyzing
+// the text.
+func analyzedText(keyword bool) map[string]interface{} {
+	fields := map[string]interface{}{
+		"english": map[string]interface{}{
+			"type":        "text",
+			"analyzer":    "english_stemmed",
+			"term_vector": "with_positions_offsets",
+		},
+		"shingles": map[string]interface{}{
+			"type":        "text",
+			"analyzer":    "shingled",
+			"term_vector": "with_positions_offsets",
+		},
+	}
+	if keyword {
+		fields["keyword"] = map[string]interface{}{"type": "keyword", "ignore_above": 256}
+	}
+	return map[string]interface{}{
+		"type":        "text",
+		"analyzer":    "folded",
+		"term_vector": "with_positions_offsets",
+		"fields":      fields,
+	}
+}
+
+// analyzedFields are the fields mapped with analyzedText.
+var analyzedFields = map[string]bool{"title": true, "author": true, "content": true, "text": true}
+
+func fieldType(t string) map[string]interface{} {
+	return map[string]interface{}{"type": t}
+}
+
+func personMapping() map[string]interface{} {
+	return map[string]interface{}{
+		"properties": map[string]interface{}{
+			"name":       textWithKeyword(),
+			"birth_year": fieldType("integer"),
+			"death_year": fieldType("integer"),
+		},
+	}
+}
+
+// storedOnly maps an object kept in _source without being indexed.
+var storedOnly = map[string]interface{}{"type": "object", "enabled": false}
+
+// booksIndex is the mapping of the book documents. Dynamic mapping is off:
+// a field that is not listed here is kept in _source but not searchable.
+// Fields filtered on by catalogFilters need a keyword subfield.
+var booksIndex = IndexDefinition{
+	Alias:    elasticIndexName,
+	Version:  4,
+	Analyzed: 4,
+	Settings: map[string]interface{}{
+		"number_of_shards":   1,
+		"number_of_replicas": 0,
+		"analysis":           analysisSettings,
+	},
+	Mappings: map[string]interface{}{
+		"dynamic": false,
+		"properties": map[string]interface{}{
+			"id":                fieldType("keyword"),
+			"title":             analyzedText(true),
+			"author":            analyzedText(true),
+			"created_at":        fieldType("date"),
+			"released_at":       fieldType("date"),
+			"release_precision": fieldType("keyword"),
+			"release_date_raw":  fieldType("keyword"),
+			"content":           analyzedText(false),
+			"paragraphs":        storedOnly,
+			"chapters":          storedOnly,
+			"form":              fieldType("keyword"),
+			"footnotes": map[string]interface{}{
+				"properties": map[string]interface{}{
+					"label": fieldType("keyword"),
+					"text":  fieldType("text"),
+				},
+			},
+			"encoding":     fieldType("keyword"),
+			"translator":   textWithKeyword(),
+			"editor":       textWithKeyword(),
+			"illustrator":  textWithKeyword(),
+			"language":     fieldType("keyword"),
+			"posting_date": fieldType("keyword"),
+			"last_updated": fieldType("keyword"),
+			"ebook_number": fieldType("keyword"),
+			"subjects":     textWithKeyword(),
+			"bookshelves":  textWithKeyword(),
+			"languages":    textWithKeyword(),
+			"locc":         textWithKeyword(),
+			"authors":      personMapping(),
+			"translators":  personMapping(),
+			"editors":      personMapping(),
+			"downloads":    fieldType("integer"),
+			"formats":      textWithKeyword(),
+		},
+	},
+}
+
+var sentencesIndex = IndexDefinition{
+	Alias:    elasticSentenceIndexName,
+	Version:  2,
+	Analyzed: 2,
+	Settings: map[string]interface{}{
+		"number_of_shards":   1,
+		"number_of_replicas": 0,
+		"analysis":           analysisSettings,
+	},
+	Mappings: map[string]interface{}{
+		"dynamic": false,
+		"properties": map[string]interface{}{
+			"book_id":   textWithKeyword(),
+			"ordinal":   fieldType("integer"),
+			"paragraph": fieldType("integer"),
+			"chapter":   fieldType("integer"),
+			"start":     fieldType("integer"),
+			"end":       fieldType("integer"),
+			"text":      analyzedText(false),
+			"structure": storedOnly,
+		},
+	},
+}
+
+// indexDefinitions are the versioned indices, by alias.
+var indexDefinitions = map[string]IndexDefinition{
+	booksIndex.Alias:     booksIndex,
+	sentencesIndex.Alias: sentencesIndex,
+}
+
+var (
+	servedMu       sync.RWMutex
+	servedVersions = map[string]int{}
+)
+
+func setServedVersion(alias string, version int) {
+	servedMu.Lock()
+	defer servedMu.Unlock()
+	servedVersions[alias] = version
+}
+
+// analyzedIndex reports whether the index an alias points at has the
+// analyzed subfields, which indices built before them lack until they are
+// reindexed.
+func analyzedIndex(alias string) bool {
+	d, ok := indexDefinitions[alias]
+	if !ok || d.Analyzed == 0 {
+		return false
+	}
+	servedMu.RLock()
+	defer servedMu.RUnlock()
+	return servedVersions[alias] >= d.Analyzed
+}
+
+// analyzedSearch reports whether a search of field through alias runs
+// against the analyzed subfields, whose hits come ranked.
+func analyzedSearch(alias, field string) bool {
+	return analyzedIndex(alias) && analyzedFields[field]
+}
+
+// ensureIndex makes sure the alias of d points at an index. A fresh
+// cluster gets version d.Version; an index created before versioning,
+// under the alias name itself, is migrated into it. An alias that already
+// exists is left alone, whatever version it points at.
+func ensureIndex(ctx context.Context, client *elastic.Client, d IndexDefinition) error {
+	current, err := aliasTarget(ctx, client, d.Alias)
+	if err != nil {
+		return err
+	}
+	if current != "" {
+		v := d.indexVersion(current)
+		if v < d.Version {
+			log.Printf("indices: %s is served by %s; reindex to move to version %d", d.Alias, current, d.Version)
+		}
+		setServedVersion(d.Alias, v)
+		return nil
+	}
+
+	legacy, err := client.IndexExists(d.Alias).Do(ctx)
+	if err != nil {
+		return err
+	}
+	if legacy {
+		log.Printf("indices: migrating unversioned index %s to %s", d.Alias, d.indexName(d.Version))
+		_, err := reindexInto(ctx, client, d, d.Alias, d.Version, true)
+		return err
+	}
+
+	name := d.indexName(d.Version)
+	exists, err := client.IndexExists(name).Do(ctx)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		if _, err := client.CreateIndex(name).BodyJson(d.body()).Do(ctx); err != nil {
+			return fmt.Errorf("create index %s: %v", name, err)
+		}
+	}
+	if _, err = client.Alias().Add(name, d.Alias).Do(ctx); err != nil {
+		return err
+	}
+	setServedVersion(d.Alias, d.Version)
+	return nil
+}
+
+// aliasTarget returns the index an alias points at, or "" if there is no
+// such alias.
+func aliasTarget(ctx context.Context, client *elastic.Client, alias string) (string, error) {
+	res, err := client.Aliases().Alias(alias).Do(ctx)
+	if elastic.IsNotFound(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	indices := res.IndicesByAlias(alias)
+	switch len(indices) {
+	case 0:
+		return "", nil
+	case 1:
+		return indices[0], nil
+	}
+	sort.Strings(indices)
+	return "", fmt.Errorf("alias %s points at several indices: %s", alias, strings.Join(indices, ", "))
+}
+
+// Reindex reports an admin reindex of one alias.
+type Reindex struct {
+	Alias      string     `json:"alias"`
+	Running    bool       `json:"running"`
+	From       string     `json:"from,omitempty"`
+	To         string     `json:"to,omitempty"`
+	SourceDocs int64      `json:"source_docs"`
+	TargetDocs int64      `json:"target_docs"`
+	Swapped    bool       `json:"swapped"`
+	StartedAt  *time.Time `json:"started_at,omitempty"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+	LastError  string     `json:"last_error,omitempty"`
+}
+
+var (
+	reindexMu sync.Mutex
+	reindexes = map[string]*Reindex{}
+)
+
+// writeGate lets the writes to an alias through while reindexInto copies
+// it, and remembers which documents they touched: a document written to
+// the source after the copy began would otherwise not reach the new index
+// and be lost at the swap. reindexInto takes the lock for a short catch-up
+// of those documents at the end.
+type writeGate struct {
+	sync.RWMutex
+	// keyQuery matches the source documents of the keys writes report.
+	keyQuery func(keys []string) elastic.Query
+
+	mu    sync.Mutex
+	dirty map[string]bool // nil unless a reindex is copying
+}
+
+var writeGates = map[string]*writeGate{
+	elasticIndexName: {keyQuery: func(keys []string) elastic.Query {
+		return elastic.NewIdsQuery().Ids(keys...)
+	}},
+	elasticSentenceIndexName: {keyQuery: func(keys []string) elastic.Query {
+		values := make([]interface{}, len(keys))
+		for i, k := range keys {
+			values[i] = k
+		}
+		return elastic.NewTermsQuery("book_id.keyword", values...)
+	}},
+}
+
+// holdWrites keeps a reindex of alias from finishing until the returned
+// func is called, and has it copy the documents of keys again before it
+// does: book IDs for both aliases.
+func holdWrites(alias string, keys ...string) func() {
+	gate, ok := writeGates[alias]
+	if !ok {
+		return func() {}
+	}
+	gate.RLock()
+	gate.mu.Lock()
+	if gate.dirty != nil {
+		for _, k := range keys {
+			gate.dirty[k] = true
+		}
+	}
+	gate.mu.Unlock()
+	return gate.RUnlock
+}
+
+// trackWrites starts or, with false, stops remembering the keys written to
+// alias, and returns the ones remembered so far.
+func (g *writeGate) trackWrites(on bool) []string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	keys := make([]string, 0, len(g.dirty))
+	for k := range g.dirty {
+		keys = append(keys, k)
+	}
+	g.dirty = nil
+	if on {
+		g.dirty = make(map[string]bool)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// catchUpBatch bounds the keys of one catch-up query.
+const catchUpBatch = 1000
+
+// catchUp copies the documents of keys from source into target again,
+// dropping the ones source no longer has.
+func catchUp(ctx context.Context, client *elastic.Client, gate *writeGate, source, target string, keys []string) error {
+	for len(keys) > 0 {
+		n := len(keys)
+		if n > catchUpBatch {
+			n = catchUpBatch
+		}
+		q := gate.keyQuery(keys[:n])
+		keys = keys[n:]
+		if _, err := client.DeleteByQuery(target).Query(q).ProceedOnVersionConflict().Refresh("true").Do(ctx); err != nil && !elastic.IsNotFound(err) {
+			return fmt.Errorf("catch up %s: %v", target, err)
+		}
+		res, err := client.Reindex().Source(elastic.NewReindexSource().Index(source).Query(q)).
+			DestinationIndex(target).WaitForCompletion(true).Refresh("true").Do(ctx)
+		if err != nil {
+			return fmt.Errorf("catch up %s from %s: %v", target, source, err)
+		}
+		if len(res.Failures) > 0 {
+			return fmt.Errorf("catch up %s from %s: %d documents failed", target, source, len(res.Failures))
+		}
+	}
+	return nil
+}
+
+// reindexInto builds version of d, copies source into it, and swaps the
+// alias over once the document counts agree. Writes to the alias go on
+// during the copy; the documents they touched are copied again at the
+// end, with writes held back only for that catch-up, the count check and
+// the swap. A source that is a legacy index named like the alias is
+// deleted in the same atomic step, since an alias cannot share its name;
+// otherwise the old index is kept, so the swap can be undone by hand.
+func reindexInto(ctx context.Context, client *elastic.Client, d IndexDefinition, source string, version int, legacy bool) (*Reindex, error) {
+	now := time.Now()
+	status := &Reindex{Alias: d.Alias, Running: true, From: source, To: d.indexName(version), StartedAt: &now}
+	reindexMu.Lock()
+	reindexes[d.Alias] = status
+	reindexMu.Unlock()
+
+	gate, gated := writeGates[d.Alias]
+	err := func() error {
+		if _, err := client.CreateIndex(status.To).BodyJson(d.body()).Do(ctx); err != nil {
+			return fmt.Errorf("create index %s: %v", status.To, err)
+		}
+		if gated {
+			// Under the lock, so no write is halfway through unnoticed.
+			gate.Lock()
+			gate.trackWrites(true)
+			gate.Unlock()
+			defer gate.trackWrites(false)
+		}
+		res, err := client.Reindex().SourceIndex(source).DestinationIndex(status.To).
+			WaitForCompletion(true).Refresh("true").Do(ctx)
+		if err != nil {
+			return fmt.Errorf("reindex %s into %s: %v", source, status.To, err)
+		}
+		if len(res.Failures) > 0 {
+			return fmt.Errorf("reindex %s into %s: %d documents failed", source, status.To, len(res.Failures))
+		}
+
+		if gated {
+			gate.Lock()
+			defer gate.Unlock()
+		}
+		if _, err := client.Refresh(source).Do(ctx); err != nil {
+			return err
+		}
+		if gated {
+			if err := catchUp(ctx, client, gate, source, status.To, gate.trackWrites(true)); err != nil {
+				return err
+			}
+		}
+		sourceDocs, err := client.Count(source).Do(ctx)
+		if err != nil {
+			return err
+		}
+		targetDocs, err := client.Count(status.To).Do(ctx)
+		if err != nil {
+			return err
+		}
+		setReindex(d.Alias, func(r *Reindex) { r.SourceDocs, r.TargetDocs = sourceDocs, targetDocs })
+		if sourceDocs != targetDocs {
+			return fmt.Errorf("document counts differ: %s has %d, %s has %d", source, sourceDocs, status.To, targetDocs)
+		}
+
+		swap := client.Alias().Action(elastic.NewAliasAddAction(d.Alias).Index(status.To))
+		if legacy {
+			swap = swap.Action(elastic.NewAliasRemoveIndexAction(source))
+		} else {
+			swap = swap.Action(elastic.NewAliasRemoveAction(d.Alias).Index(source))
+		}
+		if _, err := swap.Do(ctx); err != nil {
+			return fmt.Errorf("swap alias %s: %v", d.Alias, err)
+		}
+		setReindex(d.Alias, func(r *Reindex) { r.Swapped = true })
+		setServedVersion(d.Alias, version)
+		return nil
+	}()
+
+	if err != nil && !status.Swapped {
+		// Leave nothing half built behind; the alias still points at the
+		// source.
+		if _, derr := client.DeleteIndex(status.To).Do(context.Background()); derr != nil && !elastic.IsNotFound(derr) {
+			log.Println(derr)
+		}
+	}
+	setReindex(d.Alias, func(r *Reindex) {
+		done := time.Now()
+		r.Running = false
+		r.FinishedAt = &done
+		if err != nil {
+			r.LastError = err.Error()
+		}
+	})
+	if err == nil {
+		log.Printf("indices: %s now points at %s (%d documents)", d.Alias, status.To, status.TargetDocs)
+	}
+	return reindexStatus(d.Alias), err
+}
+
+func setReindex(alias string, f func(*Reindex)) {
+	reindexMu.Lock()
+	defer reindexMu.Unlock()
+	f(reindexes[alias])
+}
+
+func reindexStatus(alias string) *Reindex {
+	reindexMu.Lock()
+	defer reindexMu.Unlock()
+	r, ok := reindexes[alias]
+	if !ok {
+		return nil
+	}
+	snapshot := *r
+	return &snapshot
+}
+
+var errReindexRunning = errors.New("a reindex of this alias is already running")
+
+// startReindex builds the next version of an alias from its current
+// definition in the background. Writes, the crawl's included, go on
+// meanwhile; see reindexInto.
+func startReindex(d IndexDefinition) (string, error) {
+	ctx := context.Background()
+	current, err := aliasTarget(ctx, elasticClient, d.Alias)
+	if err != nil {
+		return "", err
+	}
+	if current == "" {
+		return "", fmt.Errorf("alias %s does not exist", d.Alias)
+	}
+	version := d.indexVersion(current) + 1
+	if version < d.Version {
+		version = d.Version
+	}
+
+	reindexMu.Lock()
+	if r, ok := reindexes[d.Alias]; ok && r.Running {
+		reindexMu.Unlock()
+		return "", errReindexRunning
+	}
+	reindexes[d.Alias] = &Reindex{Alias: d.Alias, Running: true, From: current, To: d.indexName(version)}
+	reindexMu.Unlock()
+
+	go func() {
+		if _, err := reindexInto(ctx, elasticClient, d, current, version, false); err != nil {
+			log.Println(err)
+		}
+	}()
+	return d.indexName(version), nil
+}
+
+// IndexStatus describes one versioned alias.
+type IndexStatus struct {
+	Alias       string   `json:"alias"`
+	Index       string   `json:"index"`
+	Version     int      `json:"version"`
+	Latest      int      `json:"latest_version"`
+	Docs        int64    `json:"docs"`
+	LastReindex *Reindex `json:"last_reindex,omitempty"`
+}
+
+func indicesEndpoint(c *gin.Context) {
+	if elasticClient == nil {
+		errorResponse(c, http.StatusNotImplemented, "Versioned indices need the elastic engine")
+		return
+	}
+	aliases := make([]string, 0, len(indexDefinitions))
+	for alias := range indexDefinitions {
+		aliases = append(aliases, alias)
+	}
+	sort.Strings(aliases)
+	statuses := make([]IndexStatus, 0, len(aliases))
+	for _, alias := range aliases {
+		d := indexDefinitions[alias]
+		current, err := aliasTarget(c, elasticClient, alias)
+		if err != nil {
+			log.Println(err)
+			errorResponse(c, http.StatusInternalServerError, err.Error())
+			return
+		}
+		s := IndexStatus{Alias: alias, Index: current, Version: d.indexVersion(current), Latest: d.Version, LastReindex: reindexStatus(alias)}
+		if current != "" {
+			if s.Docs, err = elasticClient.Count(current).Do(c); err != nil {
+				log.Println(err)
+			}
+		}
+		statuses = append(statuses, s)
+	}
+	c.JSON(http.StatusOK, gin.H{"cluster": elasticCluster, "indices": statuses})
+}
+
+// reindexEndpoint starts building the next version of an alias; progress
+// is reported by indicesEndpoint.
+func reindexEndpoint(c *gin.Context) {
+	if elasticClient == nil {
+		errorResponse(c, http.StatusNotImplemented, "Versioned indices need the elastic engine")
+		return
+	}
+	d, ok := indexDefinitions[c.Param("alias")]
+	if !ok {
+		errorResponse(c, http.StatusNotFound, "Unknown index alias")
+		return
+	}
+	target, err := startReindex(d)
+	if err == errReindexRunning {
+		errorResponse(c, http.StatusConflict, err.Error())
+		return
+	}
+	if err != nil {
+		log.Println(err)
+		errorResponse(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	c.JSON(http.StatusAccepted, gin.H{"alias": d.Alias, "to": target})
+}
@@ -0,0 +1,366 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const statusQueued = "queued"
+
+// LedgerEntry is the crawl state of one ebook.
+type LedgerEntry struct {
+	ID          string    `json:"id"`
+	Status      string    `json:"status"`
+	Error       string    `json:"error,omitempty"`
+	Attempts    int       `json:"attempts"`
+	LastAttempt time.Time `json:"last_attempt"`
+	ContentHash string    `json:"content_hash,omitempty"`
+}
+
+// ledgerLine is one line of the ledger journal: an entry, or a move of the
+// crawl cursor.
+type ledgerLine struct {
+	Entry  *LedgerEntry `json:"entry,omitempty"`
+	Cursor int          `json:"cursor,omitempty"`
+}
+
+// Ledger records the crawl status of every ebook ID in an append-only
+// journal. The journal is compacted into a snapshot when it is opened.
+type Ledger struct {
+	mu      sync.Mutex
+	path    string
+	f       *os.File
+	entries map[string]*LedgerEntry
+	cursor  int
+}
+
+// OpenLedger loads the journal at path. If it does not exist yet, the crawl
+// cursor is seeded from legacyCursorPath (the old data/startindex.txt).
+func OpenLedger(path, legacyCursorPath string) (*Ledger, error) {
+	l := &Ledger{
+		path:    path,
+		entries: make(map[string]*LedgerEntry),
+		cursor:  1,
+	}
+	err := l.load()
+	if os.IsNotExist(err) {
+		l.cursor = readLegacyCursor(legacyCursorPath)
+	} else if err != nil {
+		return nil, err
+	}
+	if err := l.compact(); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	l.f = f
+	return l, nil
+}
+
+func readLegacyCursor(path string) int {
+	f, err := os.Open(path)
+	if err != nil {
+		return 1
+	}
+	defer f.Close()
+	var n int
+	if _, err := fmt.Fscanf(f, "%d", &n); err != nil || n < 1 {
+		return 1
+	}
+	log.Printf("seeding crawl ledger cursor from %s: %d", path, n)
+	return n
+}
+
+// load replays the journal. A torn last line is ignored; the compaction
+// that follows drops it.
+func (l *Ledger) load() error {
+	f, err := os.Open(l.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	lines := 0
+	for {
+		data, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		lines++
+		var line ledgerLine
+		if err := json.Unmarshal(data, &line); err != nil {
+			log.Printf("%s: skipping bad line %d: %v", l.path, lines, err)
+			continue
+		}
+		if line.Entry != nil {
+			l.entries[line.Entry.ID] = line.Entry
+		}
+		if line.Cursor > 0 {
+			l.cursor = line.Cursor
+		}
+	}
+}
+
+// compact rewrites the journal as one line per entry plus the cursor.
+func (l *Ledger) compact() error {
+	tmp := l.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for _, id := range l.sortedIDs() {
+		if err := enc.Encode(ledgerLine{Entry: l.entries[id]}); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	enc.Encode(ledgerLine{Cursor: l.cursor})
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, l.path); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(l.path))
+}
+
+func (l *Ledger) append(lines ...ledgerLine) error {
+	var buf []byte
+	for _, line := range lines {
+		data, err := json.Marshal(line)
+		if err != nil {
+			return err
+		}
+		buf = append(buf, data...)
+		buf = append(buf, '\n')
+	}
+	if _, err := l.f.Write(buf); err != nil {
+		return err
+	}
+	return l.f.Sync()
+}
+
+// Record stores the outcome of a crawl attempt.
+func (l *Ledger) Record(r CrawlResult) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	e := LedgerEntry{ID: r.ID}
+	if old, ok := l.entries[r.ID]; ok {
+		e = *old
+	}
+	e.Status = r.Status
+	e.Error = ""
+	if r.Err != nil {
+		e.Error = r.Err.Error()
+	}
+	e.Attempts++
+	e.LastAttempt = time.Now().UTC()
+	if r.Book != nil {
+		sum := sha256.Sum256([]byte(r.Book.Content))
+		e.ContentHash = hex.EncodeToString(sum[:])
+	}
+	if err := l.append(ledgerLine{Entry: &e}); err != nil {
+		return err
+	}
+	l.entries[r.ID] = &e
+	return nil
+}
+
+// record is a Crawler.OnResult hook.
+func (l *Ledger) record(r CrawlResult) {
+	if err := l.Record(r); err != nil {
+		log.Printf("ledger: ebook %s: %v", r.ID, err)
+	}
+}
+
+// Cursor is the next never-attempted numeric ID.
+func (l *Ledger) Cursor() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.cursor
+}
+
+func (l *Ledger) SetCursor(n int) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.append(ledgerLine{Cursor: n}); err != nil {
+		return err
+	}
+	l.cursor = n
+	return nil
+}
+
+func (l *Ledger) Get(id string) (LedgerEntry, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	e, ok := l.entries[id]
+	if !ok {
+		return LedgerEntry{}, false
+	}
+	return *e, true
+}
+
+// List returns the entries with the given status, or all of them, in ID
+// order.
+func (l *Ledger) List(status string) []LedgerEntry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	list := make([]LedgerEntry, 0)
+	for _, id := range l.sortedIDs() {
+		if e := l.entries[id]; status == "" || e.Status == status {
+			list = append(list, *e)
+		}
+	}
+	return list
+}
+
+// Counts returns how many entries are in each status.
+func (l *Ledger) Counts() map[string]int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	counts := make(map[string]int)
+	for _, e := range l.entries {
+		counts[e.Status]++
+	}
+	return counts
+}
+
+// Gap is a run of IDs below the cursor that are not indexed. Status is
+// empty for IDs that were never attempted.
+type Gap struct {
+	From   int    `json:"from"`
+	To     int    `json:"to"`
+	Status string `json:"status"`
+}
+
+// Gaps lists the runs of numeric IDs in [from, to) that are not indexed,
+// grouped by status.
+func (l *Ledger) Gaps(from, to int) []Gap {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if to <= 0 || to > l.cursor {
+		to = l.cursor
+	}
+	if from < 1 {
+		from = 1
+	}
+	gaps := make([]Gap, 0)
+	for id := from; id < to; id++ {
+		status := ""
+		if e, ok := l.entries[strconv.Itoa(id)]; ok {
+			status = e.Status
+		}
+		if status == statusIndexed {
+			continue
+		}
+		if n := len(gaps); n > 0 && gaps[n-1].To == id-1 && gaps[n-1].Status == status {
+			gaps[n-1].To = id
+			continue
+		}
+		gaps = append(gaps, Gap{From: id, To: id, Status: status})
+	}
+	return gaps
+}
+
+// Requeue marks ids to be crawled again on the next run and returns the
+// IDs it queued. IDs that are already indexed are left alone unless force
+// is set.
+func (l *Ledger) Requeue(ids []string, force bool) ([]string, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	queued := make([]string, 0)
+	lines := make([]ledgerLine, 0)
+	for _, id := range ids {
+		e := LedgerEntry{ID: id}
+		if old, ok := l.entries[id]; ok {
+			e = *old
+		}
+		if e.Status == statusQueued || (e.Status == statusIndexed && !force) {
+			continue
+		}
+		e.Status = statusQueued
+		lines = append(lines, ledgerLine{Entry: &e})
+		queued = append(queued, id)
+	}
+	if len(lines) == 0 {
+		return queued, nil
+	}
+	if err := l.append(lines...); err != nil {
+		return nil, err
+	}
+	for _, line := range lines {
+		l.entries[line.Entry.ID] = line.Entry
+	}
+	return queued, nil
+}
+
+// IDs returns the IDs whose status is one of statuses, in ID order.
+func (l *Ledger) IDs(statuses ...string) []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	want := make(map[string]bool)
+	for _, s := range statuses {
+		want[s] = true
+	}
+	ids := make([]string, 0)
+	for _, id := range l.sortedIDs() {
+		if want[l.entries[id].Status] {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+func (l *Ledger) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.f.Close()
+}
+
+func (l *Ledger) sortedIDs() []string {
+	ids := make([]string, 0, len(l.entries))
+	for id := range l.entries {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return lessID(ids[i], ids[j]) })
+	return ids
+}
+
+// lessID orders numeric IDs numerically and before any other IDs.
+func lessID(a, b string) bool {
+	x, errA := strconv.Atoi(a)
+	y, errB := strconv.Atoi(b)
+	if errA == nil && errB == nil {
+		return x < y
+	}
+	if (errA == nil) != (errB == nil) {
+		return errA == nil
+	}
+	return a < b
+}
@@ -0,0 +1,468 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	defaultListLimit = 20
+	maxListLimit     = 100
+
+	codeInvalidQuery = "invalid_query"
+)
+
+// listSorts maps the sort keys of GET /v1/books to the fields
+// Elasticsearch sorts on.
+var listSorts = map[string]string{
+	"id":          "id",
+	"title":       "title.keyword",
+	"author":      "author.keyword",
+	"released_at": "released_at",
+	"created_at":  "created_at",
+}
+
+// ListFilter is what a page of GET /v1/books is drawn from: the filters
+// and the order. A cursor carries it, so every page of a listing comes
+// from the same one.
+type ListFilter struct {
+	Author      string `json:"author,omitempty"`
+	TitlePrefix string `json:"title_prefix,omitempty"`
+	// Language matches either the language of the ebook header or one of
+	// the catalog languages.
+	Language string `json:"language,omitempty"`
+	// The From bounds are inclusive, the Before bounds exclusive.
+	ReleasedFrom   *time.Time `json:"released_from,omitempty"`
+	ReleasedBefore *time.Time `json:"released_before,omitempty"`
+	CreatedFrom    *time.Time `json:"created_from,omitempty"`
+	CreatedBefore  *time.Time `json:"created_before,omitempty"`
+	// Sort is a key of listSorts, descending if Desc is set. Books with
+	// the same value, or none, follow in ID order.
+	Sort string `json:"sort"`
+	Desc bool   `json:"desc,omitempty"`
+}
+
+// ListQuery asks a store for one page of a listing.
+type ListQuery struct {
+	ListFilter
+	// After holds the sort values of the last book of the previous page,
+	// as the store gave them in ListPage.Next.
+	After []json.RawMessage
+	Limit int
+	// Exclude names top-level fields the caller does not need; a store
+	// may leave them out.
+	Exclude []string
+}
+
+// ListPage is a page of books in the order asked for. Next is set if more
+// books follow.
+type ListPage struct {
+	Books []json.RawMessage
+	Next  []json.RawMessage
+}
+
+// listCursor is the decoded next_cursor of a listing.
+type listCursor struct {
+	ListFilter
+	After []json.RawMessage `json:"after"`
+}
+
+func (c listCursor) encode() (string, error) {
+	b, err := json.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func decodeListCursor(s string) (listCursor, error) {
+	var c listCursor
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err == nil {
+		err = json.Unmarshal(b, &c)
+	}
+	if err == nil && listSorts[c.Sort] == "" {
+		err = errors.New("unknown sort")
+	}
+	if err == nil {
+		_, err = c.parseValues(c.After)
+	}
+	if err != nil {
+		return listCursor{}, errors.New("cursor is not one this API returned")
+	}
+	return c, nil
+}
+
+// esQuery is the Elasticsearch query for the filters of f.
+func (f ListFilter) esQuery() map[string]interface{} {
+	var filter []map[string]interface{}
+	if f.Author != "" {
+		filter = append(filter, map[string]interface{}{
+			"term": map[string]interface{}{"author.keyword": f.Author},
+		})
+	}
+	if f.TitlePrefix != "" {
+		filter = append(filter, map[string]interface{}{
+			"prefix": map[string]interface{}{"title.keyword": f.TitlePrefix},
+		})
+	}
+	if f.Language != "" {
+		filter = append(filter, map[string]interface{}{
+			"bool": map[string]interface{}{
+				"should": []map[string]interface{}{
+					{"term": map[string]interface{}{"language": f.Language}},
+					{"term": map[string]interface{}{"languages.keyword": f.Language}},
+				},
+				"minimum_should_match": 1,
+			},
+		})
+	}
+	for field, bounds := range map[string][2]*time.Time{
+		"released_at": {f.ReleasedFrom, f.ReleasedBefore},
+		"created_at":  {f.CreatedFrom, f.CreatedBefore},
+	} {
+		if bounds[0] == nil && bounds[1] == nil {
+			continue
+		}
+		r := map[string]interface{}{}
+		if bounds[0] != nil {
+			r["gte"] = bounds[0].Format(esTimeFormat)
+		}
+		if bounds[1] != nil {
+			r["lt"] = bounds[1].Format(esTimeFormat)
+		}
+		filter = append(filter, map[string]interface{}{
+			"range": map[string]interface{}{field: r},
+		})
+	}
+	if len(filter) == 0 {
+		return map[string]interface{}{"match_all": map[string]interface{}{}}
+	}
+	return map[string]interface{}{"bool": map[string]interface{}{"filter": filter}}
+}
+
+// esSort is the Elasticsearch sort of f, ending with the ID so that every
+// book has a place search_after can resume from.
+func (f ListFilter) esSort() []map[string]interface{} {
+	order := "asc"
+	if f.Desc {
+		order = "desc"
+	}
+	if f.Sort == "id" {
+		return []map[string]interface{}{{"id": map[string]interface{}{"order": order}}}
+	}
+	return []map[string]interface{}{
+		{listSorts[f.Sort]: map[string]interface{}{"order": order, "missing": "_last"}},
+		{"id": map[string]interface{}{"order": "asc"}},
+	}
+}
+
+// listDoc is the part of a stored book a listing filters and sorts on.
+type listDoc struct {
+	ID         string     `json:"id"`
+	Title      string     `json:"title"`
+	Author     string     `json:"author"`
+	Language   string     `json:"language"`
+	Languages  []string   `json:"languages"`
+	ReleasedAt *time.Time `json:"released_at"`
+	CreatedAt  *time.Time `json:"created_at"`
+}
+
+func (f ListFilter) match(doc listDoc) bool {
+	if f.Author != "" && doc.Author != f.Author {
+		return false
+	}
+	if !strings.HasPrefix(doc.Title, f.TitlePrefix) {
+		return false
+	}
+	if f.Language != "" && doc.Language != f.Language {
+		found := false
+		for _, l := range doc.Languages {
+			found = found || l == f.Language
+		}
+		if !found {
+			return false
+		}
+	}
+	return inRange(doc.ReleasedAt, f.ReleasedFrom, f.ReleasedBefore) &&
+		inRange(doc.CreatedAt, f.CreatedFrom, f.CreatedBefore)
+}
+
+// listKey is where a book falls in a listing sorted by f: the value sorted
+// on, a string or milliseconds, and the ID.
+type listKey struct {
+	Missing bool
+	Text    string
+	Millis  int64
+	ID      string
+}
+
+func (f ListFilter) key(doc listDoc) listKey {
+	k := listKey{ID: doc.ID}
+	var t *time.Time
+	switch f.Sort {
+	case "title":
+		k.Text = doc.Title
+	case "author":
+		k.Text = doc.Author
+	case "released_at":
+		t = doc.ReleasedAt
+	case "created_at":
+		t = doc.CreatedAt
+	}
+	if f.Sort == "released_at" || f.Sort == "created_at" {
+		if t == nil {
+			k.Missing = true
+		} else {
+			k.Millis = t.Unix()*1000 + int64(t.Nanosecond())/int64(time.Millisecond)
+		}
+	}
+	return k
+}
+
+// less orders keys as esSort does: books without the value last whatever
+// the direction, and ties in ascending ID order.
+func (f ListFilter) less(a, b listKey) bool {
+	if f.Sort == "id" {
+		if f.Desc {
+			return a.ID > b.ID
+		}
+		return a.ID < b.ID
+	}
+	if a.Missing != b.Missing {
+		return b.Missing
+	}
+	if !a.Missing && (a.Text != b.Text || a.Millis != b.Millis) {
+		if f.Desc {
+			a, b = b, a
+		}
+		if a.Text != b.Text {
+			return a.Text < b.Text
+		}
+		return a.Millis < b.Millis
+	}
+	return a.ID < b.ID
+}
+
+// values are the sort values a cursor keeps for k.
+func (f ListFilter) values(k listKey) []json.RawMessage {
+	id, _ := json.Marshal(k.ID)
+	if f.Sort == "id" {
+		return []json.RawMessage{id}
+	}
+	var v json.RawMessage
+	switch {
+	case k.Missing:
+		v = json.RawMessage("null")
+	case f.Sort == "title" || f.Sort == "author":
+		v, _ = json.Marshal(k.Text)
+	default:
+		v = json.RawMessage(strconv.FormatInt(k.Millis, 10))
+	}
+	return []json.RawMessage{v, id}
+}
+
+// parseValues reads back the key values made.
+func (f ListFilter) parseValues(values []json.RawMessage) (listKey, error) {
+	var k listKey
+	want := 2
+	if f.Sort == "id" {
+		want = 1
+	}
+	if len(values) != want {
+		return k, errors.New("cursor does not fit the sort")
+	}
+	if err := json.Unmarshal(values[want-1], &k.ID); err != nil || want == 1 {
+		return k, err
+	}
+	if string(values[0]) == "null" {
+		k.Missing = true
+		return k, nil
+	}
+	if f.Sort == "title" || f.Sort == "author" {
+		return k, json.Unmarshal(values[0], &k.Text)
+	}
+	return k, json.Unmarshal(values[0], &k.Millis)
+}
+
+// listDocOf decodes the listDoc of the book stored as src under id.
+func listDocOf(id string, src json.RawMessage) listDoc {
+	var doc listDoc
+	json.Unmarshal(src, &doc)
+	doc.ID = id
+	return doc
+}
+
+// listDocs is List for stores that keep the listDoc of every book: the
+// page is found from those alone, from the first book after q.After on,
+// and only the books on it are read.
+func listDocs(ctx context.Context, docs []listDoc, get func(string) (json.RawMessage, error), q ListQuery) (ListPage, error) {
+	keys := make([]listKey, 0, len(docs))
+	for _, doc := range docs {
+		if q.match(doc) {
+			keys = append(keys, q.key(doc))
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return q.less(keys[i], keys[j]) })
+	if len(q.After) > 0 {
+		after, err := q.parseValues(q.After)
+		if err != nil {
+			return ListPage{}, err
+		}
+		keys = keys[sort.Search(len(keys), func(i int) bool { return q.less(after, keys[i]) }):]
+	}
+
+	var page ListPage
+	for i, k := range keys {
+		if len(page.Books) == q.Limit {
+			page.Next = q.values(keys[i-1])
+			break
+		}
+		if err := ctx.Err(); err != nil {
+			return ListPage{}, err
+		}
+		src, err := get(k.ID)
+		if err == ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return ListPage{}, err
+		}
+		page.Books = append(page.Books, src)
+	}
+	return page, nil
+}
+
+// ListBooksResponse is a page of GET /v1/books. NextCursor is left out on
+// the last page.
+type ListBooksResponse struct {
+	Books      []json.RawMessage `json:"books"`
+	NextCursor string            `json:"next_cursor,omitempty"`
+}
+
+// listFilterParams are the query parameters a cursor stands for.
+var listFilterParams = []string{"author", "title_prefix", "language", "released_from", "released_to", "created_from", "created_to", "sort"}
+
+func parseListFilter(c *gin.Context) (ListFilter, error) {
+	f := ListFilter{
+		Author:      c.Query("author"),
+		TitlePrefix: c.Query("title_prefix"),
+		Language:    c.Query("language"),
+		Sort:        strings.TrimPrefix(c.DefaultQuery("sort", "id"), "-"),
+		Desc:        strings.HasPrefix(c.Query("sort"), "-"),
+	}
+	if listSorts[f.Sort] == "" {
+		return f, fmt.Errorf("cannot sort by %q: use id, title, author, released_at or created_at, with - for descending", f.Sort)
+	}
+	var err error
+	if f.ReleasedFrom, f.ReleasedBefore, err = parseDateRange(c, "released_from", "released_to"); err != nil {
+		return f, err
+	}
+	if f.CreatedFrom, f.CreatedBefore, err = parseDateRange(c, "created_from", "created_to"); err != nil {
+		return f, err
+	}
+	return f, nil
+}
+
+// parseListQuery reads a listing from the query parameters, or from
+// cursor if one is given. Filters sent along with a cursor must be the
+// ones it was made for.
+func parseListQuery(c *gin.Context) (ListQuery, error) {
+	q := ListQuery{Limit: defaultListLimit}
+	if v := c.Query("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxListLimit {
+			return q, fmt.Errorf("limit must be between 1 and %d", maxListLimit)
+		}
+		q.Limit = n
+	}
+	f, err := parseListFilter(c)
+	if err != nil {
+		return q, err
+	}
+	q.ListFilter = f
+	v := c.Query("cursor")
+	if v == "" {
+		return q, nil
+	}
+	cursor, err := decodeListCursor(v)
+	if err != nil {
+		return q, err
+	}
+	for _, name := range listFilterParams {
+		if _, ok := c.GetQuery(name); !ok {
+			continue
+		}
+		sent, _ := json.Marshal(f)
+		made, _ := json.Marshal(cursor.ListFilter)
+		if string(sent) != string(made) {
+			return q, errors.New("the filters and sort differ from those the cursor was made for")
+		}
+		break
+	}
+	q.ListFilter, q.After = cursor.ListFilter, cursor.After
+	return q, nil
+}
+
+// listBooksV1 pages through the library in a stable order. Each page ends
+// with a cursor to the next, which resumes after the last book returned,
+// so books are neither repeated nor skipped however far a client pages,
+// even as others are added. Books are returned as in GET /v1/books/:id,
+// without content unless fields names it.
+func listBooksV1(c *gin.Context) {
+	q, err := parseListQuery(c)
+	if err != nil {
+		apiError(c, http.StatusBadRequest, codeInvalidQuery, err.Error(), nil)
+		return
+	}
+	fields, exclude := splitList(c.Query("fields")), splitList(c.Query("exclude"))
+	q.Exclude = []string{"paragraphs", "footnotes", "chapters"}
+	withContent := false
+	for _, f := range fields {
+		withContent = withContent || f == "content"
+	}
+	if !withContent {
+		q.Exclude = append(q.Exclude, "content")
+		exclude = append(exclude, "content")
+	}
+
+	page, err := bookStore.List(c, q)
+	if err != nil {
+		storeError(c, err)
+		return
+	}
+	res := ListBooksResponse{Books: make([]json.RawMessage, 0, len(page.Books))}
+	for _, src := range page.Books {
+		var book Book
+		if err := json.Unmarshal(src, &book); err != nil {
+			storeError(c, err)
+			return
+		}
+		b, err := json.Marshal(newBookResponse(book))
+		if err == nil {
+			b, err = projectFields(b, fields, exclude)
+		}
+		if err != nil {
+			storeError(c, err)
+			return
+		}
+		res.Books = append(res.Books, b)
+	}
+	if page.Next != nil {
+		if res.NextCursor, err = (listCursor{q.ListFilter, page.Next}).encode(); err != nil {
+			storeError(c, err)
+			return
+		}
+	}
+	c.JSON(http.StatusOK, res)
+}
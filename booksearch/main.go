@@ -1,15 +1,12 @@
 package main
 
 import (
-	"bufio"
 	"encoding/json"
-	"fmt"
-	"io"
+	"flag"
 	"log"
 	"net/http"
 	"os"
 	"sort"
-	"strconv"
 	"strings"
 	"time"
 
@@ -22,34 +19,56 @@ const (
 	elasticIndexName = "books"
 	elasticTypeName  = "book"
 	baseUrlTitle     = "http://www.gutenberg.org/files/"
-	layout1          = "January 2, 2006"
-	layout2          = "January, 2006"
-	layout3          = "2006"
 )
 
 type Book struct {
-	ID         string    `json:"id"`
-	Title      string    `json:"title"`
-	Author     string    `json:"author"`
-	CreatedAt  time.Time `json:"created_at"`
-	ReleasedAt time.Time `json:"released_at"`
-	Content    string    `json:"content"`
+	ID         string     `json:"id"`
+	Title      string     `json:"title"`
+	Author     string     `json:"author"`
+	CreatedAt  time.Time  `json:"created_at"`
+	UpdatedAt  *time.Time `json:"updated_at,omitempty"`
+	ReleasedAt *time.Time `json:"released_at"`
+	// ReleasePrecision is day, month, year or unknown; ReleaseDateRaw is
+	// the header date as written.
+	ReleasePrecision string `json:"release_precision,omitempty"`
+	ReleaseDateRaw   string `json:"release_date_raw,omitempty"`
+	// Content keeps the line breaks of the book; Paragraphs indexes it.
+	Content    string      `json:"content"`
+	Paragraphs []Paragraph `json:"paragraphs,omitempty"`
+	Footnotes  []Footnote  `json:"footnotes,omitempty"`
+	Chapters   []Chapter   `json:"chapters,omitempty"`
+	// Form is prose, play or verse.
+	Form string `json:"form,omitempty"`
+	// Encoding is the charset the ebook was published in; Content is
+	// always UTF-8.
+	Encoding    string `json:"encoding,omitempty"`
+	Translator  string `json:"translator,omitempty"`
+	Editor      string `json:"editor,omitempty"`
+	Illustrator string `json:"illustrator,omitempty"`
+	Language    string `json:"language,omitempty"`
+	PostingDate string `json:"posting_date,omitempty"`
+	LastUpdated string `json:"last_updated,omitempty"`
+	EbookNumber string `json:"ebook_number,omitempty"`
+	CatalogRecord
 }
 
 type CreateBookRequest struct {
-	ID         string    `json:"id"`
-	Title      string    `json:"title"`
-	Author     string    `json:"author"`
-	ReleasedAt time.Time `json:"released_at"`
-	Content    string    `json:"content"`
+	ID         string     `json:"id"`
+	Title      string     `json:"title"`
+	Author     string     `json:"author"`
+	ReleasedAt *time.Time `json:"released_at"`
+	Content    string     `json:"content"`
 }
 
 type SearchBook struct {
-	ID         string    `json:"id"`
-	Title      string    `json:"title"`
-	Author     string    `json:"author"`
-	ReleasedAt time.Time `json:"released_at"`
-	Score      float64   `json:"score"`
+	ID         string     `json:"id"`
+	Title      string     `json:"title"`
+	Author     string     `json:"author"`
+	ReleasedAt *time.Time `json:"released_at"`
+	Score      float64    `json:"score"`
+	Passage    *Passage   `json:"passage,omitempty"`
+	Chapter    *Chapter   `json:"chapter,omitempty"`
+	Citation   string     `json:"citation,omitempty"`
 	// Highlight  []string  `json:"highlight"`
 }
 
@@ -58,173 +77,194 @@ type SearchResponse struct {
 }
 
 var (
-	elasticClient *elastic.Client
-	startIndex    int
+	elasticClient   *elastic.Client
+	bookStore       BookStore
+	sentenceStore   SentenceStore
+	corpus          CorpusSource
+	crawlLedger     *Ledger
+	crawlControl    *CrawlController
+	engine          = flag.String("engine", "elastic", "storage engine: elastic, memory or embedded")
+	indexDir        = flag.String("index-dir", "data/index", "index directory for the embedded engine")
+	corpusFlag      = flag.String("corpus", baseUrlTitle, "Gutenberg files URL, or a local mirror or folder of .txt files")
+	catalogFlag     = flag.String("catalog", "", "Gutenberg RDF catalog: rdf-files tarball or directory")
+	normalizeFlag   = flag.String("normalize", "all", "ingest normalization steps: "+strings.Join(normalizeSteps, ",")+", all or none")
+	parseFlag       = flag.String("parse", "", "parse a Gutenberg text file, print its header and body as JSON and exit")
+	benchFlag       = flag.String("bench", "", "time the search queries in this file, one per line, against the index and exit")
+	benchRuns       = flag.Int("bench-runs", 3, "times each benchmark query is run")
+	legacyRoutes    = flag.Bool("legacy-routes", true, "also serve the book routes that take ?id= on /books")
+	crawlerConfig   = defaultCrawlerConfig
+	elasticConfig   = defaultElasticConfig
+	normalizeConfig NormalizeConfig
 )
 
+func init() {
+	flag.IntVar(&crawlerConfig.Workers, "crawl-workers", crawlerConfig.Workers, "number of concurrent crawl workers")
+	flag.IntVar(&crawlerConfig.BatchSize, "crawl-batch", crawlerConfig.BatchSize, "books per bulk index request")
+	flag.DurationVar(&crawlerConfig.HostInterval, "crawl-host-interval", crawlerConfig.HostInterval, "minimum delay between requests to one host")
+	flag.StringVar(&crawlerConfig.UserAgent, "crawl-user-agent", crawlerConfig.UserAgent, "User-Agent sent by the crawler")
+	flag.DurationVar(&crawlerConfig.Timeout, "crawl-timeout", crawlerConfig.Timeout, "timeout for a single ebook download")
+	flag.IntVar(&crawlerConfig.MaxRetries, "crawl-retries", crawlerConfig.MaxRetries, "retries on 429, 5xx and network errors")
+	flag.DurationVar(&crawlerConfig.Backoff, "crawl-backoff", crawlerConfig.Backoff, "initial retry backoff, doubled per attempt")
+
+	flag.StringVar(&elasticConfig.URLs, "es-urls", elasticConfig.URLs, "comma-separated Elasticsearch node URLs")
+	flag.StringVar(&elasticConfig.Username, "es-username", elasticConfig.Username, "Elasticsearch basic auth user")
+	flag.StringVar(&elasticConfig.Password, "es-password", elasticConfig.Password, "Elasticsearch basic auth password (or $ES_PASSWORD)")
+	flag.StringVar(&elasticConfig.APIKey, "es-api-key", elasticConfig.APIKey, "Elasticsearch API key, base64 id:key (or $ES_API_KEY)")
+	flag.StringVar(&elasticConfig.CAFile, "es-ca-cert", elasticConfig.CAFile, "PEM file of CA certificates to trust for Elasticsearch")
+	flag.DurationVar(&elasticConfig.Timeout, "es-timeout", elasticConfig.Timeout, "timeout for a single Elasticsearch request")
+	flag.IntVar(&elasticConfig.MaxRetries, "es-retries", elasticConfig.MaxRetries, "retries of an Elasticsearch request that failed to reach a node")
+	flag.DurationVar(&elasticConfig.Backoff, "es-backoff", elasticConfig.Backoff, "initial Elasticsearch retry backoff, doubled per attempt")
+	flag.DurationVar(&elasticConfig.MaxBackoff, "es-max-backoff", elasticConfig.MaxBackoff, "longest Elasticsearch retry backoff")
+	flag.BoolVar(&elasticConfig.Sniff, "es-sniff", elasticConfig.Sniff, "discover the other Elasticsearch nodes of the cluster")
+	flag.IntVar(&elasticConfig.StartupAttempts, "es-startup-attempts", elasticConfig.StartupAttempts, "connection attempts at startup before giving up")
+	flag.DurationVar(&elasticConfig.StartupBackoff, "es-startup-backoff", elasticConfig.StartupBackoff, "delay after the first failed connection attempt, doubled per attempt")
+	flag.DurationVar(&elasticConfig.HealthInterval, "es-health-interval", elasticConfig.HealthInterval, "how often Elasticsearch health is checked")
+}
+
 func main() {
-	f, err := os.OpenFile("data/startindex.txt", os.O_RDWR|os.O_CREATE, 0666)
-	if err != nil {
-		log.Println(err)
-		return
-	} else {
-		_, err = fmt.Fscanf(f, "%d\n", &startIndex)
-		if err == io.EOF {
-			log.Println(err)
-			startIndex = 1
-		}
-	}
-	f.Close()
+	flag.Parse()
 
-	ticker := time.NewTicker(1 * time.Minute)
-	if startIndex > 4000 {
-		ticker = time.NewTicker(24 * time.Hour)
+	var err error
+	normalizeConfig, err = parseNormalizeConfig(*normalizeFlag)
+	if err != nil {
+		log.Fatal(err)
 	}
-	done := make(chan bool)
-	go func() {
-		for {
-			select {
-			case <-done:
-				return
-			case <-ticker.C:
-				if startIndex > 4000 {
-					ticker = time.NewTicker(24 * time.Hour)
-					crawlBooks(100)
-				} else {
-					crawlBooks(10)
-				}
-			}
-		}
-	}()
 
-	for {
-		elasticClient, err = elastic.NewClient(
-			elastic.SetURL("http://elasticsearch:9200"),
-			elastic.SetSniff(false),
-		)
-		if err != nil {
-			log.Println(err)
-			time.Sleep(3 * time.Second)
-		} else {
-			break
+	if *parseFlag != "" {
+		if err := printParsedEbook(os.Stdout, *parseFlag); err != nil {
+			log.Fatal(err)
 		}
+		return
 	}
 
-	r := gin.Default()
-	r.PUT("/books", putBookEndpoint)
-	r.DELETE("/books", deleteBookEndpoint)
-	r.POST("/books", postBookEndpoint)
-	r.GET("/books", getBookEndpoint)
-	r.GET("/search", searchEndpoint)
-	if err = r.Run(":8080"); err != nil {
+	corpus, err = newCorpusSource(*corpusFlag, crawlerConfig)
+	if err != nil {
 		log.Fatal(err)
 	}
 
-	for {
-
+	crawlLedger, err = OpenLedger("data/ledger.jsonl", "data/startindex.txt")
+	if err != nil {
+		log.Fatal(err)
 	}
-}
 
-func crawlBooks(amount int) {
-	bulk := elasticClient.Bulk()
-	ctx := context.Background()
-	var index int
-	for index = startIndex; index < startIndex+amount; index++ {
-		url := baseUrlTitle + strconv.Itoa(index) + "/" + strconv.Itoa(index) + ".txt"
-		res, err := http.Get(url)
+	switch *engine {
+	case "memory":
+		bookStore = NewMemoryStore()
+		sentenceStore = NewMemorySentenceStore()
+	case "embedded":
+		disk, err := OpenDiskStore(*indexDir)
 		if err != nil {
-			log.Println("can't get url data")
-			return
+			log.Fatal(err)
+		}
+		bookStore = disk
+		sentenceStore = NewMemorySentenceStore()
+		rebuildSentences(context.Background(), disk, sentenceStore, disk.IDs())
+	case "elastic":
+		if elasticClient, err = connectElastic(elasticConfig); err != nil {
+			log.Fatal(err)
+		}
+		if elasticCluster, err = detectCluster(context.Background(), elasticClient); err != nil {
+			log.Fatal(err)
 		}
-		defer res.Body.Close()
-		title, author, release_date, content := extractData(res.Body)
-		if title != "" {
-			log.Println("at index:" + strconv.Itoa(index))
-			log.Println(title)
-			log.Println(author)
-			log.Println(release_date)
-			rdate := parseAsDate(release_date)
-			log.Println(rdate)
-			book := Book{
-				ID:         strconv.Itoa(index),
-				Title:      title,
-				Author:     author,
-				CreatedAt:  time.Now().UTC(),
-				ReleasedAt: rdate,
-				Content:    content,
+		log.Printf("elastic: %s %s", elasticCluster.Distribution, elasticCluster.Version)
+		for _, d := range []IndexDefinition{booksIndex, sentencesIndex} {
+			if err := ensureIndex(context.Background(), elasticClient, d); err != nil {
+				log.Fatal(err)
 			}
-			req := elastic.NewBulkIndexRequest().Index("books").Type("book").Id(strconv.Itoa(index)).Doc(book)
-			bulk = bulk.Add(req)
 		}
-	}
-	_, err := bulk.Do(ctx)
-	if err != nil {
-		log.Println("Bulk insert failed")
-		log.Println(err)
-	} else {
-		log.Println("Bulk insert success")
-	}
-	f, err := os.OpenFile("data/startindex.txt", os.O_RDWR, 0644)
-	if err != nil {
-		log.Println("error in open file")
-		return
-	}
-	_, err = f.WriteString(strconv.Itoa(index))
-	if err != nil {
-		log.Println("error writing file")
-		f.Close()
+		bookStore = NewElasticStore(elasticClient, elasticIndexName, elasticCluster.docType())
+		sentenceStore = NewElasticSentenceStore(elasticClient, elasticSentenceIndexName, elasticCluster.docType())
+	default:
+		log.Fatalf("unknown engine %q", *engine)
+	}
+	if *benchFlag != "" {
+		if err := runSearchBenchmark(os.Stdout, bookStore, *benchFlag, *benchRuns); err != nil {
+			log.Fatal(err)
+		}
 		return
 	}
-	f.Sync()
-	f.Close()
-	startIndex = index
-}
+	bookStore = sentenceIndexingStore{bookStore, sentenceStore}
 
-func parseAsDate(release_date string) time.Time {
-	rdate := strings.Split(release_date, "[")
-	rdate2 := strings.TrimSpace(rdate[0])
-	t1, err := time.Parse(layout1, rdate2)
-	if err != nil {
-		t2, err := time.Parse(layout2, rdate2)
+	crawlControl = NewCrawlController(0, 0)
+	startCrawl := func() {
+		var err error
+		if src, ok := corpus.(WalkableSource); ok {
+			err = crawlControl.StartIngest(context.Background(), src)
+		} else {
+			err = crawlControl.StartSchedule(0, 0)
+		}
 		if err != nil {
-			t3, err := time.Parse(layout3, rdate2)
-			if err != nil {
-				return time.Now()
-			}
-			return t3
+			log.Println(err)
+		}
+		if elasticClient != nil {
+			// Runs after the crawl has started, so an outage can pause it.
+			go monitorElastic(context.Background(), elasticClient, elasticConfig)
 		}
-		return t2
 	}
-	return t1
-}
+	if *catalogFlag != "" {
+		// Like POST /admin/catalog/import, in the background: applying a
+		// catalog visits every catalogued book. The crawl waits for the
+		// load, so the books it indexes are enriched as they come in.
+		go func() {
+			if err := importCatalog(context.Background(), *catalogFlag, startCrawl); err != nil {
+				log.Println(err)
+			}
+		}()
+	} else {
+		startCrawl()
+	}
+	if elasticClient == nil {
+		setReadiness(Readiness{Ready: true, Engine: *engine})
+	}
+
+	r := gin.Default()
+	r.Use(requestID)
+	r.GET("/healthz", healthEndpoint)
+	r.GET("/readyz", readyEndpoint)
+	if *legacyRoutes {
+		r.PUT("/books", putBookEndpoint)
+		r.DELETE("/books", deleteBookEndpoint)
+		r.POST("/books", idempotent, postBookEndpoint)
+		r.GET("/books", getBookEndpoint)
+	}
+	r.POST("/books/_bulk", bulkBooksEndpoint)
+	r.GET("/books/:id/passages", passagesEndpoint)
+	r.GET("/books/:id/chapters", chaptersEndpoint)
+	r.GET("/books/:id/chapters/:n", chapterEndpoint)
+	r.GET("/search", searchEndpoint)
+	r.GET("/sentences", sentenceSearchEndpoint)
+	r.GET("/export", exportEndpoint)
+
+	v1 := r.Group("/v1")
+	v1.GET("/books", listBooksV1)
+	v1.POST("/books", idempotent, createBookV1)
+	v1.GET("/books/:id", getBookV1)
+	v1.PUT("/books/:id", replaceBookV1)
+	v1.PATCH("/books/:id", patchBookV1)
+	v1.DELETE("/books/:id", deleteBookV1)
+
+	admin := r.Group("/admin")
+	admin.GET("/ledger", ledgerListEndpoint)
+	admin.GET("/ledger/gaps", ledgerGapsEndpoint)
+	admin.GET("/ledger/ids/:id", ledgerEntryEndpoint)
+	admin.POST("/ledger/requeue", ledgerRequeueEndpoint)
+	admin.GET("/crawl", crawlStatusEndpoint)
+	admin.PATCH("/crawl", crawlConfigEndpoint)
+	admin.POST("/crawl/start", crawlStartEndpoint)
+	admin.POST("/crawl/pause", crawlPauseEndpoint)
+	admin.POST("/crawl/resume", crawlResumeEndpoint)
+	admin.POST("/crawl/cancel", crawlCancelEndpoint)
+	admin.GET("/catalog", catalogStatusEndpoint)
+	admin.POST("/catalog/import", catalogImportEndpoint)
+	admin.GET("/indices", indicesEndpoint)
+	admin.POST("/indices/:alias/reindex", reindexEndpoint)
+	if err = r.Run(":8080"); err != nil {
+		log.Fatal(err)
+	}
+
+	for {
 
-func extractData(res io.Reader) (string, string, string, string) {
-	var title = ""
-	var author = ""
-	var rd string
-	var progress = 0
-	var content strings.Builder
-	scanner := bufio.NewScanner(res)
-	for scanner.Scan() {
-		text := scanner.Text()
-		if err := scanner.Err(); err != nil {
-			break
-		}
-		if progress == 1 {
-			content.WriteString(text + " ")
-		} else if strings.Contains(text, "Title: ") {
-			title = strings.TrimPrefix(text, "Title: ")
-		} else if strings.Contains(text, "Author: ") {
-			author = strings.TrimPrefix(text, "Author: ")
-		} else if strings.Contains(text, "*** START") {
-			progress = 1
-		} else if strings.Contains(text, "*** END") {
-			break
-		} else if strings.Contains(text, "Release Date: ") {
-			rd = strings.TrimPrefix(text, "Release Date: ")
-		}
 	}
-	return title, author, rd, content.String()
 }
 
 func getBookEndpoint(c *gin.Context) {
@@ -233,22 +273,21 @@ func getBookEndpoint(c *gin.Context) {
 		errorResponse(c, http.StatusBadRequest, "Id not specified")
 		return
 	}
-	res, err := elasticClient.Get().Index("books").Type("book").Id(id).Do(c)
+	src, err := bookStore.Get(c, id)
+	if err == ErrNotFound {
+		errorResponse(c, http.StatusNotFound, err.Error())
+		return
+	}
 	if err != nil {
 		log.Println(err)
 		errorResponse(c, http.StatusInternalServerError, err.Error())
 		return
 	}
-	c.JSON(http.StatusOK, res.Source)
+	c.JSON(http.StatusOK, src)
 }
 
-func postBookEndpoint(c *gin.Context) {
-	var req CreateBookRequest
-	if err := c.BindJSON(&req); err != nil {
-		errorResponse(c, http.StatusBadRequest, "Malformed request body")
-		return
-	}
-
+// newBook builds the book stored for a create or update request.
+func newBook(req CreateBookRequest) Book {
 	book := Book{
 		ID:         req.ID,
 		Title:      req.Title,
@@ -257,44 +296,79 @@ func postBookEndpoint(c *gin.Context) {
 		ReleasedAt: req.ReleasedAt,
 		Content:    req.Content,
 	}
-	data, err := json.Marshal(book)
-	if err != nil {
-		log.Println(err)
-		errorResponse(c, http.StatusInternalServerError, err.Error())
+	normalizeBook(&book, normalizeConfig)
+	book.ReleasePrecision = precisionUnknown
+	if book.ReleasedAt != nil {
+		book.ReleasePrecision = precisionDay
+	}
+	return book
+}
+
+// postBookEndpoint creates a book; an existing book with the same ID is
+// left alone and answered with 409.
+func postBookEndpoint(c *gin.Context) {
+	var req CreateBookRequest
+	if err := c.BindJSON(&req); err != nil {
+		errorResponse(c, http.StatusBadRequest, "Malformed request body")
+		return
+	}
+	if errs := validateBookRequest(req.ID, req); len(errs) > 0 {
+		errorResponse(c, http.StatusUnprocessableEntity, fieldErrorMessage(errs))
+		return
+	}
+
+	book, err := createBook(c, req)
+	if err == ErrConflict {
+		errorResponse(c, http.StatusConflict, "Book "+book.ID+" already exists")
 		return
 	}
-	js := string(data)
-	_, err = elasticClient.Index().Index("books").Type("book").Id(book.ID).BodyJson(js).Do(c)
 	if err != nil {
 		log.Println(err)
 		errorResponse(c, http.StatusInternalServerError, err.Error())
 		return
 	}
-	c.Status(http.StatusOK)
+	c.Header("Location", bookLocation(book.ID))
+	c.JSON(http.StatusCreated, newBookResponse(book))
 }
 
+// putBookEndpoint replaces the book with the ID in the body, keeping its
+// created_at.
 func putBookEndpoint(c *gin.Context) {
 	var req CreateBookRequest
 	if err := c.BindJSON(&req); err != nil {
 		errorResponse(c, http.StatusBadRequest, "Malformed request body")
 		return
 	}
-
-	book := Book{
-		ID:         req.ID,
-		Title:      req.Title,
-		Author:     req.Author,
-		CreatedAt:  time.Now().UTC(),
-		ReleasedAt: req.ReleasedAt,
-		Content:    req.Content,
+	errs := validateBookRequest(req.ID, req)
+	if req.ID == "" {
+		errs = append(errs, FieldError{"id", "is required"})
 	}
-	_, err := elasticClient.Update().Index("books").Type("book").Id(book.ID).Doc(book).Do(c)
-	if err != nil {
+	if len(errs) > 0 {
+		errorResponse(c, http.StatusUnprocessableEntity, fieldErrorMessage(errs))
+		return
+	}
+
+	_, v, _, err := editBook(c, req.ID, c.GetHeader("If-Match"), func(existing Book) (Book, []FieldError) {
+		return replacement(existing, req), nil
+	})
+	switch err {
+	case nil:
+		c.Header("ETag", v.ETag())
+		c.Status(http.StatusOK)
+	case ErrNotFound:
+		errorResponse(c, http.StatusNotFound, err.Error())
+	case errIfMatch:
+		errorResponse(c, http.StatusPreconditionFailed, err.Error())
+	case ErrPreconditionFailed:
+		if c.GetHeader("If-Match") != "" {
+			errorResponse(c, http.StatusPreconditionFailed, errIfMatch.Error())
+			return
+		}
+		errorResponse(c, http.StatusConflict, err.Error())
+	default:
 		log.Println(err)
 		errorResponse(c, http.StatusInternalServerError, err.Error())
-		return
 	}
-	c.Status(http.StatusOK)
 }
 
 func deleteBookEndpoint(c *gin.Context) {
@@ -303,7 +377,11 @@ func deleteBookEndpoint(c *gin.Context) {
 		errorResponse(c, http.StatusBadRequest, "Id not specified")
 		return
 	}
-	res, err := elasticClient.Delete().Index("books").Type("book").Id(id).Do(c)
+	res, err := bookStore.Delete(c, id)
+	if err == ErrNotFound {
+		errorResponse(c, http.StatusNotFound, err.Error())
+		return
+	}
 	if err != nil {
 		log.Println(err)
 		errorResponse(c, http.StatusInternalServerError, err.Error())
@@ -326,48 +404,31 @@ func searchEndpoint(c *gin.Context) {
 	skip := 0
 	take := 1000
 	take_more := 30
-	terms := strings.Split(query, " ")
-	clause := make([]map[string]interface{}, 0)
-	for i := 0; i < len(terms); i++ {
-		clause = append(clause, map[string]interface{}{
-			"span_multi": map[string]interface{}{
-				"match": map[string]interface{}{
-					"fuzzy": map[string]interface{}{
-						field: map[string]interface{}{
-							"fuzziness": strconv.Itoa(getMaxFuzzy(len(terms[i]))),
-							"value":     terms[i],
-						},
-					},
-				},
-			},
-		})
-	}
-
-	esQuery := map[string]interface{}{
-		"span_near": map[string]interface{}{
-			"clauses":  clause,
-			"slop":     1,
-			"in_order": "true",
-		},
+	terms := normalizeQuery(query)
+	if len(terms) == 0 {
+		errorResponse(c, http.StatusBadRequest, "Query has no searchable terms")
+		return
 	}
 
-	queryJson, err := json.Marshal(esQuery)
+	releasedFrom, releasedBefore, err := parseDateRange(c, "released_from", "released_to")
 	if err != nil {
-		log.Println(err)
-		errorResponse(c, http.StatusInternalServerError, err.Error())
+		errorResponse(c, http.StatusBadRequest, err.Error())
 		return
 	}
 
-	highlighter := elastic.NewHighlight().HighlighterType("plain").Field("content")
-
-	result, err := elasticClient.Search().
-		Index(elasticIndexName).
-		Query(elastic.RawStringQuery(string(queryJson))).
-		From(skip).
-		Size(take).TrackScores(false).
-		Highlight(highlighter).
-		Do(c.Request.Context())
+	filters := make(map[string][]string)
+	for param, docField := range catalogFilters {
+		if values := c.QueryArray(param); len(values) > 0 {
+			filters[docField] = values
+		}
+	}
 
+	q := newSpanQuery(field, terms)
+	q.From = skip
+	q.Size = take
+	q.Filters = filters
+	q.ReleasedFrom, q.ReleasedBefore = releasedFrom, releasedBefore
+	hits, err := bookStore.Search(c.Request.Context(), q)
 	if err != nil {
 		log.Println(err)
 		errorResponse(c, http.StatusInternalServerError, err.Error())
@@ -376,77 +437,50 @@ func searchEndpoint(c *gin.Context) {
 
 	var res SearchResponse
 
+	// The analyzed search ranks hits itself and also matches books missing
+	// some of the terms, so there is nothing to supplement.
+	ranked := analyzedSearch(elasticIndexName, field)
 	books := make([]SearchBook, 0)
-	for _, hit := range result.Hits.Hits {
+	matched := make(map[string]matchedHit)
+	for _, hit := range hits {
 		var book SearchBook
-		json.Unmarshal(*hit.Source, &book)
-		book.Score = getScore(hit.Highlight["content"], terms, true)
+		json.Unmarshal(hit.Source, &book)
+		book.Score = hit.Score
+		if !ranked {
+			book.Score = getScore(hit.Highlight["content"], terms, true)
+		}
 		books = append(books, book)
+		if _, ok := matched[hit.ID]; !ok {
+			matched[hit.ID] = matchedHit{hit, terms, true}
+		}
 	}
 
-	if len(terms) > 1 && len(books) < 30 {
+	if !ranked && len(terms) > 1 && len(books) < 30 {
 		for i := 0; i < len(terms); i++ {
-			clause := make([]map[string]interface{}, 0)
-			for j := 0; j < len(terms); j++ {
-				if j != i {
-					clause = append(clause, map[string]interface{}{
-						"span_multi": map[string]interface{}{
-							"match": map[string]interface{}{
-								"fuzzy": map[string]interface{}{
-									field: map[string]interface{}{
-										"fuzziness": strconv.Itoa(getMaxFuzzy(len(terms[i]))),
-										"value":     terms[i],
-									},
-								},
-							},
-						},
-					})
-				}
-			}
-
-			esQuery := map[string]interface{}{
-				"span_near": map[string]interface{}{
-					"clauses":  clause,
-					"slop":     1,
-					"in_order": "true",
-				},
-			}
-
-			queryJson, err := json.Marshal(esQuery)
-			if err != nil {
-				log.Println(err)
-				errorResponse(c, http.StatusInternalServerError, err.Error())
-				return
-			}
-
-			result, err := elasticClient.Search().
-				Index(elasticIndexName).
-				Query(elastic.RawStringQuery(string(queryJson))).
-				From(skip).
-				Size(take_more).TrackScores(false).
-				Highlight(highlighter).
-				Do(c.Request.Context())
-
+			tmp_terms := make([]string, 0)
+			tmp_terms = append(tmp_terms, terms[:i]...)
+			tmp_terms = append(tmp_terms, terms[i+1:]...)
+
+			q := newSpanQuery(field, tmp_terms)
+			q.From = skip
+			q.Size = take_more
+			q.Filters = filters
+			q.ReleasedFrom, q.ReleasedBefore = releasedFrom, releasedBefore
+			hits, err := bookStore.Search(c.Request.Context(), q)
 			if err != nil {
 				log.Println(err)
 				errorResponse(c, http.StatusInternalServerError, err.Error())
 				return
 			}
 
-			for _, hit := range result.Hits.Hits {
+			for _, hit := range hits {
 				var book SearchBook
-				json.Unmarshal(*hit.Source, &book)
-				if i == 0 {
-					book.Score = getScore(hit.Highlight["content"], terms[1:], false)
-				} else if i == (len(terms) - 1) {
-					book.Score = getScore(hit.Highlight["content"], terms[:i], false)
-				} else {
-					tmp_terms := make([]string, 0)
-					tmp_terms = append(tmp_terms, terms[:i]...)
-					tmp_terms = append(tmp_terms, terms[i+1:]...)
-					book.Score = getScore(hit.Highlight["content"], tmp_terms, false)
-				}
+				json.Unmarshal(hit.Source, &book)
+				book.Score = getScore(hit.Highlight["content"], tmp_terms, false)
 				books = append(books, book)
+				if _, ok := matched[hit.ID]; !ok {
+					matched[hit.ID] = matchedHit{hit, tmp_terms, false}
+				}
 			}
 		}
 	}
@@ -472,9 +506,50 @@ func searchEndpoint(c *gin.Context) {
 		}
 	}
 
+	for i := range res.Books {
+		b := &res.Books[i]
+		b.Passage, b.Chapter = matched[b.ID].passage()
+		if b.Passage != nil {
+			b.Citation = citation(b.Title, b.Passage.Structure)
+		}
+	}
 	c.JSON(http.StatusOK, res)
 }
 
+// matchedHit remembers the hit a search result came from, so the passage
+// and chapter of its best fragment can be shown.
+type matchedHit struct {
+	hit        SearchHit
+	terms      []string
+	supplement bool
+}
+
+func (m matchedHit) passage() (*Passage, *Chapter) {
+	fragments := m.hit.Highlight["content"]
+	if len(fragments) == 0 {
+		return nil, nil
+	}
+	// Scored hits come with their fragments best first.
+	best, bestScore := fragments[0], -1.0
+	for _, f := range fragments {
+		if m.hit.Score > 0 {
+			break
+		}
+		if score := getScore([]string{f}, m.terms, m.supplement); score > bestScore {
+			best, bestScore = f, score
+		}
+	}
+	book, err := decodeBookText(m.hit.Source)
+	if err != nil {
+		return nil, nil
+	}
+	p := passageForHighlight(book, best)
+	if p == nil {
+		return nil, nil
+	}
+	return p, chapterAt(book.Chapters, p.Start)
+}
+
 func getScore(input []string, terms []string, supplement bool) float64 {
 	count := len(terms)
 	max_terms := count
@@ -490,7 +565,7 @@ func getScore(input []string, terms []string, supplement bool) float64 {
 	}
 
 	for _, sentence := range input {
-		words := strings.Split(sentence, " ")
+		words := strings.Fields(sentence)
 		word_num := 0
 		gaps := 0
 		total_fuzzy := 0.0
@@ -643,12 +718,12 @@ func sortByField(field string, list []SearchBook) []SearchBook {
 		return new_list
 	} else if field == "time_new" {
 		sort.SliceStable(new_list, func(i, j int) bool {
-			return new_list[i].ReleasedAt.After(new_list[j].ReleasedAt)
+			return releasedBefore(new_list[i].ReleasedAt, new_list[j].ReleasedAt, true)
 		})
 		return new_list
 	} else if field == "time_old" {
 		sort.SliceStable(new_list, func(i, j int) bool {
-			return new_list[i].ReleasedAt.Before(new_list[j].ReleasedAt)
+			return releasedBefore(new_list[i].ReleasedAt, new_list[j].ReleasedAt, false)
 		})
 		return new_list
 	} else if field == "alphabet" {
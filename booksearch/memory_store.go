@@ -0,0 +1,340 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+)
+
+var indexedFields = []string{"title", "author", "content"}
+
+// MemoryStore is an in-process BookStore backed by a positional inverted
+// index. Nothing is persisted.
+type MemoryStore struct {
+	mu       sync.RWMutex
+	docs     map[string]json.RawMessage
+	versions map[string]int64
+	fields   map[string]*fieldIndex
+	// meta holds what List filters and sorts on; nil in stores that are
+	// not listed.
+	meta map[string]listDoc
+}
+
+// fieldIndex maps term -> document ID -> sorted token positions, and keeps
+// the field text so hits can be highlighted.
+type fieldIndex struct {
+	postings map[string]map[string][]int
+	text     map[string]string
+}
+
+func NewMemoryStore() *MemoryStore {
+	s := newMemoryStore(indexedFields)
+	s.meta = make(map[string]listDoc)
+	return s
+}
+
+// newMemoryStore returns a MemoryStore indexing the given top-level text
+// fields of its documents.
+func newMemoryStore(fields []string) *MemoryStore {
+	s := &MemoryStore{
+		docs:     make(map[string]json.RawMessage),
+		versions: make(map[string]int64),
+		fields:   make(map[string]*fieldIndex),
+	}
+	for _, f := range fields {
+		s.fields[f] = &fieldIndex{
+			postings: make(map[string]map[string][]int),
+			text:     make(map[string]string),
+		}
+	}
+	return s
+}
+
+func (s *MemoryStore) Get(ctx context.Context, id string) (json.RawMessage, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	src, ok := s.docs[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return src, nil
+}
+
+func (s *MemoryStore) GetVersion(ctx context.Context, id string) (json.RawMessage, Version, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	src, ok := s.docs[id]
+	if !ok {
+		return nil, Version{}, ErrNotFound
+	}
+	return src, Version{s.versions[id], processTerm}, nil
+}
+
+func (s *MemoryStore) Replace(ctx context.Context, book Book, ifMatch Version) (Version, error) {
+	src, err := json.Marshal(book)
+	if err != nil {
+		return Version{}, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.docs[book.ID]; !ok {
+		return Version{}, ErrNotFound
+	}
+	if (Version{s.versions[book.ID], processTerm}) != ifMatch {
+		return Version{}, ErrPreconditionFailed
+	}
+	s.put(book.ID, src)
+	return Version{s.versions[book.ID], processTerm}, nil
+}
+
+func (s *MemoryStore) UpdateFields(ctx context.Context, id string, fields map[string]interface{}, ifMatch Version) (Version, error) {
+	patch, err := json.Marshal(fields)
+	if err != nil {
+		return Version{}, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	src, ok := s.docs[id]
+	if !ok {
+		return Version{}, ErrNotFound
+	}
+	if (Version{s.versions[id], processTerm}) != ifMatch {
+		return Version{}, ErrPreconditionFailed
+	}
+	merged, err := mergeSource(src, patch)
+	if err != nil {
+		return Version{}, err
+	}
+	s.put(id, merged)
+	return Version{s.versions[id], processTerm}, nil
+}
+
+func (s *MemoryStore) Index(ctx context.Context, book Book) error {
+	src, err := json.Marshal(book)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.put(book.ID, src)
+	return nil
+}
+
+func (s *MemoryStore) Create(ctx context.Context, book Book) error {
+	src, err := json.Marshal(book)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.docs[book.ID]; ok {
+		return ErrConflict
+	}
+	s.put(book.ID, src)
+	return nil
+}
+
+func (s *MemoryStore) Update(ctx context.Context, book Book) error {
+	patch, err := json.Marshal(book)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	src, ok := s.docs[book.ID]
+	if !ok {
+		return ErrNotFound
+	}
+	merged, err := mergeSource(src, patch)
+	if err != nil {
+		return err
+	}
+	s.put(book.ID, merged)
+	return nil
+}
+
+func (s *MemoryStore) Delete(ctx context.Context, id string) (*DeleteResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.docs[id]; !ok {
+		return nil, ErrNotFound
+	}
+	return s.deleteLocked(id), nil
+}
+
+func (s *MemoryStore) DeleteIf(ctx context.Context, id string, ifMatch Version) (*DeleteResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.docs[id]; !ok {
+		return nil, ErrNotFound
+	}
+	if (Version{s.versions[id], processTerm}) != ifMatch {
+		return nil, ErrPreconditionFailed
+	}
+	return s.deleteLocked(id), nil
+}
+
+func (s *MemoryStore) deleteLocked(id string) *DeleteResult {
+	s.remove(id)
+	delete(s.docs, id)
+	s.versions[id]++
+	return &DeleteResult{
+		Index:   elasticIndexName,
+		Type:    elasticTypeName,
+		ID:      id,
+		Version: s.versions[id],
+		Result:  "deleted",
+	}
+}
+
+func (s *MemoryStore) Bulk(ctx context.Context, books []Book) error {
+	srcs := make([]json.RawMessage, len(books))
+	for i, book := range books {
+		src, err := json.Marshal(book)
+		if err != nil {
+			return err
+		}
+		srcs[i] = src
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, book := range books {
+		s.put(book.ID, srcs[i])
+	}
+	return nil
+}
+
+func (s *MemoryStore) Export(ctx context.Context, q ExportQuery, fn func(json.RawMessage) error) error {
+	s.mu.RLock()
+	ids := make([]string, 0, len(s.docs))
+	for id := range s.docs {
+		ids = append(ids, id)
+	}
+	s.mu.RUnlock()
+	return exportDocs(ctx, ids, func(id string) (json.RawMessage, error) { return s.Get(ctx, id) }, q, fn)
+}
+
+func (s *MemoryStore) List(ctx context.Context, q ListQuery) (ListPage, error) {
+	s.mu.RLock()
+	docs := make([]listDoc, 0, len(s.meta))
+	for _, doc := range s.meta {
+		docs = append(docs, doc)
+	}
+	s.mu.RUnlock()
+	return listDocs(ctx, docs, func(id string) (json.RawMessage, error) { return s.Get(ctx, id) }, q)
+}
+
+func (s *MemoryStore) Search(ctx context.Context, q SpanQuery) ([]SearchHit, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	found := s.spanHits(q)
+	sortSpanHits(found)
+	hits := make([]SearchHit, 0)
+	for _, h := range pageSpanHits(found, q.From, q.Size) {
+		hit := SearchHit{ID: h.id, Source: s.docs[h.id]}
+		if q.HighlightField != "" {
+			hit.Highlight = map[string][]string{}
+			if q.HighlightField == q.Field {
+				hit.Highlight[q.HighlightField] = highlightSpans(s.fields[q.Field].text[h.id], h.matches)
+			}
+		}
+		hits = append(hits, hit)
+	}
+	return hits, nil
+}
+
+func (s *MemoryStore) spanHits(q SpanQuery) []spanHit {
+	fi, ok := s.fields[q.Field]
+	if !ok {
+		return nil
+	}
+	clauses := make([]map[string][]int, len(q.Terms))
+	for i, term := range q.Terms {
+		expanded := expandFuzzy(term, q.Fuzziness[i], func(yield func(string)) {
+			for t := range fi.postings {
+				yield(t)
+			}
+		})
+		clauses[i] = make(map[string][]int)
+		for _, t := range expanded {
+			for id, positions := range fi.postings[t] {
+				clauses[i][id] = append(clauses[i][id], positions...)
+			}
+		}
+	}
+	var keep func(string) bool
+	if q.filtered() {
+		keep = func(id string) bool { return q.matchSource(s.docs[id]) }
+	}
+	return collectSpanHits(clauses, q, keep)
+}
+
+func (s *MemoryStore) put(id string, src json.RawMessage) {
+	if _, ok := s.docs[id]; ok {
+		s.remove(id)
+	}
+	s.docs[id] = src
+	s.versions[id]++
+	if s.meta != nil {
+		s.meta[id] = listDocOf(id, src)
+	}
+
+	var fields map[string]interface{}
+	if err := json.Unmarshal(src, &fields); err != nil {
+		return
+	}
+	for name, fi := range s.fields {
+		text, _ := fields[name].(string)
+		if text == "" {
+			continue
+		}
+		fi.text[id] = text
+		for _, t := range analyze(text) {
+			docs, ok := fi.postings[t.term]
+			if !ok {
+				docs = make(map[string][]int)
+				fi.postings[t.term] = docs
+			}
+			docs[id] = append(docs[id], t.pos)
+		}
+	}
+}
+
+func (s *MemoryStore) remove(id string) {
+	if s.meta != nil {
+		delete(s.meta, id)
+	}
+	for _, fi := range s.fields {
+		text, ok := fi.text[id]
+		if !ok {
+			continue
+		}
+		for _, t := range analyze(text) {
+			if docs, ok := fi.postings[t.term]; ok {
+				delete(docs, id)
+				if len(docs) == 0 {
+					delete(fi.postings, t.term)
+				}
+			}
+		}
+		delete(fi.text, id)
+	}
+}
+
+// mergeSource applies the top-level fields of patch onto src, the way a
+// partial update document is merged.
+func mergeSource(src, patch json.RawMessage) (json.RawMessage, error) {
+	var doc map[string]json.RawMessage
+	if err := json.Unmarshal(src, &doc); err != nil {
+		return nil, err
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(patch, &fields); err != nil {
+		return nil, err
+	}
+	for k, v := range fields {
+		doc[k] = v
+	}
+	return json.Marshal(doc)
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// NormalizeConfig selects the steps of the ingest normalization pipeline.
+// Queries go through the same folding steps so they match what was
+// indexed.
+type NormalizeConfig struct {
+	Footnotes     bool // move [Footnote N: ...] blocks to Book.Footnotes
+	Illustrations bool // drop [Illustration: ...] blocks
+	Italics       bool // _italic_ -> italic
+	Dehyphenate   bool // rejoin words hyphenated across a line break
+	Quotes        bool // fold smart quotes and guillemets to ' and "
+	Dashes        bool // fold --, en and em dashes to an em dash
+}
+
+var normalizeSteps = []string{"footnotes", "illustrations", "italics", "dehyphenate", "quotes", "dashes"}
+
+var defaultNormalizeConfig = NormalizeConfig{true, true, true, true, true, true}
+
+// parseNormalizeConfig reads a comma-separated list of steps; "all" and
+// "none" are shorthands.
+func parseNormalizeConfig(s string) (NormalizeConfig, error) {
+	switch strings.TrimSpace(s) {
+	case "all":
+		return defaultNormalizeConfig, nil
+	case "none", "":
+		return NormalizeConfig{}, nil
+	}
+	var cfg NormalizeConfig
+	for _, step := range strings.Split(s, ",") {
+		switch strings.TrimSpace(step) {
+		case "footnotes":
+			cfg.Footnotes = true
+		case "illustrations":
+			cfg.Illustrations = true
+		case "italics":
+			cfg.Italics = true
+		case "dehyphenate":
+			cfg.Dehyphenate = true
+		case "quotes":
+			cfg.Quotes = true
+		case "dashes":
+			cfg.Dashes = true
+		default:
+			return cfg, fmt.Errorf("unknown normalization step %q (want %s, all or none)", step, strings.Join(normalizeSteps, ","))
+		}
+	}
+	return cfg, nil
+}
+
+const footnoteStart = "[Footnote"
+
+type Footnote struct {
+	Label string `json:"label"`
+	Text  string `json:"text"`
+}
+
+var (
+	illustrationRe = regexp.MustCompile(`\[Illustration[^\]]*\]`)
+	italicRe       = regexp.MustCompile(`_([^\s_](?:[^_]{0,300}[^\s_])?)_`)
+	dashRe         = regexp.MustCompile(`-{2,}|[–―]`)
+	quoteFolder    = strings.NewReplacer(
+		"“", `"`, "”", `"`, "„", `"`, "‟", `"`, "«", `"`, "»", `"`,
+		"‘", "'", "’", "'", "‚", "'", "‛", "'",
+	)
+	blankLinesRe = regexp.MustCompile(`\n[ \t]*\n(?:[ \t]*\n)+`)
+)
+
+// normalizeText runs the pipeline over book text and returns the text
+// and the footnotes taken out of it. Line breaks are kept apart from
+// those removed with a block.
+func normalizeText(text string, cfg NormalizeConfig) (string, []Footnote) {
+	var footnotes []Footnote
+	if cfg.Footnotes {
+		text, footnotes = extractFootnotes(text)
+		for i := range footnotes {
+			footnotes[i].Text = foldText(footnotes[i].Text, cfg)
+		}
+	}
+	if cfg.Illustrations {
+		text = illustrationRe.ReplaceAllString(text, "")
+	}
+	if cfg.Dehyphenate {
+		text = dehyphenate(text)
+	}
+	text = foldText(text, cfg)
+	if cfg.Footnotes || cfg.Illustrations {
+		// Removed blocks leave runs of blank lines behind.
+		text = strings.Trim(blankLinesRe.ReplaceAllString(text, "\n\n"), "\n")
+	}
+	return text, footnotes
+}
+
+// foldText applies the inline steps, the ones that also apply to queries
+// and short fields such as titles.
+func foldText(text string, cfg NormalizeConfig) string {
+	if cfg.Italics {
+		text = italicRe.ReplaceAllString(text, "$1")
+	}
+	if cfg.Quotes {
+		text = quoteFolder.Replace(text)
+	}
+	if cfg.Dashes {
+		text = dashRe.ReplaceAllString(text, "—")
+	}
+	return text
+}
+
+// extractFootnotes removes [Footnote N: ...] blocks, which may span lines
+// and contain brackets, and the [N] marker that refers to each: the last
+// one before the block. Bracketed text that no block refers to, such as
+// [sic] or an unreferenced [2], is left alone.
+func extractFootnotes(text string) (string, []Footnote) {
+	var footnotes []Footnote
+	var out []byte
+	rest := text
+	for {
+		i := strings.Index(rest, footnoteStart)
+		if i < 0 {
+			break
+		}
+		end := closingBracket(rest, i)
+		if end < 0 {
+			break
+		}
+		body := rest[i+len(footnoteStart) : end]
+		label, note := "", body
+		if colon := strings.IndexByte(body, ':'); colon >= 0 {
+			label, note = strings.TrimSpace(body[:colon]), body[colon+1:]
+		}
+		footnotes = append(footnotes, Footnote{Label: label, Text: strings.Join(strings.Fields(note), " ")})
+		out = append(out, rest[:i]...)
+		if label != "" {
+			marker := "[" + label + "]"
+			if m := bytes.LastIndex(out, []byte(marker)); m >= 0 {
+				out = append(out[:m], out[m+len(marker):]...)
+			}
+		}
+		rest = rest[end+1:]
+	}
+	out = append(out, rest...)
+	return string(out), footnotes
+}
+
+// closingBracket returns the index of the bracket closing the one at open,
+// or -1.
+func closingBracket(s string, open int) int {
+	depth := 0
+	for i := open; i < len(s); i++ {
+		switch s[i] {
+		case '[':
+			depth++
+		case ']':
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// dehyphenate rejoins "exam-\nple" as "example\n", moving the rest of the
+// word up to the first line so the line structure is kept. The hyphen is
+// dropped only if the joined word occurs unhyphenated elsewhere in the
+// text; otherwise the word is taken for a compound and kept whole, as
+// "well-known".
+func dehyphenate(text string) string {
+	known := make(map[string]bool)
+	for _, w := range strings.FieldsFunc(text, func(r rune) bool { return !unicode.IsLetter(r) }) {
+		known[strings.ToLower(w)] = true
+	}
+	lines := strings.Split(text, "\n")
+	for i := 0; i+1 < len(lines); i++ {
+		line := strings.TrimRight(lines[i], " \t")
+		if len(line) < 2 || line[len(line)-1] != '-' || line[len(line)-2] == '-' {
+			continue
+		}
+		before := []rune(line[:len(line)-1])
+		if !unicode.IsLetter(before[len(before)-1]) {
+			continue
+		}
+		next := strings.TrimLeft(lines[i+1], " \t")
+		if next == "" {
+			continue
+		}
+		first := []rune(next)[0]
+		if !unicode.IsLower(first) {
+			continue
+		}
+		word := next
+		if sp := strings.IndexAny(next, " \t"); sp >= 0 {
+			word = next[:sp]
+		}
+		head := line[:len(line)-1]
+		if !known[strings.ToLower(lastWord(head)+leadingLetters(word))] {
+			head = line
+		}
+		lines[i] = head + word
+		lines[i+1] = strings.TrimLeft(next[len(word):], " \t")
+		if lines[i+1] == "" {
+			// Keep the paragraph together rather than leave a blank line.
+			lines = append(lines[:i+1], lines[i+2:]...)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// lastWord returns the letters at the end of s.
+func lastWord(s string) string {
+	i := strings.LastIndexFunc(s, func(r rune) bool { return !unicode.IsLetter(r) })
+	if i < 0 {
+		return s
+	}
+	_, size := utf8.DecodeRuneInString(s[i:])
+	return s[i+size:]
+}
+
+// leadingLetters returns the letters at the start of s.
+func leadingLetters(s string) string {
+	if i := strings.IndexFunc(s, func(r rune) bool { return !unicode.IsLetter(r) }); i >= 0 {
+		return s[:i]
+	}
+	return s
+}
+
+// normalizeQuery folds a query the way book text is folded at ingest and
+// splits it into the terms the index holds.
+func normalizeQuery(query string) []string {
+	query = foldText(query, normalizeConfig)
+	terms := make([]string, 0)
+	for _, t := range analyze(query) {
+		terms = append(terms, t.term)
+	}
+	return terms
+}
+
+// normalizeBook normalizes the text fields of a book and rebuilds its
+// paragraph index, chapter outline and play or verse structure.
+func normalizeBook(book *Book, cfg NormalizeConfig) {
+	book.Title = foldText(book.Title, cfg)
+	book.Author = foldText(book.Author, cfg)
+	book.Content, book.Footnotes = normalizeText(book.Content, cfg)
+	book.Paragraphs = splitParagraphs(book.Content)
+	book.Chapters = detectChapters(book.Content, book.Paragraphs)
+	book.Form = detectStructure(book.Content, book.Paragraphs, book.Chapters)
+}
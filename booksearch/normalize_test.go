@@ -0,0 +1,27 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestExtractFootnotesKeepsUnreferencedBrackets(t *testing.T) {
+	text := "He wrote it thus [sic] in [2] places.[1]\n\n[Footnote 1: A note [with brackets].]\n\nMore."
+	got, notes := extractFootnotes(text)
+	want := "He wrote it thus [sic] in [2] places.\n\n\n\nMore."
+	if got != want {
+		t.Errorf("text = %q, want %q", got, want)
+	}
+	wantNotes := []Footnote{{Label: "1", Text: "A note [with brackets]."}}
+	if !reflect.DeepEqual(notes, wantNotes) {
+		t.Errorf("footnotes = %+v, want %+v", notes, wantNotes)
+	}
+}
+
+func TestDehyphenateKeepsCompounds(t *testing.T) {
+	text := "a well-\nknown exam-\nple of an example"
+	want := "a well-known\nexample\nof an example"
+	if got := dehyphenate(text); got != want {
+		t.Errorf("dehyphenate = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+const maxPassageParagraphs = 50
+
+// Paragraph locates one paragraph of Book.Content: the byte offsets of its
+// first and past-the-end characters, and the offset of each of its lines.
+type Paragraph struct {
+	Start int   `json:"start"`
+	End   int   `json:"end"`
+	Lines []int `json:"lines"`
+	// LineNumbers and Speakers run parallel to Lines in plays and verse;
+	// see detectStructure.
+	LineNumbers []int    `json:"line_numbers,omitempty"`
+	Speakers    []string `json:"speakers,omitempty"`
+}
+
+// Passage is a paragraph rendered as it appears in the book, line breaks
+// and indentation included.
+type Passage struct {
+	Paragraph int        `json:"paragraph"`
+	Start     int        `json:"start"`
+	End       int        `json:"end"`
+	Text      string     `json:"text"`
+	Structure *Structure `json:"structure,omitempty"`
+}
+
+// splitParagraphs finds the paragraphs of content: runs of non-blank lines
+// separated by blank ones.
+func splitParagraphs(content string) []Paragraph {
+	paragraphs := make([]Paragraph, 0)
+	inParagraph := false
+	for offset := 0; offset <= len(content); {
+		end := strings.IndexByte(content[offset:], '\n')
+		if end < 0 {
+			end = len(content)
+		} else {
+			end += offset
+		}
+		if strings.TrimSpace(content[offset:end]) == "" {
+			inParagraph = false
+		} else {
+			if !inParagraph {
+				paragraphs = append(paragraphs, Paragraph{Start: offset})
+				inParagraph = true
+			}
+			p := &paragraphs[len(paragraphs)-1]
+			p.End = end
+			p.Lines = append(p.Lines, offset)
+		}
+		offset = end + 1
+	}
+	return paragraphs
+}
+
+// paragraphAt returns the index of the paragraph containing offset, or of
+// the first one after it.
+func paragraphAt(paragraphs []Paragraph, offset int) int {
+	lo, hi := 0, len(paragraphs)
+	for lo < hi {
+		mid := (lo + hi) / 2
+		if paragraphs[mid].End <= offset {
+			lo = mid + 1
+		} else {
+			hi = mid
+		}
+	}
+	return lo
+}
+
+func passage(book bookText, i int) Passage {
+	p := book.Paragraphs[i]
+	return Passage{
+		Paragraph: i,
+		Start:     p.Start,
+		End:       p.End,
+		Text:      book.Content[p.Start:p.End],
+		Structure: structureAt(book, p.Start),
+	}
+}
+
+// passageForHighlight finds the paragraph holding the first match of a
+// highlight fragment. Highlighters return fragments verbatim apart from
+// the <em> tags. The structure is that of the matching line.
+func passageForHighlight(book bookText, fragment string) *Passage {
+	plain := strings.NewReplacer("<em>", "", "</em>", "").Replace(fragment)
+	offset := strings.Index(book.Content, plain)
+	if offset < 0 || len(book.Paragraphs) == 0 {
+		return nil
+	}
+	if em := strings.Index(fragment, "<em>"); em > 0 {
+		offset += em
+	}
+	i := paragraphAt(book.Paragraphs, offset)
+	if i >= len(book.Paragraphs) {
+		return nil
+	}
+	p := passage(book, i)
+	p.Structure = structureAt(book, offset)
+	return &p
+}
+
+// bookText is the part of a stored book the passage API reads.
+type bookText struct {
+	ID         string      `json:"id"`
+	Title      string      `json:"title"`
+	Content    string      `json:"content"`
+	Paragraphs []Paragraph `json:"paragraphs"`
+	Chapters   []Chapter   `json:"chapters"`
+	Form       string      `json:"form"`
+}
+
+func decodeBookText(src json.RawMessage) (bookText, error) {
+	var b bookText
+	if err := json.Unmarshal(src, &b); err != nil {
+		return b, err
+	}
+	// Books indexed before paragraphs were stored.
+	if b.Paragraphs == nil {
+		b.Paragraphs = splitParagraphs(b.Content)
+		b.Chapters = detectChapters(b.Content, b.Paragraphs)
+		b.Form = detectStructure(b.Content, b.Paragraphs, b.Chapters)
+	}
+	if b.Chapters == nil {
+		b.Chapters = detectChapters(b.Content, b.Paragraphs)
+	}
+	return b, nil
+}
+
+// passagesEndpoint returns count paragraphs of a book starting at
+// paragraph, or the paragraph containing a byte offset with context
+// paragraphs on either side.
+func passagesEndpoint(c *gin.Context) {
+	book, ok := bookTextFor(c)
+	if !ok {
+		return
+	}
+
+	from, to := 0, 1
+	if v := c.Query("offset"); v != "" {
+		offset, err := strconv.Atoi(v)
+		if err != nil || offset < 0 {
+			errorResponse(c, http.StatusBadRequest, "offset must be a byte offset into the content")
+			return
+		}
+		around, _ := strconv.Atoi(c.DefaultQuery("context", "1"))
+		at := paragraphAt(book.Paragraphs, offset)
+		from, to = at-around, at+around+1
+	} else {
+		from, _ = strconv.Atoi(c.DefaultQuery("paragraph", "0"))
+		count, _ := strconv.Atoi(c.DefaultQuery("count", "1"))
+		to = from + count
+	}
+	if from < 0 {
+		from = 0
+	}
+	if to > len(book.Paragraphs) {
+		to = len(book.Paragraphs)
+	}
+	if to-from > maxPassageParagraphs {
+		to = from + maxPassageParagraphs
+	}
+
+	passages := make([]Passage, 0)
+	for i := from; i < to; i++ {
+		passages = append(passages, passage(book, i))
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"id":         book.ID,
+		"title":      book.Title,
+		"paragraphs": len(book.Paragraphs),
+		"passages":   passages,
+	})
+}
@@ -0,0 +1,371 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	maxFuzzyExpansions = 50
+	highlightFragSize  = 100
+	highlightMaxFrags  = 5
+)
+
+// token is a single analyzed term with its position and byte offsets in the
+// original text.
+type token struct {
+	term  string
+	pos   int
+	start int
+	end   int
+}
+
+// analyze splits text the way the standard analyzer does closely enough for
+// span queries: lowercased runs of letters and digits, keeping apostrophes
+// that sit between two letters.
+func analyze(text string) []token {
+	tokens := make([]token, 0)
+	start := -1
+	pos := 0
+	flush := func(end int) {
+		if start >= 0 {
+			tokens = append(tokens, token{
+				term:  strings.ToLower(text[start:end]),
+				pos:   pos,
+				start: start,
+				end:   end,
+			})
+			pos++
+			start = -1
+		}
+	}
+	for i, r := range text {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			if start < 0 {
+				start = i
+			}
+			continue
+		}
+		if (r == '\'' || r == '’') && start >= 0 {
+			next, _ := utf8.DecodeRuneInString(text[i+utf8.RuneLen(r):])
+			if unicode.IsLetter(next) {
+				continue
+			}
+		}
+		flush(i)
+	}
+	flush(len(text))
+	return tokens
+}
+
+// fuzzyDistance returns the optimal string alignment distance between a and
+// b, or max+1 as soon as it is known to exceed max.
+func fuzzyDistance(a, b string, max int) int {
+	ra := []rune(a)
+	rb := []rune(b)
+	if d := len(ra) - len(rb); d > max || -d > max {
+		return max + 1
+	}
+	prev2 := make([]int, len(rb)+1)
+	prev := make([]int, len(rb)+1)
+	cur := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		cur[0] = i
+		rowMin := cur[0]
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			v := prev[j] + 1
+			if cur[j-1]+1 < v {
+				v = cur[j-1] + 1
+			}
+			if prev[j-1]+cost < v {
+				v = prev[j-1] + cost
+			}
+			if i > 1 && j > 1 && ra[i-1] == rb[j-2] && ra[i-2] == rb[j-1] && prev2[j-2]+1 < v {
+				v = prev2[j-2] + 1
+			}
+			cur[j] = v
+			if v < rowMin {
+				rowMin = v
+			}
+		}
+		if rowMin > max {
+			return max + 1
+		}
+		prev2, prev, cur = prev, cur, prev2
+	}
+	return prev[len(rb)]
+}
+
+// expandFuzzy picks the dictionary terms within fuzziness edits of value,
+// closest first, capped like the fuzzy query's max_expansions.
+func expandFuzzy(value string, fuzziness int, terms func(yield func(term string))) []string {
+	type candidate struct {
+		term string
+		dist int
+	}
+	candidates := make([]candidate, 0)
+	terms(func(term string) {
+		if d := fuzzyDistance(value, term, fuzziness); d <= fuzziness {
+			candidates = append(candidates, candidate{term, d})
+		}
+	})
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].dist != candidates[j].dist {
+			return candidates[i].dist < candidates[j].dist
+		}
+		return candidates[i].term < candidates[j].term
+	})
+	if len(candidates) > maxFuzzyExpansions {
+		candidates = candidates[:maxFuzzyExpansions]
+	}
+	expanded := make([]string, len(candidates))
+	for i, c := range candidates {
+		expanded[i] = c.term
+	}
+	return expanded
+}
+
+// spanMatch holds the position matched by each clause of a span_near query.
+type spanMatch []int
+
+// matchSpanNear finds non-overlapping span_near matches given the sorted
+// positions each clause matched in one document.
+func matchSpanNear(clauses [][]int, slop int, inOrder bool) []spanMatch {
+	if len(clauses) == 0 {
+		return nil
+	}
+	for _, positions := range clauses {
+		if len(positions) == 0 {
+			return nil
+		}
+	}
+	if inOrder {
+		return matchOrdered(clauses, slop)
+	}
+	return matchUnordered(clauses, slop)
+}
+
+func matchOrdered(clauses [][]int, slop int) []spanMatch {
+	matches := make([]spanMatch, 0)
+	last := -1
+	for _, first := range clauses[0] {
+		if first <= last {
+			continue
+		}
+		m := make(spanMatch, len(clauses))
+		m[0] = first
+		if extendOrdered(clauses, m, 1, slop) {
+			matches = append(matches, m)
+			last = m[len(m)-1]
+		}
+	}
+	return matches
+}
+
+func extendOrdered(clauses [][]int, m spanMatch, k int, slop int) bool {
+	if k == len(clauses) {
+		return true
+	}
+	prev := m[k-1]
+	i := sort.SearchInts(clauses[k], prev+1)
+	for ; i < len(clauses[k]); i++ {
+		p := clauses[k][i]
+		gap := p - prev - 1
+		if gap > slop {
+			break
+		}
+		m[k] = p
+		if extendOrdered(clauses, m, k+1, slop-gap) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchUnordered(clauses [][]int, slop int) []spanMatch {
+	width := len(clauses) + slop
+	starts := make([]int, 0)
+	for _, positions := range clauses {
+		starts = append(starts, positions...)
+	}
+	sort.Ints(starts)
+	matches := make([]spanMatch, 0)
+	last := -1
+	for i, start := range starts {
+		if start <= last || (i > 0 && starts[i-1] == start) {
+			continue
+		}
+		m := make(spanMatch, len(clauses))
+		used := make(map[int]bool)
+		if assignUnordered(clauses, m, 0, start, start+width-1, used) && used[start] {
+			matches = append(matches, m)
+			for _, p := range m {
+				if p > last {
+					last = p
+				}
+			}
+		}
+	}
+	return matches
+}
+
+func assignUnordered(clauses [][]int, m spanMatch, k int, lo, hi int, used map[int]bool) bool {
+	if k == len(clauses) {
+		return true
+	}
+	i := sort.SearchInts(clauses[k], lo)
+	for ; i < len(clauses[k]) && clauses[k][i] <= hi; i++ {
+		p := clauses[k][i]
+		if used[p] {
+			continue
+		}
+		used[p] = true
+		m[k] = p
+		if assignUnordered(clauses, m, k+1, lo, hi, used) {
+			return true
+		}
+		delete(used, p)
+	}
+	return false
+}
+
+// spanHit is a document together with its span_near matches.
+type spanHit struct {
+	id      string
+	matches []spanMatch
+}
+
+// collectSpanHits runs span_near over clause postings keyed by document ID.
+// keep, if not nil, filters the documents before their spans are matched,
+// so a filter narrows the hits before they are paged.
+func collectSpanHits(clauses []map[string][]int, q SpanQuery, keep func(id string) bool) []spanHit {
+	found := make([]spanHit, 0)
+	if len(clauses) == 0 {
+		return found
+	}
+	for id := range clauses[0] {
+		if keep != nil && !keep(id) {
+			continue
+		}
+		perClause := make([][]int, len(clauses))
+		for i, c := range clauses {
+			perClause[i] = c[id]
+			sort.Ints(perClause[i])
+		}
+		if matches := matchSpanNear(perClause, q.Slop, q.InOrder); len(matches) > 0 {
+			found = append(found, spanHit{id, matches})
+		}
+	}
+	return found
+}
+
+func sortSpanHits(hits []spanHit) {
+	sort.Slice(hits, func(i, j int) bool {
+		if len(hits[i].matches) != len(hits[j].matches) {
+			return len(hits[i].matches) > len(hits[j].matches)
+		}
+		return hits[i].id < hits[j].id
+	})
+}
+
+func pageSpanHits(hits []spanHit, from, size int) []spanHit {
+	if from < 0 {
+		from = 0
+	}
+	if from >= len(hits) || size <= 0 {
+		return nil
+	}
+	hits = hits[from:]
+	if size < len(hits) {
+		hits = hits[:size]
+	}
+	return hits
+}
+
+// highlightSpans renders plain-highlighter style fragments of text with the
+// matched positions wrapped in <em> tags.
+func highlightSpans(text string, matches []spanMatch) []string {
+	if len(matches) == 0 {
+		return nil
+	}
+	tokens := analyze(text)
+	byPos := make(map[int]token, len(tokens))
+	for _, t := range tokens {
+		byPos[t.pos] = t
+	}
+
+	fragments := make([]string, 0)
+	lastEnd := 0
+	for _, m := range matches {
+		if len(fragments) == highlightMaxFrags {
+			break
+		}
+		positions := append([]int(nil), m...)
+		sort.Ints(positions)
+		first, ok1 := byPos[positions[0]]
+		final, ok2 := byPos[positions[len(positions)-1]]
+		if !ok1 || !ok2 || first.start < lastEnd {
+			continue
+		}
+		pad := (highlightFragSize - (final.end - first.start)) / 2
+		if pad < 0 {
+			pad = 0
+		}
+		start := snapBackward(text, first.start-pad, lastEnd)
+		end := snapForward(text, final.end+pad)
+
+		var b strings.Builder
+		cursor := start
+		for _, p := range positions {
+			t := byPos[p]
+			b.WriteString(text[cursor:t.start])
+			b.WriteString("<em>")
+			b.WriteString(text[t.start:t.end])
+			b.WriteString("</em>")
+			cursor = t.end
+		}
+		b.WriteString(text[cursor:end])
+		fragments = append(fragments, strings.TrimSpace(b.String()))
+		lastEnd = end
+	}
+	return fragments
+}
+
+func snapBackward(text string, i, floor int) int {
+	if i <= floor {
+		return floor
+	}
+	for i > floor && !utf8.RuneStart(text[i]) {
+		i--
+	}
+	for j := i; j > floor; j-- {
+		if text[j-1] == ' ' || text[j-1] == '\n' {
+			return j
+		}
+	}
+	return floor
+}
+
+func snapForward(text string, i int) int {
+	if i >= len(text) {
+		return len(text)
+	}
+	for i < len(text) && !utf8.RuneStart(text[i]) {
+		i++
+	}
+	for j := i; j < len(text); j++ {
+		if text[j] == ' ' || text[j] == '\n' {
+			return j
+		}
+	}
+	return len(text)
+}
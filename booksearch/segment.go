@@ -0,0 +1,353 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+	"sort"
+)
+
+// Segment file layout:
+//
+//	magic
+//	stored sources, one after another
+//	postings lists: uvarint doc count, then per doc uvarint ord delta,
+//	uvarint freq and uvarint position deltas
+//	meta: doc IDs with source offsets, then per field the sorted term
+//	dictionary with postings offsets
+//	footer: meta offset, meta length, meta crc32, magic
+const (
+	segmentMagic      = "BKSEG001"
+	segmentFooterSize = 8 + 8 + 4 + len(segmentMagic)
+)
+
+var errCorruptSegment = errors.New("corrupt segment")
+
+type segment struct {
+	name   string
+	f      *os.File
+	ids    []string
+	srcOff []int64
+	srcLen []int64
+	fields map[string]*segmentField
+}
+
+type segmentField struct {
+	terms []string
+	off   []int64
+	size  []int64
+}
+
+type segmentDoc struct {
+	id  string
+	src json.RawMessage
+}
+
+// writeSegment writes docs as a new immutable segment at path. The file is
+// written under a temporary name, synced and then renamed into place.
+func writeSegment(path string, docs []segmentDoc) error {
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+
+	w := &countingWriter{w: bufio.NewWriterSize(f, 1<<20)}
+	w.Write([]byte(segmentMagic))
+
+	srcOff := make([]int64, len(docs))
+	postings := make(map[string]map[string]map[int][]int, len(indexedFields))
+	for _, field := range indexedFields {
+		postings[field] = make(map[string]map[int][]int)
+	}
+	for ord, doc := range docs {
+		srcOff[ord] = w.n
+		w.Write(doc.src)
+
+		var fields map[string]interface{}
+		if err := json.Unmarshal(doc.src, &fields); err != nil {
+			f.Close()
+			return err
+		}
+		for _, field := range indexedFields {
+			text, _ := fields[field].(string)
+			for _, t := range analyze(text) {
+				lists := postings[field][t.term]
+				if lists == nil {
+					lists = make(map[int][]int)
+					postings[field][t.term] = lists
+				}
+				lists[ord] = append(lists[ord], t.pos)
+			}
+		}
+	}
+
+	meta := new(bytes.Buffer)
+	putUvarint(meta, uint64(len(docs)))
+	for ord, doc := range docs {
+		putString(meta, doc.id)
+		putUvarint(meta, uint64(srcOff[ord]))
+		putUvarint(meta, uint64(len(doc.src)))
+	}
+	putUvarint(meta, uint64(len(indexedFields)))
+	buf := new(bytes.Buffer)
+	for _, field := range indexedFields {
+		terms := make([]string, 0, len(postings[field]))
+		for term := range postings[field] {
+			terms = append(terms, term)
+		}
+		sort.Strings(terms)
+		putString(meta, field)
+		putUvarint(meta, uint64(len(terms)))
+		for _, term := range terms {
+			buf.Reset()
+			lists := postings[field][term]
+			ords := make([]int, 0, len(lists))
+			for ord := range lists {
+				ords = append(ords, ord)
+			}
+			sort.Ints(ords)
+			putUvarint(buf, uint64(len(ords)))
+			prevOrd := 0
+			for _, ord := range ords {
+				positions := lists[ord]
+				putUvarint(buf, uint64(ord-prevOrd))
+				prevOrd = ord
+				putUvarint(buf, uint64(len(positions)))
+				prevPos := 0
+				for _, p := range positions {
+					putUvarint(buf, uint64(p-prevPos))
+					prevPos = p
+				}
+			}
+			putString(meta, term)
+			putUvarint(meta, uint64(w.n))
+			putUvarint(meta, uint64(buf.Len()))
+			w.Write(buf.Bytes())
+		}
+	}
+
+	metaOff := w.n
+	w.Write(meta.Bytes())
+	footer := make([]byte, segmentFooterSize)
+	binary.LittleEndian.PutUint64(footer[0:], uint64(metaOff))
+	binary.LittleEndian.PutUint64(footer[8:], uint64(meta.Len()))
+	binary.LittleEndian.PutUint32(footer[16:], crc32.ChecksumIEEE(meta.Bytes()))
+	copy(footer[20:], segmentMagic)
+	w.Write(footer)
+
+	if w.err == nil {
+		w.err = w.w.(*bufio.Writer).Flush()
+	}
+	if w.err == nil {
+		w.err = f.Sync()
+	}
+	if err := f.Close(); w.err == nil {
+		w.err = err
+	}
+	if w.err != nil {
+		return w.err
+	}
+	return os.Rename(tmp, path)
+}
+
+func openSegment(path, name string) (*segment, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	seg, err := readSegmentMeta(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	seg.name = name
+	seg.f = f
+	return seg, nil
+}
+
+func readSegmentMeta(f *os.File) (*segment, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() < int64(len(segmentMagic)+segmentFooterSize) {
+		return nil, errCorruptSegment
+	}
+	footer := make([]byte, segmentFooterSize)
+	if _, err := f.ReadAt(footer, info.Size()-int64(segmentFooterSize)); err != nil {
+		return nil, err
+	}
+	if string(footer[20:]) != segmentMagic {
+		return nil, errCorruptSegment
+	}
+	metaOff := int64(binary.LittleEndian.Uint64(footer[0:]))
+	metaLen := int64(binary.LittleEndian.Uint64(footer[8:]))
+	if metaOff+metaLen+int64(segmentFooterSize) != info.Size() {
+		return nil, errCorruptSegment
+	}
+	meta := make([]byte, metaLen)
+	if _, err := f.ReadAt(meta, metaOff); err != nil {
+		return nil, err
+	}
+	if crc32.ChecksumIEEE(meta) != binary.LittleEndian.Uint32(footer[16:]) {
+		return nil, errCorruptSegment
+	}
+
+	r := bytes.NewReader(meta)
+	seg := &segment{fields: make(map[string]*segmentField)}
+	ndocs, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, errCorruptSegment
+	}
+	seg.ids = make([]string, ndocs)
+	seg.srcOff = make([]int64, ndocs)
+	seg.srcLen = make([]int64, ndocs)
+	for i := range seg.ids {
+		if seg.ids[i], err = readString(r); err != nil {
+			return nil, errCorruptSegment
+		}
+		off, err1 := binary.ReadUvarint(r)
+		size, err2 := binary.ReadUvarint(r)
+		if err1 != nil || err2 != nil {
+			return nil, errCorruptSegment
+		}
+		seg.srcOff[i] = int64(off)
+		seg.srcLen[i] = int64(size)
+	}
+	nfields, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, errCorruptSegment
+	}
+	for i := uint64(0); i < nfields; i++ {
+		name, err := readString(r)
+		if err != nil {
+			return nil, errCorruptSegment
+		}
+		nterms, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, errCorruptSegment
+		}
+		sf := &segmentField{
+			terms: make([]string, nterms),
+			off:   make([]int64, nterms),
+			size:  make([]int64, nterms),
+		}
+		for j := range sf.terms {
+			if sf.terms[j], err = readString(r); err != nil {
+				return nil, errCorruptSegment
+			}
+			off, err1 := binary.ReadUvarint(r)
+			size, err2 := binary.ReadUvarint(r)
+			if err1 != nil || err2 != nil {
+				return nil, errCorruptSegment
+			}
+			sf.off[j] = int64(off)
+			sf.size[j] = int64(size)
+		}
+		seg.fields[name] = sf
+	}
+	return seg, nil
+}
+
+func (s *segment) source(ord int) (json.RawMessage, error) {
+	src := make([]byte, s.srcLen[ord])
+	if _, err := s.f.ReadAt(src, s.srcOff[ord]); err != nil {
+		return nil, err
+	}
+	return src, nil
+}
+
+// postings returns doc ordinal -> positions for term in field.
+func (s *segment) postings(field, term string) (map[int][]int, error) {
+	sf, ok := s.fields[field]
+	if !ok {
+		return nil, nil
+	}
+	i := sort.SearchStrings(sf.terms, term)
+	if i == len(sf.terms) || sf.terms[i] != term {
+		return nil, nil
+	}
+	raw := make([]byte, sf.size[i])
+	if _, err := s.f.ReadAt(raw, sf.off[i]); err != nil {
+		return nil, err
+	}
+	r := bytes.NewReader(raw)
+	count, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, errCorruptSegment
+	}
+	lists := make(map[int][]int, count)
+	ord := 0
+	for n := uint64(0); n < count; n++ {
+		delta, err1 := binary.ReadUvarint(r)
+		freq, err2 := binary.ReadUvarint(r)
+		if err1 != nil || err2 != nil {
+			return nil, errCorruptSegment
+		}
+		ord += int(delta)
+		positions := make([]int, freq)
+		pos := 0
+		for k := range positions {
+			d, err := binary.ReadUvarint(r)
+			if err != nil {
+				return nil, errCorruptSegment
+			}
+			pos += int(d)
+			positions[k] = pos
+		}
+		lists[ord] = positions
+	}
+	return lists, nil
+}
+
+func (s *segment) close() error {
+	return s.f.Close()
+}
+
+type countingWriter struct {
+	w   io.Writer
+	n   int64
+	err error
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	c.err = err
+	return n, err
+}
+
+func putUvarint(b *bytes.Buffer, v uint64) {
+	var tmp [binary.MaxVarintLen64]byte
+	b.Write(tmp[:binary.PutUvarint(tmp[:], v)])
+}
+
+func putString(b *bytes.Buffer, s string) {
+	putUvarint(b, uint64(len(s)))
+	b.WriteString(s)
+}
+
+func readString(r *bytes.Reader) (string, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return "", err
+	}
+	if n > uint64(r.Len()) {
+		return "", errCorruptSegment
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
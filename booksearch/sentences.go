@@ -0,0 +1,582 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"github.com/olivere/elastic"
+)
+
+const (
+	elasticSentenceIndexName = "sentences"
+	maxSentenceContext       = 10
+	maxSentenceResults       = 100
+)
+
+// Sentence is one sentence of a book, indexed as a document of its own.
+// Start and End are byte offsets into Book.Content; Chapter is the index
+// of the innermost chapter holding it, 0 if the book has no outline. The
+// book title and the citation are stored with it, so a search need not
+// read the book.
+type Sentence struct {
+	BookID    string `json:"book_id"`
+	Title     string `json:"title,omitempty"`
+	Ordinal   int    `json:"ordinal"`
+	Paragraph int    `json:"paragraph"`
+	Chapter   int    `json:"chapter,omitempty"`
+	Start     int    `json:"start"`
+	End       int    `json:"end"`
+	Text      string `json:"text"`
+	// Structure places the sentence in a play or poem.
+	Structure *Structure `json:"structure,omitempty"`
+	Citation  string     `json:"citation,omitempty"`
+}
+
+func (s Sentence) docID() string {
+	return s.BookID + "-" + strconv.Itoa(s.Ordinal)
+}
+
+// sentenceAbbreviations end with a period without ending a sentence.
+var sentenceAbbreviations = map[string]bool{
+	"mr": true, "mrs": true, "messrs": true, "dr": true, "st": true, "mt": true,
+	"jr": true, "sr": true, "rev": true, "capt": true, "col": true, "gen": true,
+	"lieut": true, "sgt": true, "prof": true, "hon": true, "vs": true, "viz": true,
+	"no": true, "vol": true, "ch": true, "chap": true, "p": true, "pp": true,
+}
+
+// splitSentences splits the paragraphs of a book into sentences. A
+// sentence ends at ., ! or ? followed by closing quotes or brackets, then
+// white space and a capital, a digit or an opening quote; or at the end of
+// its paragraph or speech.
+func splitSentences(book bookText) []Sentence {
+	content, paragraphs := book.Content, book.Paragraphs
+	sentences := make([]Sentence, 0)
+	add := func(paragraph, start, end int) {
+		for start < end && isSpaceByte(content[start]) {
+			start++
+		}
+		for end > start && isSpaceByte(content[end-1]) {
+			end--
+		}
+		if start == end {
+			return
+		}
+		s := Sentence{
+			BookID:    book.ID,
+			Ordinal:   len(sentences),
+			Paragraph: paragraph,
+			Start:     start,
+			End:       end,
+			Text:      content[start:end],
+			Structure: structureAt(book, start),
+		}
+		// A sentence opening on a speaker's name alone is placed on the
+		// first line of the speech.
+		for at := start; s.Structure != nil && s.Structure.Line == 0; {
+			nl := strings.IndexByte(content[at:end], '\n')
+			if nl < 0 {
+				break
+			}
+			at += nl + 1
+			if next := structureAt(book, at); next.Line > 0 {
+				s.Structure = next
+			}
+		}
+		if ch := chapterAt(book.Chapters, start); ch != nil {
+			s.Chapter = ch.Index
+		}
+		s.Title = book.Title
+		s.Citation = citation(book.Title, s.Structure)
+		sentences = append(sentences, s)
+	}
+	for i, p := range paragraphs {
+		for _, sp := range speeches(content, p) {
+			start := sp.start
+			for j := sp.scan; j < sp.end; j++ {
+				if c := content[j]; c != '.' && c != '!' && c != '?' {
+					continue
+				}
+				end := j + 1
+				for end < sp.end {
+					r, size := utf8.DecodeRuneInString(content[end:])
+					if !strings.ContainsRune(`"')]’”»`, r) {
+						break
+					}
+					end += size
+				}
+				if end < sp.end && !isSpaceByte(content[end]) {
+					continue
+				}
+				next := end
+				for next < sp.end && isSpaceByte(content[next]) {
+					next++
+				}
+				if next < sp.end && !startsSentence(content[next:]) {
+					continue
+				}
+				if content[j] == '.' && isAbbreviation(content[start:j]) {
+					continue
+				}
+				add(i, start, end)
+				start = next
+				j = next - 1
+			}
+			add(i, start, sp.end)
+		}
+	}
+	return sentences
+}
+
+func startsSentence(s string) bool {
+	r, _ := utf8.DecodeRuneInString(s)
+	return unicode.IsUpper(r) || unicode.IsDigit(r) || strings.ContainsRune(`"'(‘“«—[_`, r)
+}
+
+// isAbbreviation reports whether text, the sentence up to a period, ends
+// in an abbreviation or an initial.
+func isAbbreviation(text string) bool {
+	word := text
+	if i := strings.LastIndexFunc(text, func(r rune) bool { return !unicode.IsLetter(r) }); i >= 0 {
+		_, size := utf8.DecodeRuneInString(text[i:])
+		word = text[i+size:]
+	}
+	if r, size := utf8.DecodeRuneInString(word); size == len(word) && r != 'I' {
+		return unicode.IsUpper(r)
+	}
+	return sentenceAbbreviations[strings.ToLower(word)]
+}
+
+func isSpaceByte(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r'
+}
+
+// SentenceStore holds the sentence documents of every book. Search runs
+// the same span queries as BookStore over the "text" field; Ranges reads
+// the sentences of several ordinal ranges at once, in no particular order.
+type SentenceStore interface {
+	Put(ctx context.Context, bookID string, sentences []Sentence) error
+	Delete(ctx context.Context, bookID string) error
+	Search(ctx context.Context, q SpanQuery) ([]SearchHit, error)
+	Ranges(ctx context.Context, ranges []SentenceRange) ([]Sentence, error)
+}
+
+// SentenceRange is the sentences of a book with ordinals from From up to,
+// not including, To.
+type SentenceRange struct {
+	BookID   string
+	From, To int
+}
+
+// MemorySentenceStore is the SentenceStore of the memory and embedded
+// engines. Sentences are derived from the book text, so the embedded
+// engine rebuilds it at startup instead of persisting it.
+type MemorySentenceStore struct {
+	mu     sync.Mutex
+	docs   *MemoryStore
+	counts map[string]int
+}
+
+func NewMemorySentenceStore() *MemorySentenceStore {
+	return &MemorySentenceStore{
+		docs:   newMemoryStore([]string{"text"}),
+		counts: make(map[string]int),
+	}
+}
+
+func (s *MemorySentenceStore) Put(ctx context.Context, bookID string, sentences []Sentence) error {
+	srcs := make([]json.RawMessage, len(sentences))
+	for i, sentence := range sentences {
+		src, err := json.Marshal(sentence)
+		if err != nil {
+			return err
+		}
+		srcs[i] = src
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.docs.mu.Lock()
+	defer s.docs.mu.Unlock()
+	s.removeLocked(bookID)
+	for i, sentence := range sentences {
+		s.docs.put(sentence.docID(), srcs[i])
+	}
+	s.counts[bookID] = len(sentences)
+	return nil
+}
+
+func (s *MemorySentenceStore) Delete(ctx context.Context, bookID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.docs.mu.Lock()
+	defer s.docs.mu.Unlock()
+	s.removeLocked(bookID)
+	return nil
+}
+
+func (s *MemorySentenceStore) removeLocked(bookID string) {
+	for i := 0; i < s.counts[bookID]; i++ {
+		id := Sentence{BookID: bookID, Ordinal: i}.docID()
+		s.docs.remove(id)
+		delete(s.docs.docs, id)
+		delete(s.docs.versions, id)
+	}
+	delete(s.counts, bookID)
+}
+
+func (s *MemorySentenceStore) Search(ctx context.Context, q SpanQuery) ([]SearchHit, error) {
+	return s.docs.Search(ctx, q)
+}
+
+func (s *MemorySentenceStore) Ranges(ctx context.Context, ranges []SentenceRange) ([]Sentence, error) {
+	sentences := make([]Sentence, 0)
+	for _, r := range ranges {
+		for i := r.From; i < r.To; i++ {
+			src, err := s.docs.Get(ctx, Sentence{BookID: r.BookID, Ordinal: i}.docID())
+			if err == ErrNotFound {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			var sentence Sentence
+			if err := json.Unmarshal(src, &sentence); err != nil {
+				return nil, err
+			}
+			sentences = append(sentences, sentence)
+		}
+	}
+	return sentences, nil
+}
+
+// ElasticSentenceStore keeps sentences in an index of their own, one
+// document per sentence with IDs "<book>-<ordinal>".
+type ElasticSentenceStore struct {
+	*ElasticStore
+}
+
+func NewElasticSentenceStore(client *elastic.Client, index, typ string) *ElasticSentenceStore {
+	return &ElasticSentenceStore{NewElasticStore(client, index, typ)}
+}
+
+// Put indexes the sentences of a book, then drops the ones left over from
+// a longer earlier version.
+func (s *ElasticSentenceStore) Put(ctx context.Context, bookID string, sentences []Sentence) error {
+	defer holdWrites(s.index, bookID)()
+	if len(sentences) > 0 {
+		bulk := s.client.Bulk()
+		for _, sentence := range sentences {
+			bulk = bulk.Add(s.bulkIndex(sentence.docID(), sentence))
+		}
+		res, err := bulk.Do(ctx)
+		if err != nil {
+			return err
+		}
+		if err := bulkFailure(res); err != nil {
+			return fmt.Errorf("indexing sentences of book %s: %v", bookID, err)
+		}
+	}
+	return s.deleteFrom(ctx, bookID, len(sentences))
+}
+
+func (s *ElasticSentenceStore) Delete(ctx context.Context, bookID string) error {
+	defer holdWrites(s.index, bookID)()
+	return s.deleteFrom(ctx, bookID, 0)
+}
+
+func (s *ElasticSentenceStore) deleteFrom(ctx context.Context, bookID string, ordinal int) error {
+	query := elastic.NewBoolQuery().
+		Filter(elastic.NewTermQuery("book_id.keyword", bookID)).
+		Filter(elastic.NewRangeQuery("ordinal").Gte(ordinal))
+	// Refreshed, so a search right after the write does not see the
+	// sentences it dropped.
+	del := s.client.DeleteByQuery(s.index).Query(query).ProceedOnVersionConflict().Refresh("true")
+	if !s.typeless() {
+		del = del.Type(s.typ)
+	}
+	_, err := del.Do(ctx)
+	if elastic.IsNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+func (s *ElasticSentenceStore) Ranges(ctx context.Context, ranges []SentenceRange) ([]Sentence, error) {
+	if len(ranges) == 0 {
+		return nil, nil
+	}
+	should := make([]map[string]interface{}, len(ranges))
+	size := 0
+	for i, r := range ranges {
+		should[i] = map[string]interface{}{
+			"bool": map[string]interface{}{
+				"filter": []map[string]interface{}{
+					{"term": map[string]interface{}{"book_id.keyword": r.BookID}},
+					{"range": map[string]interface{}{"ordinal": map[string]interface{}{"gte": r.From, "lt": r.To}}},
+				},
+			},
+		}
+		size += r.To - r.From
+	}
+	body := map[string]interface{}{
+		"query": map[string]interface{}{
+			"bool": map[string]interface{}{"should": should, "minimum_should_match": 1},
+		},
+		"size": size,
+	}
+	result, err := rawSearch(ctx, s.client, s.index, body)
+	if err != nil {
+		return nil, err
+	}
+	sentences := make([]Sentence, 0, len(result.Hits.Hits))
+	for _, hit := range result.Hits.Hits {
+		var sentence Sentence
+		if err := json.Unmarshal(hit.Source, &sentence); err != nil {
+			return nil, err
+		}
+		sentences = append(sentences, sentence)
+	}
+	return sentences, nil
+}
+
+// sentenceIndexingStore is the BookStore the handlers and the crawler
+// write through: it keeps the sentence documents of each book in step with
+// the book document.
+type sentenceIndexingStore struct {
+	BookStore
+	sentences SentenceStore
+}
+
+func (s sentenceIndexingStore) Index(ctx context.Context, book Book) error {
+	if err := s.BookStore.Index(ctx, book); err != nil {
+		return err
+	}
+	return s.putSentences(ctx, book)
+}
+
+func (s sentenceIndexingStore) Create(ctx context.Context, book Book) error {
+	if err := s.BookStore.Create(ctx, book); err != nil {
+		return err
+	}
+	return s.putSentences(ctx, book)
+}
+
+func (s sentenceIndexingStore) Replace(ctx context.Context, book Book, ifMatch Version) (Version, error) {
+	v, err := s.BookStore.Replace(ctx, book, ifMatch)
+	if err != nil {
+		return v, err
+	}
+	return v, s.putSentences(ctx, book)
+}
+
+// Update only touches the sentences when the content changes.
+func (s sentenceIndexingStore) Update(ctx context.Context, book Book) error {
+	if err := s.BookStore.Update(ctx, book); err != nil {
+		return err
+	}
+	if book.Content == "" {
+		return nil
+	}
+	return s.putSentences(ctx, book)
+}
+
+func (s sentenceIndexingStore) Delete(ctx context.Context, id string) (*DeleteResult, error) {
+	res, err := s.BookStore.Delete(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return res, s.sentences.Delete(ctx, id)
+}
+
+func (s sentenceIndexingStore) DeleteIf(ctx context.Context, id string, ifMatch Version) (*DeleteResult, error) {
+	res, err := s.BookStore.DeleteIf(ctx, id, ifMatch)
+	if err != nil {
+		return nil, err
+	}
+	return res, s.sentences.Delete(ctx, id)
+}
+
+func (s sentenceIndexingStore) Bulk(ctx context.Context, books []Book) error {
+	err := s.BookStore.Bulk(ctx, books)
+	bulkErr, partial := err.(*BulkError)
+	if err != nil && !partial {
+		return err
+	}
+	for _, book := range books {
+		if partial && bulkErr.Failed[book.ID] != nil {
+			continue
+		}
+		if err := s.putSentences(ctx, book); err != nil {
+			return err
+		}
+	}
+	return err
+}
+
+func (s sentenceIndexingStore) putSentences(ctx context.Context, book Book) error {
+	text := bookText{
+		ID:         book.ID,
+		Title:      book.Title,
+		Content:    book.Content,
+		Paragraphs: book.Paragraphs,
+		Chapters:   book.Chapters,
+		Form:       book.Form,
+	}
+	if text.Paragraphs == nil {
+		text.Paragraphs = splitParagraphs(text.Content)
+		text.Chapters = detectChapters(text.Content, text.Paragraphs)
+		text.Form = detectStructure(text.Content, text.Paragraphs, text.Chapters)
+	}
+	return s.sentences.Put(ctx, book.ID, splitSentences(text))
+}
+
+// rebuildSentences indexes the sentences of the books already in store.
+func rebuildSentences(ctx context.Context, store BookStore, sentences SentenceStore, ids []string) {
+	sort.Strings(ids)
+	for _, id := range ids {
+		src, err := store.Get(ctx, id)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		book, err := decodeBookText(src)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		if err := sentences.Put(ctx, id, splitSentences(book)); err != nil {
+			log.Println(err)
+		}
+	}
+	log.Printf("sentences: rebuilt for %d books", len(ids))
+}
+
+// SentenceResult is a matching sentence with the sentences around it.
+type SentenceResult struct {
+	Sentence
+	Highlight []string   `json:"highlight,omitempty"`
+	Before    []Sentence `json:"before"`
+	After     []Sentence `json:"after"`
+}
+
+// sentenceSearchEndpoint finds the sentences matching a query and returns
+// each with context sentences on either side, read from the sentence
+// store in one go.
+func sentenceSearchEndpoint(c *gin.Context) {
+	terms := normalizeQuery(c.Query("query"))
+	if len(terms) == 0 {
+		errorResponse(c, http.StatusBadRequest, "Query has no searchable terms")
+		return
+	}
+	around, _ := strconv.Atoi(c.DefaultQuery("context", "1"))
+	if around < 0 {
+		around = 0
+	}
+	if around > maxSentenceContext {
+		around = maxSentenceContext
+	}
+	from, err := strconv.Atoi(c.DefaultQuery("from", "0"))
+	if err != nil || from < 0 {
+		errorResponse(c, http.StatusBadRequest, "from must be a number of results, 0 or more")
+		return
+	}
+	size, err := strconv.Atoi(c.DefaultQuery("size", "10"))
+	if err != nil || size < 1 {
+		errorResponse(c, http.StatusBadRequest, "size must be a number of results, 1 or more")
+		return
+	}
+	if size > maxSentenceResults {
+		size = maxSentenceResults
+	}
+
+	q := newSpanQuery("text", terms)
+	q.HighlightField = "text"
+	q.From, q.Size = from, size
+	if id := c.Query("book_id"); id != "" {
+		q.Filters = map[string][]string{"book_id": {id}}
+	}
+	hits, err := sentenceStore.Search(c, q)
+	if err != nil {
+		log.Println(err)
+		errorResponse(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	results := make([]SentenceResult, 0, len(hits))
+	var ranges []SentenceRange
+	for _, hit := range hits {
+		var s Sentence
+		if err := json.Unmarshal(hit.Source, &s); err != nil {
+			log.Println(err)
+			continue
+		}
+		lo := s.Ordinal - around
+		if lo < 0 {
+			lo = 0
+		}
+		ranges = append(ranges, SentenceRange{BookID: s.BookID, From: lo, To: s.Ordinal + around + 1})
+		results = append(results, SentenceResult{Sentence: s, Highlight: hit.Highlight["text"]})
+	}
+	if around > 0 {
+		near, err := sentenceStore.Ranges(c, ranges)
+		if err != nil {
+			log.Println(err)
+			errorResponse(c, http.StatusInternalServerError, err.Error())
+			return
+		}
+		byID := make(map[string]Sentence, len(near))
+		for _, s := range near {
+			// The title is the match's to report.
+			s.Title = ""
+			byID[s.docID()] = s
+		}
+		for i := range results {
+			r := &results[i]
+			for o := ranges[i].From; o < ranges[i].To; o++ {
+				s, ok := byID[Sentence{BookID: r.BookID, Ordinal: o}.docID()]
+				switch {
+				case !ok:
+				case o < r.Ordinal:
+					r.Before = append(r.Before, s)
+				case o > r.Ordinal:
+					r.After = append(r.After, s)
+				}
+			}
+		}
+	}
+	titles := make(map[string]string)
+	for i := range results {
+		r := &results[i]
+		if r.Before == nil {
+			r.Before = []Sentence{}
+		}
+		if r.After == nil {
+			r.After = []Sentence{}
+		}
+		if r.Title == "" {
+			// Indexed before sentences carried the title: read it from
+			// the book, once per book.
+			title, ok := titles[r.BookID]
+			if !ok {
+				if src, err := bookStore.Get(c, r.BookID); err == nil {
+					if book, err := decodeBookText(src); err == nil {
+						title = book.Title
+					}
+				}
+				titles[r.BookID] = title
+			}
+			r.Title = title
+			r.Citation = citation(title, r.Structure)
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"sentences": results})
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+var (
+	ErrNotFound = errors.New("book not found")
+	ErrConflict = errors.New("book already exists")
+	// ErrPreconditionFailed is returned by Replace when the book is no
+	// longer at the version the caller read.
+	ErrPreconditionFailed = errors.New("book was changed since it was read")
+)
+
+// Version identifies one revision of a stored book: its sequence number
+// and primary term in Elasticsearch. The other stores count writes per
+// book and use the time the process started as the term, so versions read
+// before a restart never match.
+type Version struct {
+	SeqNo       int64
+	PrimaryTerm int64
+}
+
+// ETag renders v as a strong entity tag.
+func (v Version) ETag() string {
+	return fmt.Sprintf(`"%d-%d"`, v.SeqNo, v.PrimaryTerm)
+}
+
+// processTerm is the primary term of the memory and embedded stores.
+var processTerm = time.Now().UnixNano()
+
+// BookStore is the storage backend behind the HTTP handlers and the crawler.
+type BookStore interface {
+	Get(ctx context.Context, id string) (json.RawMessage, error)
+	Index(ctx context.Context, book Book) error
+	// Create stores a book that must not exist yet, or returns ErrConflict.
+	Create(ctx context.Context, book Book) error
+	Update(ctx context.Context, book Book) error
+	// GetVersion is Get with the version of the book.
+	GetVersion(ctx context.Context, id string) (json.RawMessage, Version, error)
+	// Replace overwrites an existing book if it is still at version ifMatch,
+	// and returns its new version.
+	Replace(ctx context.Context, book Book, ifMatch Version) (Version, error)
+	// UpdateFields merges fields into the top level of an existing book if
+	// it is still at version ifMatch; a nil value clears its field. The
+	// fields must not include the content, whose sentences are left as
+	// they are.
+	UpdateFields(ctx context.Context, id string, fields map[string]interface{}, ifMatch Version) (Version, error)
+	Delete(ctx context.Context, id string) (*DeleteResult, error)
+	// DeleteIf deletes an existing book if it is still at version ifMatch.
+	DeleteIf(ctx context.Context, id string, ifMatch Version) (*DeleteResult, error)
+	Bulk(ctx context.Context, books []Book) error
+	Search(ctx context.Context, q SpanQuery) ([]SearchHit, error)
+	// Export calls fn with every book selected by q, reading a bounded
+	// number at a time. An error from fn stops the export.
+	Export(ctx context.Context, q ExportQuery, fn func(json.RawMessage) error) error
+	// List returns a page of the books selected by q, in its order.
+	List(ctx context.Context, q ListQuery) (ListPage, error)
+}
+
+// SpanQuery is an ordered (or unordered) span_near query over fuzzy terms.
+type SpanQuery struct {
+	Field          string
+	Terms          []string
+	Fuzziness      []int
+	Slop           int
+	InOrder        bool
+	From           int
+	Size           int
+	HighlightField string
+	// Filters restricts hits to documents where every field holds one of
+	// the listed values exactly. Dotted fields reach into nested objects.
+	Filters map[string][]string
+	// ReleasedFrom (inclusive) and ReleasedBefore (exclusive) restrict
+	// hits to books released between them; nil leaves that end open.
+	ReleasedFrom   *time.Time
+	ReleasedBefore *time.Time
+}
+
+type SearchHit struct {
+	ID        string
+	Source    json.RawMessage
+	Highlight map[string][]string
+	// Score is the store's own relevance score, zero for stores that only
+	// match spans.
+	Score float64
+}
+
+// BulkError is returned by Bulk when some of the books were not stored;
+// the others were.
+type BulkError struct {
+	Failed map[string]error
+}
+
+func (e *BulkError) Error() string {
+	ids := make([]string, 0, len(e.Failed))
+	for id := range e.Failed {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return fmt.Sprintf("bulk: %d items failed, first %s: %v", len(ids), ids[0], e.Failed[ids[0]])
+}
+
+type DeleteResult struct {
+	Index   string `json:"_index,omitempty"`
+	Type    string `json:"_type,omitempty"`
+	ID      string `json:"_id,omitempty"`
+	Version int64  `json:"_version,omitempty"`
+	Result  string `json:"result,omitempty"`
+}
+
+func newSpanQuery(field string, terms []string) SpanQuery {
+	fuzziness := make([]int, len(terms))
+	for i, term := range terms {
+		fuzziness[i] = getMaxFuzzy(len(term))
+	}
+	return SpanQuery{
+		Field:          field,
+		Terms:          terms,
+		Fuzziness:      fuzziness,
+		Slop:           1,
+		InOrder:        true,
+		HighlightField: "content",
+	}
+}
+
+// filtered reports whether q restricts hits by more than its terms.
+func (q SpanQuery) filtered() bool {
+	return len(q.Filters) > 0 || q.ReleasedFrom != nil || q.ReleasedBefore != nil
+}
+
+// matchSource reports whether the document src passes the filters and the
+// release range of q.
+func (q SpanQuery) matchSource(src json.RawMessage) bool {
+	if !matchFilters(src, q.Filters) {
+		return false
+	}
+	if q.ReleasedFrom == nil && q.ReleasedBefore == nil {
+		return true
+	}
+	var doc struct {
+		ReleasedAt *time.Time `json:"released_at"`
+	}
+	if err := json.Unmarshal(src, &doc); err != nil {
+		return false
+	}
+	return inRange(doc.ReleasedAt, q.ReleasedFrom, q.ReleasedBefore)
+}
+
+// matchFilters reports whether the document src passes q.Filters.
+func matchFilters(src json.RawMessage, filters map[string][]string) bool {
+	if len(filters) == 0 {
+		return true
+	}
+	var doc interface{}
+	if err := json.Unmarshal(src, &doc); err != nil {
+		return false
+	}
+	for field, want := range filters {
+		found := false
+		for _, v := range sourceValues(doc, strings.Split(field, ".")) {
+			for _, w := range want {
+				if v == w {
+					found = true
+				}
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// sourceValues collects the scalar values at path in a decoded document,
+// flattening arrays along the way.
+func sourceValues(doc interface{}, path []string) []string {
+	switch v := doc.(type) {
+	case []interface{}:
+		var values []string
+		for _, item := range v {
+			values = append(values, sourceValues(item, path)...)
+		}
+		return values
+	case map[string]interface{}:
+		if len(path) == 0 {
+			return nil
+		}
+		return sourceValues(v[path[0]], path[1:])
+	case nil:
+		return nil
+	default:
+		if len(path) > 0 {
+			return nil
+		}
+		return []string{fmt.Sprint(v)}
+	}
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	formProse = "prose"
+	formPlay  = "play"
+	formVerse = "verse"
+
+	// maxVerseLine is the longest line still read as a line of verse;
+	// prose in Gutenberg texts is wrapped at about 70 characters.
+	maxVerseLine = 55
+)
+
+// Structure places a passage or sentence in a play or poem: act, scene
+// and speaker for plays, stanza for verse, and the line number in the
+// scene or poem.
+type Structure struct {
+	Form    string `json:"form"`
+	Act     int    `json:"act,omitempty"`
+	Scene   int    `json:"scene,omitempty"`
+	Speaker string `json:"speaker,omitempty"`
+	Stanza  int    `json:"stanza,omitempty"`
+	Line    int    `json:"line,omitempty"`
+}
+
+var (
+	// "HAMLET. To be, or not to be" and "HAMLET." on a line of its own.
+	capsSpeakerRe = regexp.MustCompile(`^\s*([A-Z][A-Z'’\- ]{0,28}[A-Z])\s*[.:](?:\s+(\S.*))?$`)
+	// "  Ham. To be, or not to be", as in the oldest play texts.
+	abbrevSpeakerRe = regexp.MustCompile(`^ {1,4}([A-Z][a-z]{1,11}(?: [A-Z][a-z]{1,11})?)\.\s+(\S.*)$`)
+	stageRe         = regexp.MustCompile(`^(?:\[|\(|(?:Enter|Exit|Exeunt|Re-enter|Manet|Flourish|Alarum|Alarums|Sennet|Trumpets|Dies|Dying)\b)`)
+	// Line numbers printed in the right margin.
+	marginNumberRe = regexp.MustCompile(`\S\s{2,}(\d{1,4})$`)
+)
+
+// notSpeakers are capitalized lines that end like a speaker prefix.
+var notSpeakers = map[string]bool{
+	"THE END": true, "END": true, "FINIS": true, "EXIT": true, "EXEUNT": true,
+	"CURTAIN": true, "DRAMATIS PERSONAE": true, "PERSONS REPRESENTED": true,
+}
+
+// detectStructure decides whether a book is prose, a play or verse and,
+// for plays and verse, fills in the line numbers and speakers of its
+// paragraphs. Lines are numbered within each scene of a play, counting
+// spoken lines only, and within each chapter of verse; numbers printed in
+// the margin take precedence over the count.
+func detectStructure(content string, paragraphs []Paragraph, chapters []Chapter) string {
+	form := formProse
+	switch {
+	case isPlay(content, paragraphs, chapters):
+		form = formPlay
+	case isVerse(content, paragraphs, chapters):
+		form = formVerse
+	default:
+		return form
+	}
+	abbreviated := hasChapterKind(chapters, "act") || hasChapterKind(chapters, "scene")
+
+	headings := make(map[int]bool, len(chapters))
+	for _, ch := range chapters {
+		headings[ch.Start] = true
+	}
+	line, speaker := 0, ""
+	chapter := -1
+	for i := range paragraphs {
+		p := &paragraphs[i]
+		if at := chapterIndexAt(chapters, p.Start); at != chapter {
+			chapter, line, speaker = at, 0, ""
+		}
+		if headings[p.Start] {
+			continue
+		}
+		p.LineNumbers = make([]int, len(p.Lines))
+		if form == formPlay {
+			p.Speakers = make([]string, len(p.Lines))
+		}
+		for j := range p.Lines {
+			raw := content[p.Lines[j]:lineEnd(*p, j)]
+			if form == formPlay {
+				name, speech := speakerPrefix(raw, abbreviated)
+				switch {
+				case name != "":
+					speaker = name
+					if speech == "" {
+						p.Speakers[j] = speaker
+						continue
+					}
+				case stageRe.MatchString(strings.TrimSpace(raw)):
+					if j == 0 {
+						// A stage direction between speeches.
+						speaker = ""
+					}
+					continue
+				case speaker == "":
+					continue
+				}
+				p.Speakers[j] = speaker
+			}
+			line++
+			if m := marginNumberRe.FindStringSubmatch(raw); m != nil {
+				line, _ = strconv.Atoi(m[1])
+			}
+			p.LineNumbers[j] = line
+		}
+	}
+	return form
+}
+
+// speech is a stretch of a paragraph spoken by one speaker; scan is where
+// the speech proper starts, after the speaker's name.
+type speech struct {
+	start, scan, end int
+}
+
+// speeches splits a paragraph of a play where the speaker changes, so no
+// sentence runs from one speech into the next. Other paragraphs are one
+// speech.
+func speeches(content string, p Paragraph) []speech {
+	if len(p.Speakers) == 0 {
+		return []speech{{p.Start, p.Start, p.End}}
+	}
+	var out []speech
+	for j := range p.Lines {
+		if j > 0 && (p.Speakers[j] == "" || p.Speakers[j] == p.Speakers[j-1]) {
+			continue
+		}
+		if len(out) > 0 {
+			out[len(out)-1].end = p.Lines[j] - 1
+		}
+		sp := speech{p.Lines[j], p.Lines[j], p.End}
+		raw := content[p.Lines[j]:lineEnd(p, j)]
+		if name, _ := speakerPrefix(raw, true); name != "" {
+			sp.scan += strings.Index(raw, name) + len(name) + 1
+		}
+		out = append(out, sp)
+	}
+	return out
+}
+
+// speakerPrefix returns the speaker named at the start of a line of a
+// play and the speech that follows the name on the same line, if any.
+func speakerPrefix(line string, abbreviated bool) (string, string) {
+	if _, ok := parseHeading(strings.TrimSpace(line)); ok {
+		return "", ""
+	}
+	if m := capsSpeakerRe.FindStringSubmatch(line); m != nil && !notSpeakers[m[1]] && len(strings.Fields(m[1])) <= 4 {
+		return m[1], m[2]
+	}
+	if abbreviated {
+		if m := abbrevSpeakerRe.FindStringSubmatch(line); m != nil && !stageRe.MatchString(m[1]) {
+			return m[1], m[2]
+		}
+	}
+	return "", ""
+}
+
+// isPlay: a book with ACT or SCENE headings, or one where many paragraphs
+// open with a speaker's name in capitals.
+func isPlay(content string, paragraphs []Paragraph, chapters []Chapter) bool {
+	if hasChapterKind(chapters, "act") || hasChapterKind(chapters, "scene") {
+		return true
+	}
+	speeches := 0
+	for _, p := range paragraphs {
+		if name, _ := speakerPrefix(content[p.Start:lineEnd(p, 0)], false); name != "" {
+			speeches++
+		}
+	}
+	return speeches >= 20 && speeches*4 >= len(paragraphs)
+}
+
+// isVerse: most paragraphs of more than one line are stanzas of short
+// lines.
+func isVerse(content string, paragraphs []Paragraph, chapters []Chapter) bool {
+	headings := make(map[int]bool, len(chapters))
+	for _, ch := range chapters {
+		headings[ch.Start] = true
+	}
+	stanzas, total := 0, 0
+	for _, p := range paragraphs {
+		if len(p.Lines) < 2 || headings[p.Start] {
+			continue
+		}
+		total++
+		short := true
+		for _, line := range paragraphLines(content, p) {
+			if len(line) > maxVerseLine {
+				short = false
+				break
+			}
+		}
+		if short {
+			stanzas++
+		}
+	}
+	return stanzas >= 3 && stanzas*10 >= total*6
+}
+
+func hasChapterKind(chapters []Chapter, kind string) bool {
+	for _, ch := range chapters {
+		if ch.Kind == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// chapterIndexAt returns the index of the innermost chapter holding
+// offset, or -1.
+func chapterIndexAt(chapters []Chapter, offset int) int {
+	if ch := chapterAt(chapters, offset); ch != nil {
+		return ch.Index
+	}
+	return -1
+}
+
+// lineEnd returns the offset past the end of line j of a paragraph.
+func lineEnd(p Paragraph, j int) int {
+	if j+1 < len(p.Lines) {
+		return p.Lines[j+1] - 1
+	}
+	return p.End
+}
+
+// structureAt describes where offset falls in a play or poem, or returns
+// nil for prose.
+func structureAt(book bookText, offset int) *Structure {
+	if book.Form != formPlay && book.Form != formVerse {
+		return nil
+	}
+	s := &Structure{Form: book.Form}
+	for _, ch := range book.Chapters {
+		if ch.Start > offset {
+			break
+		}
+		if offset >= ch.End {
+			continue
+		}
+		switch ch.Kind {
+		case "act":
+			s.Act = ch.Number
+		case "scene":
+			s.Scene = ch.Number
+		}
+	}
+	i := paragraphAt(book.Paragraphs, offset)
+	if i >= len(book.Paragraphs) {
+		return s
+	}
+	p := book.Paragraphs[i]
+	j := 0
+	for j+1 < len(p.Lines) && p.Lines[j+1] <= offset {
+		j++
+	}
+	if j < len(p.LineNumbers) {
+		s.Line = p.LineNumbers[j]
+	}
+	if j < len(p.Speakers) {
+		s.Speaker = p.Speakers[j]
+	}
+	if book.Form == formVerse {
+		// Stanzas are counted from the start of the chapter.
+		chapter := chapterIndexAt(book.Chapters, offset)
+		for k := i; k >= 0 && chapterIndexAt(book.Chapters, book.Paragraphs[k].Start) == chapter; k-- {
+			if len(book.Paragraphs[k].LineNumbers) > 0 {
+				s.Stanza++
+			}
+		}
+	}
+	return s
+}
+
+// citation renders a structure as "Hamlet, Act III, Scene 1, spoken by
+// HAMLET, line 56".
+func citation(title string, s *Structure) string {
+	if s == nil {
+		return ""
+	}
+	parts := []string{title}
+	if s.Act > 0 {
+		parts = append(parts, "Act "+formatRoman(s.Act))
+	}
+	if s.Scene > 0 {
+		parts = append(parts, fmt.Sprintf("Scene %d", s.Scene))
+	}
+	if s.Speaker != "" {
+		parts = append(parts, "spoken by "+s.Speaker)
+	}
+	if s.Stanza > 0 {
+		parts = append(parts, fmt.Sprintf("stanza %d", s.Stanza))
+	}
+	if s.Line > 0 {
+		parts = append(parts, fmt.Sprintf("line %d", s.Line))
+	}
+	return strings.Join(parts, ", ")
+}